@@ -42,9 +42,19 @@ func HandlerEx(find FindModule, extra any, h *stdhttp.HTTP, id uint64, prefix st
 
 	processed = true
 
+	// Версия API по заголовкам. Ошибка отдается после подготовки proc
+	byHeaders := module.versions != nil
+	module, versionErr := module.selectVersion(r)
+
+	// Вложенный модуль
+	if child := module.findChild(tail); child != nil {
+		module = child
+	}
+
 	proc := newProcOptions()
 	defer proc.free()
 	proc.handler = module.Handler
+	proc.module = module
 	proc.LogFacility = module.LogFacility
 	proc.H = h
 	proc.LogSrc = fmt.Sprintf("%d", id)
@@ -63,6 +73,19 @@ func HandlerEx(find FindModule, extra any, h *stdhttp.HTTP, id uint64, prefix st
 	var result any
 	var code int
 
+	if versionErr != nil {
+		proc.reply(nil, http.StatusBadRequest, versionErr)
+		return
+	}
+
+	if proc.Info.Version != "" {
+		proc.ExtraHeaders[VersionHeader] = proc.Info.Version
+	}
+
+	if byHeaders {
+		proc.addVary(VersionHeader, "Accept")
+	}
+
 	proc.AuthIdentity, err = stdhttp.GetIdentityFromRequestContext(r)
 	if err != nil {
 		proc.reply(result, code, err)
@@ -73,6 +96,17 @@ func HandlerEx(find FindModule, extra any, h *stdhttp.HTTP, id uint64, prefix st
 		r.Method = stdhttp.MethodPOST // Это ответ kAPI"
 	}
 
+	if proc.cors() {
+		return
+	}
+
+	if proc.options() {
+		return
+	}
+
+	proc.headAsGet()
+	r = proc.R
+
 	proc.Chain, proc.PathParams, result, code, err = module.Info.Methods.Find(r.Method, tail)
 
 	if err != nil || code != 0 || !misc.IsNil(result) {
@@ -80,11 +114,29 @@ func HandlerEx(find FindModule, extra any, h *stdhttp.HTTP, id uint64, prefix st
 		return
 	}
 
+	if module.parent != nil {
+		proc.ParentKey, err = module.Info.Parent.parseKey(tail[0])
+		if err != nil {
+			code = http.StatusNotFound
+			proc.reply(nil, code, err)
+			return
+		}
+	}
+
 	// Копия Chain для возможности ее модификации для работы с динамическими объектами. Рекомендуется использовать её, а не Chain.Parent
 	proc.ChainLocal = *proc.Chain
 
+	proc.deprecation()
+	proc.corsExpose()
+
 	proc.Scope = proc.Chain.Scope
 
+	if proc.Info.Flags&FlagSubscriptions != 0 && r.Method == stdhttp.MethodGET && isWebSocketRequest(r) {
+		// Подписка на изменения
+		proc.subscribe()
+		return
+	}
+
 	if proc.ChainLocal.Params.Flags&path.FlagDontReadBody == 0 {
 		code, err = proc.readBody()
 		if err != nil {
@@ -165,51 +217,11 @@ func (proc *ProcOptions) readBody() (code int, err error) {
 //----------------------------------------------------------------------------------------------------------------------------//
 
 // Поиск обработчкика для запроса по его URL
-func findModule(path string) (module *Module, basePath string, extraPath []string, found bool) {
-	found = false
-
-	p := path
-	n := 0
-
-	for {
-		modulesMutex.RLock()
-		module, found = modules[p]
-		modulesMutex.RUnlock()
-
-		if found {
-			basePath = p
-			if n > 0 {
-				tail := path[len(p)+1:]
-
-				extraPath = strings.Split(strings.Trim(tail, "/"), "/")
-				if len(extraPath) == 1 && extraPath[0] == "" {
-					extraPath = []string{}
-				} else {
-					for i, p := range extraPath {
-						extraPath[i], _ = url.PathUnescape(p)
-					}
-				}
-			}
-
-			return
-		}
-
-		i := strings.LastIndexByte(p, '/')
-		if i < 0 {
-			return
-		}
-
-		p = p[:i]
-		if p == "" {
-			return
-		}
-		n++
-	}
-}
-
 //----------------------------------------------------------------------------------------------------------------------------//
 
 func (proc *ProcOptions) reply(result any, code int, err error) {
+	proc.deprecation()
+
 	if proc.Info.ResultTuner != nil {
 		result, code, err = proc.Info.ResultTuner(proc, result, code, err)
 	}
@@ -255,8 +267,16 @@ func (proc *ProcOptions) reply(result any, code int, err error) {
 		}
 
 	case http.StatusMethodNotAllowed:
+		allow := proc.allowHeader()
+		if allow != "" {
+			proc.W.Header().Set(HTTPheaderAllow, allow)
+		}
 		if err == nil {
-			code, err = NotAllowed("")
+			if allow != "" {
+				code, err = NotAllowed("allowed: %s", allow)
+			} else {
+				code, err = NotAllowed("")
+			}
 		}
 
 	case http.StatusNotFound:
@@ -270,6 +290,21 @@ func (proc *ProcOptions) reply(result any, code int, err error) {
 		return
 	}
 
+	if code == http.StatusOK && proc.R.Method == stdhttp.MethodGET {
+		var src any
+		if !readyAnswer {
+			src = result
+		}
+
+		if proc.httpCache(src) {
+			err = proc.writeReply(http.StatusNotModified, "", nil)
+			if err != nil {
+				proc.LogFacility.Message(log.NOTICE, "[%d] WriteReply error (client may have disconnected): %s", proc.ID, err)
+			}
+			return
+		}
+	}
+
 	var data []byte
 	contentType := proc.httpContentType()
 
@@ -324,7 +359,7 @@ func (proc *ProcOptions) reply(result any, code int, err error) {
 
 	proc.LogFacility.Message(log.TRACE3, `[%d] WriteReply: %d (%s)`, proc.ID, code, contentType)
 
-	err = stdhttp.WriteReply(proc.W, proc.R, code, contentType, proc.ExtraHeaders, data)
+	err = proc.writeReply(code, contentType, data)
 	if err != nil {
 		proc.LogFacility.Message(log.NOTICE, "[%d] WriteReply error (client may have disconnected): %s", proc.ID, err)
 	}
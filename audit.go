@@ -0,0 +1,64 @@
+package rest
+
+import (
+	"reflect"
+
+	"github.com/alrusov/misc"
+	path "github.com/alrusov/rest/v4/path"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Заполнение полей аудита (role createdAt, updatedAt, createdBy, updatedBy) в proc.Fields.
+// Значения от клиента в них не попадают, так как поля аудита считаются readonly.
+// Для *By полей целого типа используется AuthIdentity.UserID, иначе AuthIdentity.User
+func (proc *ProcOptions) fillAuditFields(create bool) {
+	auditFields := proc.ChainLocal.Params.Request.AuditFields
+	if len(auditFields) == 0 {
+		return
+	}
+
+	now := misc.NowUTC()
+
+	values := make(misc.InterfaceMap, len(auditFields))
+
+	for role, af := range auditFields {
+		switch role {
+		case path.RoleCreatedAt:
+			if create {
+				values[af.DbName] = now
+			}
+		case path.RoleUpdatedAt:
+			values[af.DbName] = now
+		case path.RoleCreatedBy:
+			if create {
+				values[af.DbName] = proc.auditUser(af.Type)
+			}
+		case path.RoleUpdatedBy:
+			values[af.DbName] = proc.auditUser(af.Type)
+		}
+	}
+
+	for _, fields := range proc.Fields {
+		for name, v := range values {
+			fields[name] = v
+		}
+	}
+}
+
+// Пользователь для *By полей
+func (proc *ProcOptions) auditUser(tp reflect.Type) any {
+	if proc.AuthIdentity == nil {
+		return nil
+	}
+
+	switch tp.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return proc.AuthIdentity.UserID
+	default:
+		return proc.AuthIdentity.User
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,333 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/alrusov/db"
+	"github.com/alrusov/misc"
+	path "github.com/alrusov/rest/v4/path"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+var (
+	// Максимальное количество ключей в одном групповом запросе. 0 - без ограничений
+	BulkMaxKeys = 1000
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Групповые операции по списку ключей (ScopeUpdateIDs, ScopeUpdateGUIDs, ScopeDeleteIDs, ScopeDeleteGUIDs).
+//
+// Ключи берутся из query параметра ParamIDs (через запятую), а для удаления, если его нет, из тела запроса:
+// [1, 2, 3] или {"ids": [1, 2, 3]}.
+// Запрос к базе выполняется для каждого ключа, ключ передается последней из общих переменных DBqueryVars, например:
+//
+//	UPDATE ... SET @FIELDS@ WHERE id=$1
+//	DELETE FROM ... WHERE guid=$1
+//
+// Все выполняется в одной транзакции. Если хотя бы один ключ не обработан, то транзакция откатывается,
+// а успешные записи получают код 424 (Failed Dependency). После ошибки базы (транзакция в PostgreSQL после нее
+// уже не работает) остальные ключи не обрабатываются и тоже получают 424. Результат по каждому ключу - в ExecResult.Rows,
+// сообщения проверки тела запроса (например, об игнорируемых полях) добавляются к каждому ключу
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Групповое обновление: тело запроса - одна запись, которая применяется к каждому ключу
+func (proc *ProcOptions) UpdateKeys() (result any, code int, err error) {
+	execResult := NewExecResult()
+
+	defer func() {
+		execResult.MultiDefer(&result, &code, &err)
+	}()
+
+	keys, err := parseBulkKeys(proc.Scope, proc.R.URL.Query().Get(ParamIDs), nil)
+	if err != nil {
+		code = http.StatusUnprocessableEntity
+		return
+	}
+
+	_, err = proc.prepareFields(execResult, false)
+	if err != nil {
+		code = http.StatusUnprocessableEntity
+		return
+	}
+
+	result, code, err = proc.before()
+	if code != 0 || !misc.IsNil(result) || err != nil {
+		return
+	}
+
+	if !proc.checkFields(true, execResult) {
+		return
+	}
+
+	// Сообщения проверки относятся ко всем ключам
+	messages := slices.Clone(execResult.Rows[0].Messages)
+	execResult.Rows = nil
+
+	proc.fillAuditFields(false)
+
+	return proc.execKeys(execResult, keys, messages, func() (int, []string) { return proc.makeQueryVars(true) })
+}
+
+// Групповое удаление
+func (proc *ProcOptions) DeleteKeys() (result any, code int, err error) {
+	execResult := NewExecResult()
+
+	defer func() {
+		execResult.MultiDefer(&result, &code, &err)
+	}()
+
+	keys, err := parseBulkKeys(proc.Scope, proc.R.URL.Query().Get(ParamIDs), proc.RawBody)
+	if err != nil {
+		code = http.StatusUnprocessableEntity
+		return
+	}
+
+	var makeVars func() (int, []string)
+	if proc.Info.deletedField != nil {
+		// Мягкое удаление
+		proc.DBqueryName = proc.softDeleteQueryName()
+		proc.softDeleteFields(true)
+		makeVars = proc.softDeleteVars
+	}
+
+	result, code, err = proc.before()
+	if code != 0 || !misc.IsNil(result) || err != nil {
+		return
+	}
+
+	return proc.execKeys(execResult, keys, nil, makeVars)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// messages добавляются к результату каждого ключа. makeVars добавляет в DBqueryVars поля update запроса, nil - запрос без полей
+func (proc *ProcOptions) execKeys(execResult *ExecResult, keys []any, messages []string, makeVars func() (startIdx int, fieldNames []string)) (result any, code int, err error) {
+	err = proc.setDB()
+	if err != nil {
+		return
+	}
+
+	// Если транзакцию не открыл do(), то открываем свою
+
+	tx := proc.dbTx
+	ownTx := tx == nil
+
+	if ownTx {
+		conn, e := proc.db.GetConn()
+		if e != nil {
+			err = e
+			return
+		}
+
+		tx, err = conn.Beginx()
+		if err != nil {
+			return
+		}
+
+		defer func() {
+			if err == nil && execResult.failed() == 0 {
+				err = tx.Commit()
+				return
+			}
+			_ = tx.Rollback()
+		}()
+	}
+
+	commonVars := slices.Clone(proc.DBqueryVars)
+	dbFailed := false
+
+	for _, key := range keys {
+		r := NewExecResultRow()
+		switch key := key.(type) {
+		case uint64:
+			r.ID = key
+		case string:
+			r.GUID = key
+		}
+		r.AddMessages(messages)
+		execResult.AddRow(r)
+
+		if dbFailed {
+			r.Code = http.StatusFailedDependency
+			r.AddMessage("not processed")
+			continue
+		}
+
+		proc.DBqueryVars = append(slices.Clone(commonVars), key)
+
+		patternType := db.PatternTypeNone
+		startIdx := 0
+		var fieldNames []string
+		if makeVars != nil {
+			patternType = db.PatternTypeUpdate
+			startIdx, fieldNames = makeVars()
+		}
+
+		var returnsObj *[]*ExecResultRow
+		if proc.ChainLocal.Params.Flags&path.FlagUDqueriesReturnsID != 0 {
+			requestRes := NewExecResult()
+			returnsObj = &requestRes.Rows
+		}
+
+		dbResult, e := proc.db.ExecTxEx(tx, returnsObj, proc.DBqueryName, patternType, startIdx, fieldNames, proc.DBqueryVars)
+		if e != nil {
+			r.Code = http.StatusInternalServerError
+			r.AddError(e)
+			dbFailed = true
+			continue
+		}
+
+		keyResult := NewExecResult()
+		keyResult.AddRow(NewExecResultRow())
+
+		e = keyResult.DbResultParser(dbResult, returnsObj)
+		if e != nil {
+			r.Code = http.StatusInternalServerError
+			r.AddError(e)
+			continue
+		}
+
+		src := keyResult.Rows[0]
+		r.Code = src.Code
+		r.AddErrors(src.Errors())
+		if src.ID != 0 {
+			r.ID = src.ID
+		}
+		if src.GUID != "" {
+			r.GUID = src.GUID
+		}
+	}
+
+	proc.DBqueryVars = commonVars
+
+	execResult.rollbackMark()
+
+	proc.ExecResult = execResult
+
+	result, code, err = proc.after()
+	if code != 0 || !misc.IsNil(result) || err != nil {
+		return
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Количество необработанных записей
+func (execResult *ExecResult) failed() (n int) {
+	for _, r := range execResult.Rows {
+		if r.Code/100 > 2 {
+			n++
+		}
+	}
+	return
+}
+
+// Если есть необработанные записи, то транзакция будет откачена - отмечаем это в успешных
+func (execResult *ExecResult) rollbackMark() {
+	if execResult.failed() == 0 {
+		return
+	}
+
+	for _, r := range execResult.Rows {
+		if r.Code/100 <= 2 {
+			r.Code = http.StatusFailedDependency
+			r.AddMessage("rolled back")
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Список ключей из query параметра или тела запроса. Для *.ids - uint64, для *.guids - string
+func parseBulkKeys(scope string, query string, body []byte) (keys []any, err error) {
+	var list []string
+
+	query = strings.TrimSpace(query)
+	body = bytes.TrimSpace(body)
+
+	switch {
+	case query != "":
+		list = strings.Split(query, ",")
+
+	case len(body) != 0:
+		var raw []json.RawMessage
+
+		if body[0] == '{' {
+			var obj struct {
+				IDs []json.RawMessage `json:"ids"`
+			}
+			err = json.Unmarshal(body, &obj)
+			raw = obj.IDs
+		} else {
+			err = json.Unmarshal(body, &raw)
+		}
+
+		if err != nil {
+			err = fmt.Errorf("bad keys list: %w", err)
+			return
+		}
+
+		list = make([]string, len(raw))
+		for i, v := range raw {
+			list[i] = strings.Trim(string(v), `"`)
+		}
+	}
+
+	byGUID := strings.HasSuffix(scope, ".guids")
+
+	msgs := misc.NewMessages()
+	defer msgs.Free()
+
+	keys = make([]any, 0, len(list))
+	seen := make(map[string]bool, len(list))
+
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" || seen[s] {
+			continue
+		}
+		seen[s] = true
+
+		if byGUID {
+			keys = append(keys, s)
+			continue
+		}
+
+		id, e := strconv.ParseUint(s, 10, 64)
+		if e != nil || id == 0 {
+			msgs.Add(`bad id "%s"`, s)
+			continue
+		}
+		keys = append(keys, id)
+	}
+
+	err = msgs.Error()
+	if err != nil {
+		return
+	}
+
+	if len(keys) == 0 {
+		err = fmt.Errorf("no keys found (%s)", ParamIDs)
+		return
+	}
+
+	if BulkMaxKeys > 0 && len(keys) > BulkMaxKeys {
+		err = fmt.Errorf("too many keys: %d, maximum %d", len(keys), BulkMaxKeys)
+		return
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
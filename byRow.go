@@ -2,13 +2,24 @@ package rest
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
 	"io"
-	"math"
+	"maps"
 	"net/http"
 	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
 
 	"github.com/alrusov/jsonw"
+	"github.com/alrusov/log"
 	"github.com/alrusov/misc"
 	"github.com/alrusov/stdhttp"
 )
@@ -22,14 +33,21 @@ type (
 
 		Data []RowData
 
+		Format  *ByRowFormat // Формат вывода
+		Columns []string     // Колонки для табличных форматов (по умолчанию json имена из DBFields)
+
+		Workers int // Количество горутин для параллельного выполнения tuner и маршалинга. Если <= 1, то обработка последовательная
+
 		RowNum     int            // Количество выданных строк (увеличивается в конце обработки строки)
+		SrcRowNum  int            // Количество прочитанных из базы строк (до обработки текущей)
 		IsFinal    bool           // Финал, Tuner еще раз вызывается после завершения выборки, в первом параметре опять последнее значение
 		withWriter bool           // Hадо производить запись, иначе это делает сам tuner
 		proc       *ProcOptions   //
 		tuner      ByRowTuner     //
-		withGzip   bool           //
+		encoding   string         // Content-Encoding потока
 		blockNum   int            //
 		failed     bool           //
+		streamErr  error          // Ошибка, переданная клиенту после начала отправки ответа
 		last       any            //
 		buf        *bytes.Buffer  //
 		writer     io.WriteCloser //
@@ -43,30 +61,121 @@ type (
 	}
 
 	ByRowTuner func(br *ByRow, row any) (err error)
+
+	// Формат вывода ByRow
+	ByRowFormat struct {
+		Name        string                                          // Имя формата (для Chain.StreamFormat)
+		MediaType   string                                          // Тип для выбора по Accept
+		ContentType string                                          // Content-Type ответа
+		Begin       []byte                                          // Пишется один раз в начале (после заголовка)
+		End         []byte                                          // Пишется один раз в конце
+		Separator   []byte                                          // Разделитель строк. Если nil, то используется RowData.Separator
+		Header      func(br *ByRow) (header []byte, err error)      // Заголовок, пишется перед Begin
+		Marshal     func(br *ByRow, data any) (j []byte, err error) // Сериализация строки
+		ErrorRecord func(br *ByRow, err error) (rec []byte)         // Запись-признак ошибки, пишется перед End, если ответ уже начал отправляться
+	}
+
+	// Запись-признак ошибки, добавляемая в конец прерванного ответа
+	ByRowErrorRecord struct {
+		Error      string `json:"error" comment:"Error message"`
+		RowCount   int    `json:"rowCount" comment:"Number of rows sent before the error"`
+		Incomplete bool   `json:"incomplete" comment:"Always true, the result is incomplete"`
+	}
 )
 
 const (
 	blockBufferSize = 128 * 1024
+
+	ByRowFormatJSON   = "json"
+	ByRowFormatNDJSON = "ndjson"
+	ByRowFormatCSV    = "csv"
+	ByRowFormatTSV    = "tsv"
+
+	ByRowErrorRecordName = "byRowErrorRecord"
+
+	HTTPheaderTrailer     = "Trailer"
+	HTTPheaderStreamError = "X-Stream-Error" // Трейлер: ошибка, прервавшая отправку
+	HTTPheaderRowCount    = "X-Row-Count"    // Трейлер: количество отправленных строк
 )
 
 var (
 	ByRowDefautlBegin     = []byte{'['}
 	ByRowDefautlEnd       = []byte{']'}
 	ByRowDefaultSeparator = []byte{','}
+
+	// Заголовки потокового ответа (для OpenAPI, добавляются только к цепочкам с path.FlagResponseByRow)
+	ByRowOutHeaders = misc.StringMap{
+		HTTPheaderTrailer:     "List of trailers sent after the data: " + HTTPheaderStreamError + ", " + HTTPheaderRowCount,
+		HTTPheaderStreamError: "Trailer. Error that interrupted the data transfer. If present, the result is incomplete",
+		HTTPheaderRowCount:    "Trailer. Number of rows sent",
+	}
+
+	// Описание протокола прерывания потокового ответа (для OpenAPI, добавляется только к цепочкам с path.FlagResponseByRow)
+	ByRowFailureDescription = "If an error occurs after the transfer has started, the " + ByRowErrorRecordName +
+		" object is appended as the last element (json and ndjson formats), the " + HTTPheaderStreamError +
+		" trailer is set and the " + HTTPheaderRowCount + " trailer contains the number of rows actually sent."
+
+	byRowFormatsMutex sync.RWMutex
+	byRowFormats      = map[string]*ByRowFormat{
+		ByRowFormatJSON: {
+			Name:        ByRowFormatJSON,
+			ErrorRecord: byRowErrorRecordJSON,
+			MediaType:   "application/json",
+			ContentType: stdhttp.ContentTypeJSON,
+			Begin:       ByRowDefautlBegin,
+			End:         ByRowDefautlEnd,
+			Separator:   nil,
+			Marshal:     byRowMarshalJSON,
+		},
+		ByRowFormatNDJSON: {
+			Name:        ByRowFormatNDJSON,
+			ErrorRecord: byRowErrorRecordJSON,
+			MediaType:   "application/x-ndjson",
+			ContentType: "application/x-ndjson; charset=utf-8",
+			End:         []byte{'\n'},
+			Separator:   []byte{'\n'},
+			Marshal:     byRowMarshalJSON,
+		},
+		ByRowFormatCSV: {
+			Name:        ByRowFormatCSV,
+			MediaType:   "text/csv",
+			ContentType: stdhttp.ContentTypeCsv,
+			End:         []byte{'\n'},
+			Separator:   []byte{'\n'},
+			Header:      byRowTableHeader(','),
+			Marshal:     byRowMarshalTable(','),
+		},
+		ByRowFormatTSV: {
+			Name:        ByRowFormatTSV,
+			MediaType:   "text/tab-separated-values",
+			ContentType: "text/tab-separated-values; charset=utf-8",
+			End:         []byte{'\n'},
+			Separator:   []byte{'\n'},
+			Header:      byRowTableHeader('\t'),
+			Marshal:     byRowMarshalTable('\t'),
+		},
+	}
 )
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
 func NewByRow(proc *ProcOptions, tuner ByRowTuner, withWriter bool) (br *ByRow, err error) {
+	format, err := proc.byRowFormat()
+	if err != nil {
+		return
+	}
+
 	br = &ByRow{
-		Begin:      ByRowDefautlBegin,
-		End:        ByRowDefautlEnd,
+		Begin:      format.Begin,
+		End:        format.End,
+		Format:     format,
+		Columns:    proc.byRowColumns(),
 		RowNum:     0,
 		IsFinal:    false,
 		withWriter: withWriter,
 		proc:       proc,
 		tuner:      tuner,
-		withGzip:   false,
+		encoding:   "",
 		blockNum:   0,
 		failed:     false,
 		buf:        new(bytes.Buffer),
@@ -80,11 +189,16 @@ func NewByRow(proc *ProcOptions, tuner ByRowTuner, withWriter bool) (br *ByRow,
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
+// Если ошибка возникла после начала отправки ответа, то она передается клиенту (ErrorRecord и трейлеры), логируется,
+// а Do возвращает nil, так как отвечать еще раз уже нельзя. Саму ошибку можно получить через StreamError()
 func (br *ByRow) Do() (err error) {
 	// При завершении самоликвидируемся
 	defer func() {
 		if err != nil {
-			br.failed = true
+			br.fail(err)
+			if br.streamErr != nil {
+				err = nil
+			}
 		}
 
 		br.Close()
@@ -99,11 +213,28 @@ func (br *ByRow) Do() (err error) {
 		br.End = nil
 	}
 
+	if br.Format.Header != nil {
+		var hdr []byte
+		hdr, err = br.Format.Header(br)
+		if err != nil {
+			return
+		}
+
+		if len(hdr) != 0 {
+			br.Begin = append(hdr, br.Begin...)
+		}
+	}
+
 	if br.withWriter {
-		// Если нужен gzip, то добавляем упаковку
-		if stdhttp.UseGzip(br.proc.R, math.MaxInt, &br.proc.ExtraHeaders) {
-			br.writer = gzip.NewWriter(br)
-			br.withGzip = true
+		// Если клиент принимает сжатие, то добавляем упаковку
+		enc := br.proc.streamEncoder()
+		if enc != nil {
+			br.writer, err = enc.NewWriter(br, br.proc.compressLevel())
+			if err != nil {
+				br.writer = br
+				return
+			}
+			br.encoding = enc.Name
 		}
 	}
 
@@ -113,6 +244,29 @@ func (br *ByRow) Do() (err error) {
 
 	// Обработка
 
+	if br.Workers > 1 && br.withWriter && br.tuner != nil {
+		err = br.doParallel(rows, srcTp)
+	} else {
+		err = br.doSerial(rows, srcTp)
+	}
+	if err != nil {
+		return
+	}
+
+	if br.withWriter && br.RowNum != 0 && br.End != nil {
+		// Пишем конец результата
+		_, err = br.writer.Write(br.End)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (br *ByRow) doSerial(rows *sqlx.Rows, srcTp reflect.Type) (err error) {
 	for {
 		r := reflect.New(srcTp).Interface()
 		exists := rows.Next()
@@ -160,75 +314,305 @@ func (br *ByRow) Do() (err error) {
 			}
 		}
 
+		if !br.IsFinal {
+			br.SrcRowNum++
+		}
+
 		if br.withWriter {
 			if len(br.Data) == 0 {
 				// Писать нечего
 				continue
 			}
 
-			for i, rd := range br.Data {
-				if i > 0 || br.RowNum > 0 {
-					// Пишем разделитель
-					if rd.Separator != nil {
-						_, err = br.writer.Write(rd.Separator)
-						if err != nil {
-							return
-						}
-					}
-				} else if br.Begin != nil {
-					// Пишем начало результата
-					_, err = br.writer.Write(br.Begin)
-					if err != nil {
-						return
-					}
-				}
+			err = br.writeRowData(br.Data, nil)
+			if err != nil {
+				return
+			}
+		}
 
-				if rd.Prefix != nil {
-					// Пишем префикс
-					_, err = br.writer.Write(rd.Prefix)
-					if err != nil {
-						return
-					}
-				}
+		br.Data = nil
 
-				if !misc.IsNil(rd.Data) {
-					// Маршалим данные в json
-					var j []byte
-					j, err = jsonw.Marshal(rd.Data)
-					if err != nil {
-						return
-					}
-
-					// Пишем данные
-					_, err = br.writer.Write(j)
-					if err != nil {
-						return
-					}
-				}
+		if !br.IsFinal || br.withWriter {
+			br.RowNum++
+		}
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Параллельная обработка: чтение из базы и запись идут последовательно, tuner и маршалинг - в Workers горутинах.
+// Порядок строк сохраняется, одновременно в работе не более 2*Workers строк.
+// Tuner получает копию ByRow и не должен писать самостоятельно. RowNum в копии вычисляется с учетом уже известных пропущенных
+// строк. Если после сборки по порядку оказалось, что он не совпадает с последовательным режимом (пропущена строка, которая
+// еще обрабатывалась), то tuner вызывается для этой строки повторно, с правильным RowNum и исходной копией строки.
+// Финальный вызов tuner (IsFinal) выполняется последовательно после обработки всех строк.
+// Отмена контекста запроса (отключение клиента) прекращает чтение из базы
+func (br *ByRow) doParallel(rows *sqlx.Rows, srcTp reflect.Type) (err error) {
+	type (
+		result struct {
+			data    []RowData
+			encoded [][]byte
+			err     error
+		}
+
+		job struct {
+			br     *ByRow
+			row    any
+			src    any // Копия строки до tuner для повторного вызова
+			result chan *result
+		}
+	)
+
+	n := br.Workers
+
+	jobs := make(chan *job, n)
+	order := make(chan *job, 2*n)
+	done := make(chan struct{})
+	producerDone := make(chan struct{})
+
+	var readErr error
+	var skipped atomic.Int64 // Пропущенные tuner строки
+	var wg sync.WaitGroup
+
+	ctx := context.Background()
+	if br.proc.R != nil {
+		ctx = br.proc.R.Context()
+	}
+
+	defer func() {
+		close(done)
+		<-producerDone
+		wg.Wait()
+	}()
+
+	base := *br
+	base.Data = nil
+
+	// Чтение из базы
+	go func() {
+		defer close(producerDone)
+		defer close(order)
+		defer close(jobs)
+
+		for idx := 0; ; idx++ {
+			if !rows.Next() {
+				readErr = rows.Err()
+				return
+			}
+
+			r := reflect.New(srcTp)
+			e := rows.StructScan(r.Interface())
+			if e != nil {
+				readErr = e
+				return
+			}
+
+			src := reflect.New(srcTp)
+			src.Elem().Set(r.Elem())
+
+			wbr := base
+			wbr.RowNum = idx - int(skipped.Load())
+			wbr.SrcRowNum = idx
+
+			j := &job{
+				br:     &wbr,
+				row:    r.Interface(),
+				src:    src.Interface(),
+				result: make(chan *result, 1),
+			}
+
+			select {
+			case order <- j:
+			case <-done:
+				return
+			case <-ctx.Done():
+				readErr = ctx.Err()
+				return
+			}
+
+			select {
+			case jobs <- j:
+			case <-done:
+				return
+			case <-ctx.Done():
+				readErr = ctx.Err()
+				return
+			}
+		}
+	}()
 
-				if rd.Suffix != nil {
-					// Пишем суффикс
-					_, err = br.writer.Write(rd.Suffix)
-					if err != nil {
-						return
-					}
+	// Обработчики
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := range jobs {
+				res := &result{}
+
+				res.err = br.tuner(j.br, j.row)
+				if res.err == nil {
+					res.data = j.br.Data
+					res.encoded, res.err = j.br.encodeRowData(res.data)
 				}
+
+				j.result <- res
 			}
+		}()
+	}
+
+	// Запись в исходном порядке
+	for j := range order {
+		var res *result
+		select {
+		case res = <-j.result:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
 		}
 
-		br.Data = nil
+		if j.br.RowNum != br.RowNum {
+			// Перед строкой пропущена строка, которая еще обрабатывалась - повторяем с правильным RowNum
+			wbr := base
+			wbr.RowNum = br.RowNum
+			wbr.SrcRowNum = j.br.SrcRowNum
+			j.row = j.src
+
+			res = &result{}
+			res.err = br.tuner(&wbr, j.row)
+			if res.err == nil {
+				res.data = wbr.Data
+				res.encoded, res.err = wbr.encodeRowData(res.data)
+			}
+		}
 
-		if !br.IsFinal || br.withWriter {
-			br.RowNum++
+		if res.err != nil {
+			err = res.err
+			return
+		}
+
+		br.last = j.row
+		br.SrcRowNum++
+
+		if len(res.data) == 0 {
+			// Писать нечего
+			skipped.Add(1)
+			continue
+		}
+
+		err = br.writeRowData(res.data, res.encoded)
+		if err != nil {
+			return
 		}
+
+		br.RowNum++
 	}
 
-	if br.withWriter && br.RowNum != 0 && br.End != nil {
-		// Пишем конец результата
-		_, err = br.writer.Write(br.End)
+	if readErr != nil {
+		err = readErr
+		return
+	}
+
+	// Финализируем
+	br.IsFinal = true
+
+	err = br.tuner(br, br.last)
+	if err != nil {
+		return
+	}
+
+	if len(br.Data) != 0 {
+		err = br.writeRowData(br.Data, nil)
 		if err != nil {
 			return
 		}
+
+		br.RowNum++
+	}
+
+	br.Data = nil
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Маршалинг данных строки
+func (br *ByRow) encodeRowData(data []RowData) (encoded [][]byte, err error) {
+	encoded = make([][]byte, len(data))
+
+	for i, rd := range data {
+		if misc.IsNil(rd.Data) {
+			continue
+		}
+
+		encoded[i], err = br.Format.Marshal(br, rd.Data)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Запись данных строки. Если encoded == nil, то маршалинг выполняется здесь
+func (br *ByRow) writeRowData(data []RowData, encoded [][]byte) (err error) {
+	for i, rd := range data {
+		if i > 0 || br.RowNum > 0 {
+			// Пишем разделитель
+			sep := rd.Separator
+			if sep != nil && br.Format.Separator != nil {
+				sep = br.Format.Separator
+			}
+			if sep != nil {
+				_, err = br.writer.Write(sep)
+				if err != nil {
+					return
+				}
+			}
+		} else if br.Begin != nil {
+			// Пишем начало результата
+			_, err = br.writer.Write(br.Begin)
+			if err != nil {
+				return
+			}
+		}
+
+		if rd.Prefix != nil {
+			// Пишем префикс
+			_, err = br.writer.Write(rd.Prefix)
+			if err != nil {
+				return
+			}
+		}
+
+		var j []byte
+		if encoded != nil {
+			j = encoded[i]
+		} else if !misc.IsNil(rd.Data) {
+			// Маршалим данные
+			j, err = br.Format.Marshal(br, rd.Data)
+			if err != nil {
+				return
+			}
+		}
+
+		if j != nil {
+			// Пишем данные
+			_, err = br.writer.Write(j)
+			if err != nil {
+				return
+			}
+		}
+
+		if rd.Suffix != nil {
+			// Пишем суффикс
+			_, err = br.writer.Write(rd.Suffix)
+			if err != nil {
+				return
+			}
+		}
 	}
 
 	return
@@ -300,12 +684,58 @@ func (br *ByRow) Close() (err error) {
 		br.proc.W.WriteHeader(http.StatusNoContent)
 	}
 
+	if br.blockNum != 0 {
+		// Трейлеры
+		h := br.proc.W.Header()
+		h.Set(HTTPheaderRowCount, strconv.Itoa(br.RowNum))
+		if br.streamErr != nil {
+			h.Set(HTTPheaderStreamError, strings.Join(strings.Fields(br.streamErr.Error()), " "))
+		}
+	}
+
 	err = msgs.Error()
 	return
 }
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
+// Обработка ошибки выборки
+func (br *ByRow) fail(err error) {
+	if !br.withWriter || br.blockNum == 0 {
+		// Ничего еще не отправлено - ответ остается за вызывающим
+		br.buf.Reset()
+		br.failed = true
+		return
+	}
+
+	br.streamErr = err
+	br.proc.LogFacility.Message(log.ERR, "[%d] ByRow: the transfer was interrupted after %d rows: %s", br.proc.ID, br.RowNum, err)
+
+	// Ошибки записи здесь уже не важны, клиент мог и отключиться
+	if br.Format.ErrorRecord != nil {
+		rec := br.Format.ErrorRecord(br, err)
+		if len(rec) != 0 {
+			sep := br.Format.Separator
+			if sep == nil {
+				sep = ByRowDefaultSeparator
+			}
+			_, _ = br.writer.Write(sep)
+			_, _ = br.writer.Write(rec)
+		}
+	}
+
+	if br.End != nil {
+		_, _ = br.writer.Write(br.End)
+	}
+}
+
+// Ошибка, прервавшая уже начатую отправку ответа
+func (br *ByRow) StreamError() error {
+	return br.streamErr
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
 func (br *ByRow) Flush() (err error) {
 	if br.buf.Len() == 0 {
 		return
@@ -314,20 +744,25 @@ func (br *ByRow) Flush() (err error) {
 	w := br.proc.W
 
 	if br.blockNum == 0 {
-		err = stdhttp.WriteContentHeader(w, stdhttp.ContentTypeJSON)
+		err = stdhttp.WriteContentHeader(w, br.Format.ContentType)
 		if err != nil {
 			return
 		}
 
 		br.proc.ExtraHeaders["X-Content-Type-Options"] = "nosniff"
-		if br.withGzip {
-			br.proc.ExtraHeaders[stdhttp.HTTPheaderContentEncoding] = stdhttp.ContentEncodingGzip
+		if br.encoding != "" {
+			br.proc.ExtraHeaders[stdhttp.HTTPheaderContentEncoding] = br.encoding
+		}
+		if br.proc.compressMinSize() >= 0 {
+			br.proc.addVary(stdhttp.HTTPheaderAcceptEncoding)
 		}
 
 		for n, v := range br.proc.ExtraHeaders {
 			w.Header().Set(n, v)
 		}
 
+		w.Header().Set(HTTPheaderTrailer, HTTPheaderStreamError+", "+HTTPheaderRowCount)
+
 		w.WriteHeader(http.StatusOK)
 	}
 
@@ -342,3 +777,204 @@ func (br *ByRow) Flush() (err error) {
 }
 
 //----------------------------------------------------------------------------------------------------------------------------//
+
+// Добавить (заменить) формат вывода
+func AddByRowFormat(format *ByRowFormat) (err error) {
+	if format == nil || format.Name == "" || format.Marshal == nil {
+		return fmt.Errorf("illegal ByRow format %#v", format)
+	}
+
+	byRowFormatsMutex.Lock()
+	byRowFormats[format.Name] = format
+	byRowFormatsMutex.Unlock()
+
+	return
+}
+
+func GetByRowFormat(name string) (format *ByRowFormat, exists bool) {
+	byRowFormatsMutex.RLock()
+	defer byRowFormatsMutex.RUnlock()
+
+	format, exists = byRowFormats[name]
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Выбор формата: по Accept, иначе из цепочки, иначе json
+func (proc *ProcOptions) byRowFormat() (format *ByRowFormat, err error) {
+	if proc.R != nil {
+		byRowFormatsMutex.RLock()
+		for _, item := range parseQList(proc.R.Header, "Accept") {
+			if item.Q == 0 {
+				continue
+			}
+
+			for _, f := range byRowFormats {
+				if f.MediaType == item.Value {
+					format = f
+					break
+				}
+			}
+
+			if format != nil || strings.HasSuffix(item.Value, "/*") {
+				break
+			}
+		}
+		byRowFormatsMutex.RUnlock()
+
+		if format != nil {
+			return
+		}
+	}
+
+	name := ByRowFormatJSON
+	if proc.Chain != nil && proc.ChainLocal.StreamFormat != "" {
+		name = proc.ChainLocal.StreamFormat
+	}
+
+	format, exists := GetByRowFormat(name)
+	if !exists {
+		err = fmt.Errorf(`unknown ByRow format "%s"`, name)
+		return
+	}
+
+	return
+}
+
+// Колонки по умолчанию: json имена полей из DBFields
+func (proc *ProcOptions) byRowColumns() (columns []string) {
+	if proc.Chain == nil || proc.ChainLocal.Params.DBFields == nil {
+		return
+	}
+
+	fieldsInfo := proc.ChainLocal.Params.DBFields.ByDbName()
+	names := proc.ChainLocal.Params.DBFields.AllDbNames()
+	columns = make([]string, 0, len(names))
+
+	for _, dbName := range names {
+		if _, exists := proc.ExcludedFields[dbName]; exists {
+			continue
+		}
+
+		fi, exists := fieldsInfo[dbName]
+		if !exists || fi.JsonName == "" || fi.JsonName == "-" {
+			continue
+		}
+
+		if slices.Contains(columns, fi.JsonName) {
+			continue
+		}
+
+		columns = append(columns, fi.JsonName)
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func byRowMarshalJSON(br *ByRow, data any) (j []byte, err error) {
+	return jsonw.Marshal(data)
+}
+
+func byRowErrorRecordJSON(br *ByRow, err error) (rec []byte) {
+	rec, _ = jsonw.Marshal(
+		&ByRowErrorRecord{
+			Error:      err.Error(),
+			RowCount:   br.RowNum,
+			Incomplete: true,
+		},
+	)
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func byRowTableHeader(comma rune) func(br *ByRow) (header []byte, err error) {
+	return func(br *ByRow) (header []byte, err error) {
+		if len(br.Columns) == 0 {
+			return
+		}
+
+		header, err = byRowTableLine(comma, br.Columns)
+		if err != nil {
+			return
+		}
+
+		header = append(header, '\n')
+		return
+	}
+}
+
+func byRowMarshalTable(comma rune) func(br *ByRow, data any) (line []byte, err error) {
+	return func(br *ByRow, data any) (line []byte, err error) {
+		// Через json, чтобы учитывались имена полей и кастомные маршалеры
+		j, err := jsonw.Marshal(data)
+		if err != nil {
+			return
+		}
+
+		var m map[string]any
+		d := json.NewDecoder(bytes.NewReader(j))
+		d.UseNumber()
+		err = d.Decode(&m)
+		if err != nil {
+			err = fmt.Errorf("%T is not an object: %w", data, err)
+			return
+		}
+
+		columns := br.Columns
+		if len(columns) == 0 {
+			// Колонки не заданы - берем из первой строки
+			columns = slices.Sorted(maps.Keys(m))
+			br.Columns = columns
+		}
+
+		record := make([]string, len(columns))
+
+		for i, name := range columns {
+			switch v := m[name].(type) {
+			case nil:
+			case string:
+				record[i] = v
+			case json.Number:
+				record[i] = v.String()
+			case bool:
+				record[i] = strconv.FormatBool(v)
+			default:
+				var b []byte
+				b, err = jsonw.Marshal(v)
+				if err != nil {
+					return
+				}
+				record[i] = string(b)
+			}
+		}
+
+		return byRowTableLine(comma, record)
+	}
+}
+
+func byRowTableLine(comma rune, record []string) (line []byte, err error) {
+	buf := new(bytes.Buffer)
+
+	w := csv.NewWriter(buf)
+	w.Comma = comma
+
+	err = w.Write(record)
+	if err != nil {
+		return
+	}
+
+	w.Flush()
+	err = w.Error()
+	if err != nil {
+		return
+	}
+
+	line = bytes.TrimRight(buf.Bytes(), "\r\n")
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
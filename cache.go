@@ -0,0 +1,890 @@
+package rest
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+	path "github.com/alrusov/rest/v4/path"
+	"github.com/alrusov/stdhttp"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	cachedData struct {
+		headers misc.StringMap
+		result  any
+	}
+
+	// Закэшированный ответ GET
+	cacheEntry struct {
+		key        string
+		module     string
+		chain      string
+		scope      string
+		tags       []string
+		code       int
+		data       cachedData
+		size       int64 // Оценка занимаемой памяти
+		created    time.Time
+		expires    time.Time // Свежая до
+		staleUntil time.Time // Можно отдавать протухшую во время обновления до
+		errorUntil time.Time // Можно отдавать протухшую при ошибке обновления до
+		elem       *list.Element
+	}
+
+	// Выполняющееся заполнение записи, его ждут идентичные запросы
+	cacheFlight struct {
+		done   chan struct{}
+		entry  *cacheEntry // Сохраненная запись, nil - не сохранена
+		failed bool        // Запрос завершился ошибкой
+	}
+
+	// Заполнение кэша после выполнения запроса
+	cacheFill struct {
+		store     *cacheStore
+		key       string
+		seq       uint64
+		flight    *cacheFlight
+		stale     *cacheEntry // Протухшая запись, которая обновляется
+		committed bool
+	}
+
+	cacheStore struct {
+		mutex       *sync.Mutex
+		entries     map[string]*cacheEntry
+		tags        map[string]map[string]*cacheEntry // tag -> key -> entry
+		flights     map[string]*cacheFlight           // key -> выполняющееся заполнение
+		seq         uint64                            // Счетчик инвалидаций
+		tagSeq      map[string]uint64                 // Номер последней инвалидации тега, пока есть незавершенные заполнения
+		counters    map[cacheStatKey]*cacheCounters
+		lastCleanup time.Time
+		lru         *list.List // Записи по времени последнего обращения, в начале - самые свежие
+		memory      int64      // Оценка занимаемой памяти
+		cleaning    bool       // Работает периодическая очистка
+	}
+
+	cacheStatKey struct {
+		module string
+		chain  string
+	}
+
+	cacheCounters struct {
+		hits   uint64
+		stale  uint64
+		misses uint64
+	}
+
+	// Статистика кэша по цепочке модуля
+	CacheStat struct {
+		Module  string `json:"module"`
+		Chain   string `json:"chain"`
+		Entries int    `json:"entries"`      // Количество записей
+		Expired int    `json:"expired"`      // Из них протухших, но еще хранящихся (stale-while-revalidate, stale-if-error)
+		Hits    uint64 `json:"hits"`         // Ответов из кэша
+		Stale   uint64 `json:"staleHits"`    // Из них протухших
+		Misses  uint64 `json:"misses"`       // Запросов, выполненных без кэша
+		Memory  int64  `json:"memoryApprox"` // Оценка занимаемой памяти, байт
+	}
+
+	cacheRefreshKey struct{}
+)
+
+const (
+	HTTPheaderAuthorization = "Authorization"
+	HTTPheaderCookie        = "Cookie"
+	HTTPheaderCacheControl  = "Cache-Control"
+	HTTPheaderAge           = "Age"
+)
+
+var (
+	// Периодичность удаления протухших записей
+	CacheCleanupInterval = time.Minute
+
+	// Максимальное количество записей в кэше, при превышении удаляются давно не использовавшиеся. 0 - без ограничения
+	CacheMaxEntries = 100000
+
+	// Максимальная (оценочная) память под кэш, байт, при превышении удаляются давно не использовавшиеся записи. 0 - без ограничения
+	CacheMaxMemory = int64(512 * 1024 * 1024)
+
+	// Максимальное время ожидания идентичного запроса, после которого запрос выполняется самостоятельно
+	CacheWaitTimeout = 30 * time.Second
+
+	responseCache = newCacheStore()
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func newCacheStore() *cacheStore {
+	return &cacheStore{
+		mutex:    new(sync.Mutex),
+		entries:  make(map[string]*cacheEntry, 1024),
+		tags:     make(map[string]map[string]*cacheEntry, 1024),
+		flights:  make(map[string]*cacheFlight, 64),
+		counters: make(map[cacheStatKey]*cacheCounters, 64),
+		tagSeq:   make(map[string]uint64, 64),
+		lru:      list.New(),
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Тег всех записей модуля
+func cacheModuleTag(moduleURL string) string {
+	return moduleURL + "#"
+}
+
+// Тег записи: для адресованных по ID/GUID - топик с ключами, для остальных (коллекции, выборки по имени и т.п.) - URL модуля.
+// Тем самым изменение любой записи сбрасывает все выборки, которые могут ее содержать
+func cacheKeyTag(moduleURL string, params any) string {
+	keys := misc.InterfaceMap{}
+
+	v := reflect.Indirect(reflect.ValueOf(params))
+
+	switch v.Kind() {
+	case reflect.Struct:
+		for _, name := range []string{path.VarID, path.VarGUID} {
+			f := v.FieldByName(name)
+			if f.IsValid() && !f.IsZero() {
+				keys[name] = f.Interface()
+			}
+		}
+
+	case reflect.Map:
+		if v.Type().Key().Kind() == reflect.String {
+			for _, name := range []string{path.VarID, path.VarGUID} {
+				f := v.MapIndex(reflect.ValueOf(name))
+				if f.IsValid() && !f.IsZero() {
+					keys[name] = f.Interface()
+				}
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		return moduleURL
+	}
+
+	return SubscriptionTopic(moduleURL, keys)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Получить запись.
+// Свежая запись возвращается без fill. Если записи нет, то возвращается fill, которое надо завершить через commit.
+// Если запись протухла, но может отдаваться во время обновления, то возвращаются и она, и fill для фонового обновления.
+// Идентичные запросы ждут завершения уже выполняющегося. Если не получено ни записи, ни fill, то запрос выполняется без кэширования
+func (s *cacheStore) get(key string) (entry *cacheEntry, fill *cacheFill) {
+	now := misc.NowUTC()
+
+	s.mutex.Lock()
+
+	s.cleanup(now)
+
+	entry = s.entries[key]
+	if entry != nil {
+		if now.Before(entry.expires) {
+			s.lru.MoveToFront(entry.elem)
+			s.mutex.Unlock()
+			return
+		}
+
+		if !now.Before(entry.staleUntil) && !now.Before(entry.errorUntil) {
+			s.remove(entry)
+			entry = nil
+		}
+	}
+
+	flight := s.flights[key]
+
+	if flight == nil {
+		flight = &cacheFlight{
+			done: make(chan struct{}),
+		}
+		s.flights[key] = flight
+
+		fill = &cacheFill{
+			store:  s,
+			key:    key,
+			seq:    s.seq,
+			flight: flight,
+			stale:  entry,
+		}
+
+		if entry != nil && !now.Before(entry.staleUntil) {
+			// Отдавать нельзя, но может пригодиться при ошибке
+			entry = nil
+		}
+
+		s.mutex.Unlock()
+		return
+	}
+
+	s.mutex.Unlock()
+
+	if entry != nil && now.Before(entry.staleUntil) {
+		// Обновление уже идет
+		return
+	}
+
+	select {
+	case <-flight.done:
+	case <-time.After(CacheWaitTimeout):
+		entry = nil
+		return
+	}
+
+	if flight.entry != nil {
+		entry = flight.entry
+		return
+	}
+
+	if flight.failed && entry != nil && misc.NowUTC().Before(entry.errorUntil) {
+		return
+	}
+
+	entry = nil
+	return
+}
+
+// Сохранить запись и разбудить ожидающих. Если пока она готовилась, ее теги инвалидировались, то запись не сохраняется.
+// Повторный вызов ничего не делает
+func (fill *cacheFill) commit(entry *cacheEntry, failed bool) {
+	s := fill.store
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if fill.committed {
+		return
+	}
+	fill.committed = true
+
+	if s.flights[fill.key] == fill.flight {
+		delete(s.flights, fill.key)
+	}
+
+	defer func() {
+		fill.flight.failed = failed
+		close(fill.flight.done)
+
+		if len(s.flights) == 0 && len(s.tagSeq) != 0 {
+			clear(s.tagSeq)
+		}
+	}()
+
+	if entry == nil {
+		return
+	}
+
+	if fill.seq != s.seq {
+		for _, tag := range entry.tags {
+			if s.tagSeq[tag] > fill.seq {
+				return
+			}
+		}
+	}
+
+	if old, exists := s.entries[entry.key]; exists {
+		s.remove(old)
+	}
+
+	s.entries[entry.key] = entry
+	entry.elem = s.lru.PushFront(entry)
+	s.memory += entry.size
+
+	for _, tag := range entry.tags {
+		keys, exists := s.tags[tag]
+		if !exists {
+			keys = make(map[string]*cacheEntry, 8)
+			s.tags[tag] = keys
+		}
+		keys[entry.key] = entry
+	}
+
+	fill.flight.entry = entry
+
+	s.evict()
+
+	if !s.cleaning {
+		s.cleaning = true
+		go s.cleaner()
+	}
+}
+
+// Учесть обращение к кэшу
+func (s *cacheStore) count(module string, chain string, entry *cacheEntry, now time.Time) {
+	k := cacheStatKey{module: module, chain: chain}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c, exists := s.counters[k]
+	if !exists {
+		c = &cacheCounters{}
+		s.counters[k] = c
+	}
+
+	switch {
+	case entry == nil:
+		c.misses++
+	case now.Before(entry.expires):
+		c.hits++
+	default:
+		c.hits++
+		c.stale++
+	}
+}
+
+// Удалить записи, удовлетворяющие фильтру
+func (s *cacheStore) purge(filter func(entry *cacheEntry) bool) (n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.seq++
+
+	for _, entry := range s.entries {
+		if !filter(entry) {
+			continue
+		}
+
+		if len(s.flights) != 0 {
+			for _, tag := range entry.tags {
+				s.tagSeq[tag] = s.seq
+			}
+		}
+
+		s.remove(entry)
+		n++
+	}
+
+	return
+}
+
+// Статистика
+func (s *cacheStore) stats() (list []*CacheStat) {
+	now := misc.NowUTC()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	m := make(map[cacheStatKey]*CacheStat, len(s.counters))
+
+	get := func(k cacheStatKey) *CacheStat {
+		st, exists := m[k]
+		if !exists {
+			st = &CacheStat{
+				Module: k.module,
+				Chain:  k.chain,
+			}
+			m[k] = st
+		}
+		return st
+	}
+
+	for k, c := range s.counters {
+		st := get(k)
+		st.Hits = c.hits
+		st.Stale = c.stale
+		st.Misses = c.misses
+	}
+
+	for _, entry := range s.entries {
+		st := get(cacheStatKey{module: entry.module, chain: entry.chain})
+		st.Entries++
+		if !now.Before(entry.expires) {
+			st.Expired++
+		}
+		st.Memory += entry.size
+	}
+
+	list = slices.Collect(maps.Values(m))
+	slices.SortFunc(list, func(a, b *CacheStat) int {
+		if c := strings.Compare(a.Module, b.Module); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Chain, b.Chain)
+	})
+
+	return
+}
+
+// Удалить записи с указанными тегами
+func (s *cacheStore) invalidate(tags ...string) (n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.seq++
+
+	for _, tag := range tags {
+		if len(s.flights) != 0 {
+			s.tagSeq[tag] = s.seq
+		}
+
+		for _, entry := range s.tags[tag] {
+			s.remove(entry)
+			n++
+		}
+	}
+
+	return
+}
+
+// Удалить запись, под блокировкой
+func (s *cacheStore) remove(entry *cacheEntry) {
+	if s.entries[entry.key] != entry {
+		return
+	}
+
+	delete(s.entries, entry.key)
+	s.lru.Remove(entry.elem)
+	s.memory -= entry.size
+
+	for _, tag := range entry.tags {
+		keys := s.tags[tag]
+		delete(keys, entry.key)
+		if len(keys) == 0 {
+			delete(s.tags, tag)
+		}
+	}
+}
+
+// Удалить давно не использовавшиеся записи сверх CacheMaxEntries и CacheMaxMemory, под блокировкой
+func (s *cacheStore) evict() {
+	for (CacheMaxEntries > 0 && len(s.entries) > CacheMaxEntries) || (CacheMaxMemory > 0 && s.memory > CacheMaxMemory) {
+		elem := s.lru.Back()
+		if elem == nil {
+			return
+		}
+
+		s.remove(elem.Value.(*cacheEntry))
+	}
+}
+
+// Периодическое удаление протухших записей, чтобы не хранить те, к которым больше не обращаются.
+// Завершается, когда кэш опустел, и запускается снова при сохранении записи
+func (s *cacheStore) cleaner() {
+	ticker := time.NewTicker(CacheCleanupInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mutex.Lock()
+
+		s.cleanup(misc.NowUTC())
+
+		if len(s.entries) == 0 {
+			s.cleaning = false
+			s.mutex.Unlock()
+			return
+		}
+
+		s.mutex.Unlock()
+	}
+}
+
+// Удалить протухшие записи, под блокировкой
+func (s *cacheStore) cleanup(now time.Time) {
+	if now.Sub(s.lastCleanup) < CacheCleanupInterval {
+		return
+	}
+
+	s.lastCleanup = now
+
+	for _, entry := range s.entries {
+		if !now.Before(entry.staleUntil) && !now.Before(entry.errorUntil) {
+			s.remove(entry)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Сбросить кэш модуля. keys - параметры измененных записей в том же виде, что и для PublishChange.
+// Если keys не заданы, то сбрасывается весь кэш модуля, иначе выборки модуля и записи с указанными ID/GUID
+func InvalidateCache(moduleURL string, keys ...any) (n int) {
+	if len(keys) == 0 {
+		return responseCache.invalidate(cacheModuleTag(moduleURL))
+	}
+
+	tags := make(misc.BoolMap, len(keys)+1)
+	tags[moduleURL] = true
+
+	for _, k := range keys {
+		tags[cacheKeyTag(moduleURL, k)] = true
+	}
+
+	return responseCache.invalidate(slices.Collect(maps.Keys(tags))...)
+}
+
+// Статистика кэша по цепочкам модулей
+func CacheStats() []*CacheStat {
+	return responseCache.stats()
+}
+
+// Сбросить кэш: модуля (если moduleURL не пустой), scope (если scope не пустой) или весь
+func PurgeCache(moduleURL string, scope string) (n int) {
+	return responseCache.purge(func(entry *cacheEntry) bool {
+		return (moduleURL == "" || entry.module == moduleURL) && (scope == "" || entry.scope == scope)
+	})
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (proc *ProcOptions) moduleURL() string {
+	if proc.module == nil {
+		return proc.Path
+	}
+
+	return proc.module.RawURL
+}
+
+// Ключ кэша: URL с упорядоченными query параметрами и составляющие из CacheVary и CacheKey цепочки (или Info.CacheKey).
+// Заодно формирует Vary заголовок ответа.
+// Ключ строится по запросу, а не по разобранным параметрам (как было с proc.Path, RequestURI и PathParams/QueryParams):
+// порядок query параметров не важен (?a=1&b=2 и ?b=2&a=1 - одна запись), но разные записи значений (?id=1 и ?id=01)
+// и разные префиксы прокси дают разные записи. Первая составляющая - URL модуля: по общему пути версий API
+// (выбор по заголовкам) разные версии не получают ответы друг друга
+func (proc *ProcOptions) cacheKey() string {
+	var key strings.Builder
+	key.WriteString(proc.moduleURL())
+	key.WriteByte('\n')
+	key.WriteString(proc.R.URL.Path)
+	key.WriteByte('?')
+	key.WriteString(proc.R.URL.Query().Encode())
+
+	for _, v := range proc.ChainLocal.CacheVary {
+		key.WriteByte('\n')
+
+		switch v {
+		case path.CacheVaryIdentity:
+			proc.addVary(HTTPheaderAuthorization, HTTPheaderCookie)
+			if id := proc.AuthIdentity; id != nil {
+				fmt.Fprintf(&key, "%s:%s:%d:%s", id.Method, id.User, id.UserID, id.UserGUID)
+			}
+
+		case path.CacheVaryGroups:
+			proc.addVary(HTTPheaderAuthorization, HTTPheaderCookie)
+			if id := proc.AuthIdentity; id != nil {
+				groups := slices.Clone(id.Groups)
+				slices.Sort(groups)
+				key.WriteString(strings.Join(groups, ","))
+			}
+
+		case path.CacheVaryLocale:
+			proc.addVary(HTTPheaderCookie)
+			key.WriteString(proc.Locale)
+
+		default:
+			name := http.CanonicalHeaderKey(v)
+			proc.addVary(name)
+			key.WriteString(name)
+			key.WriteByte(':')
+			key.WriteString(strings.Join(proc.R.Header.Values(name), ","))
+		}
+	}
+
+	if f := proc.cacheKeyFunc(); f != nil {
+		key.WriteByte('\n')
+		key.WriteString(f(proc))
+	}
+
+	return key.String()
+}
+
+// Функция дополнительной составляющей ключа: цепочки, если нет - модуля
+func (proc *ProcOptions) cacheKeyFunc() (f FuncCacheKey) {
+	f, _ = chainCacheKey(proc.ChainLocal.CacheKey)
+	if f == nil && proc.Info != nil {
+		f = proc.Info.CacheKey
+	}
+
+	return
+}
+
+// Приведение Chain.CacheKey к FuncCacheKey
+func chainCacheKey(v any) (f FuncCacheKey, ok bool) {
+	switch v := v.(type) {
+	case nil:
+		return nil, true
+	case FuncCacheKey:
+		return v, true
+	case func(proc *ProcOptions) (key string):
+		return v, true
+	default:
+		return nil, false
+	}
+}
+
+// Проверка Chain.CacheKey всех цепочек модуля
+func (info *Info) checkCacheKeys() (err error) {
+	if info.Methods == nil {
+		return
+	}
+
+	for method, chains := range info.Methods.Methods {
+		for _, chain := range chains.Chains {
+			if _, ok := chainCacheKey(chain.CacheKey); !ok {
+				return fmt.Errorf(`%s chain "%s": CacheKey is %T, expected %T`, method, chain.Name, chain.CacheKey, FuncCacheKey(nil))
+			}
+		}
+	}
+
+	return
+}
+
+// Добавить заголовки запроса в Vary ответа
+func (proc *ProcOptions) addVary(names ...string) {
+	if proc.ExtraHeaders == nil {
+		proc.ExtraHeaders = make(misc.StringMap, 4)
+	}
+
+	vary := proc.ExtraHeaders[HTTPheaderVary]
+
+	for _, name := range names {
+		exists := false
+		for v := range strings.SplitSeq(vary, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), name) {
+				exists = true
+				break
+			}
+		}
+		if exists {
+			continue
+		}
+
+		if vary != "" {
+			vary += ", "
+		}
+		vary += name
+	}
+
+	proc.ExtraHeaders[HTTPheaderVary] = vary
+}
+
+// Поиск ответа в кэше. Если fill != nil, то после выполнения запроса надо вызвать cachePut.
+// При фоновом обновлении fill приходит в контексте запроса
+func (proc *ProcOptions) cacheGet() (fill *cacheFill, result any, code int, found bool) {
+	key := proc.cacheKey()
+
+	if fill, _ = proc.R.Context().Value(cacheRefreshKey{}).(*cacheFill); fill != nil && fill.key == key {
+		return
+	}
+
+	entry, fill := responseCache.get(key)
+	responseCache.count(proc.moduleURL(), proc.ChainLocal.Name, entry, misc.NowUTC())
+	if entry == nil {
+		return
+	}
+
+	if fill != nil {
+		// Отдаем протухшую запись и обновляем в фоне
+		proc.cacheRefresh(fill)
+		fill = nil
+	}
+
+	result, code = proc.cacheHit(entry)
+	found = true
+	return
+}
+
+// Ответ из записи кэша
+func (proc *ProcOptions) cacheHit(entry *cacheEntry) (result any, code int) {
+	vary := proc.ExtraHeaders[HTTPheaderVary]
+	proc.ExtraHeaders = maps.Clone(entry.data.headers)
+	if vary != "" {
+		proc.addVary(strings.Split(vary, ", ")...)
+	}
+
+	proc.cacheAge(entry)
+
+	return entry.data.result, entry.code
+}
+
+// Сохранение ответа в кэше. Кэшируются только успешные ответы.
+// Если обновление завершилось ошибкой сервера, а протухшую запись разрешено отдавать при ошибках, то отдается она
+func (proc *ProcOptions) cachePut(fill *cacheFill, result0 any, code0 int, err0 error) (result any, code int, err error) {
+	result, code, err = result0, code0, err0
+
+	if err != nil || (code != 0 && code/100 != 2) {
+		serverError := code == 0 || code/100 == 5
+		fill.commit(nil, serverError)
+
+		if serverError && fill.stale != nil && misc.NowUTC().Before(fill.stale.errorUntil) {
+			proc.LogFacility.Message(log.NOTICE, "[%d] Stale cached data returned instead of error: %d %v", proc.ID, code, err)
+			result, code = proc.cacheHit(fill.stale)
+			err = nil
+		}
+		return
+	}
+
+	moduleURL := proc.moduleURL()
+
+	cd := cachedData{
+		headers: maps.Clone(proc.ExtraHeaders),
+		result:  result,
+	}
+	// Сжатие выбирается для каждого клиента отдельно при отправке
+	delete(cd.headers, stdhttp.HTTPheaderContentEncoding)
+
+	now := misc.NowUTC()
+	expires := now.Add(time.Duration(proc.ChainLocal.CacheLifetime))
+
+	entry := &cacheEntry{
+		key:        fill.key,
+		module:     moduleURL,
+		chain:      proc.ChainLocal.Name,
+		scope:      proc.Scope,
+		tags:       []string{cacheModuleTag(moduleURL), cacheKeyTag(moduleURL, proc.PathParams)},
+		code:       code,
+		data:       cd,
+		size:       int64(len(fill.key)) + approxSize(reflect.ValueOf(cd.headers), 0) + approxSize(reflect.ValueOf(result), 0),
+		created:    now,
+		expires:    expires,
+		staleUntil: expires.Add(time.Duration(proc.ChainLocal.CacheStaleWhileRevalidate)),
+		errorUntil: expires.Add(time.Duration(proc.ChainLocal.CacheStaleIfError)),
+	}
+
+	fill.commit(entry, false)
+
+	proc.cacheAge(entry)
+	return
+}
+
+// Фоновое обновление записи повторным выполнением запроса
+func (proc *ProcOptions) cacheRefresh(fill *cacheFill) {
+	module := proc.module
+	if module == nil {
+		fill.commit(nil, false)
+		return
+	}
+
+	r := proc.R.Clone(context.WithValue(context.WithoutCancel(proc.R.Context()), cacheRefreshKey{}, fill))
+	r.Header.Del(stdhttp.HTTPheaderAcceptEncoding)
+
+	tail := proc.Tail
+	find := func(string) (*Module, string, []string, bool) {
+		return module, module.RawURL, tail, true
+	}
+
+	extra, h, id, prefix, urlPath := proc.Extra, proc.H, proc.ID, proc.Prefix, proc.Path
+
+	go func() {
+		// Если запрос не дошел до Get
+		defer fill.commit(nil, true)
+
+		HandlerEx(find, extra, h, id, prefix, urlPath, newResponseBuffer(), r)
+	}()
+}
+
+// Возраст ответа в кэше. Cache-Control формируется при отправке ответа
+func (proc *ProcOptions) cacheAge(entry *cacheEntry) {
+	proc.ExtraHeaders[HTTPheaderAge] = strconv.Itoa(max(0, int(misc.NowUTC().Sub(entry.created).Seconds())))
+}
+
+// Сброс кэша модуля после успешного изменения
+func (proc *ProcOptions) invalidateCache() {
+	if proc.ExecResult == nil {
+		// Нестандартный обработчик, что изменилось - неизвестно
+		for _, u := range proc.moduleURLs() {
+			InvalidateCache(u)
+		}
+		return
+	}
+
+	if proc.ExecResult.SuccessRows == 0 {
+		return
+	}
+
+	keys := make([]any, 0, 2*len(proc.ExecResult.Rows))
+
+	if cacheKeyTag("", proc.PathParams) != "" {
+		keys = append(keys, proc.PathParams)
+	}
+
+	for _, r := range proc.ExecResult.Rows {
+		if r.Code/100 != 2 {
+			continue
+		}
+
+		if r.ID != 0 {
+			keys = append(keys, misc.InterfaceMap{path.VarID: r.ID})
+		}
+
+		if r.GUID != "" {
+			keys = append(keys, misc.InterfaceMap{path.VarGUID: r.GUID})
+		}
+	}
+
+	// Если изменены записи, ключи которых неизвестны, то сбрасывается весь модуль
+	for _, u := range proc.moduleURLs() {
+		InvalidateCache(u, keys...)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Приблизительный размер данных в памяти
+func approxSize(v reflect.Value, depth int) int64 {
+	if !v.IsValid() {
+		return 0
+	}
+
+	return int64(v.Type().Size()) + referencedSize(v, depth)
+}
+
+// Размер данных, на которые ссылается значение
+func referencedSize(v reflect.Value, depth int) (size int64) {
+	if depth > 32 {
+		return
+	}
+
+	depth++
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			size = approxSize(v.Elem(), depth)
+		}
+
+	case reflect.String:
+		size = int64(v.Len())
+
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice {
+			size = int64(v.Len()) * int64(v.Type().Elem().Size())
+		}
+
+		switch v.Type().Elem().Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.String, reflect.Slice, reflect.Array, reflect.Map, reflect.Struct:
+			for i := range v.Len() {
+				size += referencedSize(v.Index(i), depth)
+			}
+		}
+
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			size += approxSize(iter.Key(), depth) + approxSize(iter.Value(), depth)
+		}
+
+	case reflect.Struct:
+		for i := range v.NumField() {
+			size += referencedSize(v.Field(i), depth)
+		}
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
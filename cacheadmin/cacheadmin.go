@@ -0,0 +1,162 @@
+/*
+Модуль управления кэшем GET запросов: статистика и сброс.
+Подключается через ModuleRegistration, доступ определяется настройками авторизации для его пути
+*/
+package cacheadmin
+
+import (
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+	rest "github.com/alrusov/rest/v4"
+	path "github.com/alrusov/rest/v4/path"
+	"github.com/alrusov/stdhttp"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Настройки в конфиге
+	Config struct {
+		AdminOnly bool `toml:"admin-only"` // Только для пользователей с IsAdmin
+	}
+
+	module struct {
+		info *rest.Info
+	}
+
+	queryParams struct {
+		Module string `json:"module" comment:"Module URL, e.g. /api/users. Empty - all modules"`
+		Scope  string `json:"scope" comment:"Scope, e.g. select.all. Empty - all scopes"`
+	}
+
+	// Результат сброса
+	PurgeResult struct {
+		Removed int `json:"removed" comment:"Number of removed entries"`
+	}
+)
+
+const (
+	// Путь по умолчанию
+	DefaultPath = "/cache"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (x *Config) Check(cfg any) (err error) {
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Регистрация модуля. Если p пустой, то DefaultPath
+func Register(p string) (err error) {
+	if p == "" {
+		p = DefaultPath
+	}
+
+	stdParams := path.Params{
+		QueryParamsPattern: queryParams{},
+	}
+
+	chains := func(summary string) *path.Chains {
+		return &path.Chains{
+			Summary:   summary,
+			StdParams: stdParams,
+			Chains: path.ChainsList{
+				{
+					Name: "all",
+					Tokens: []*path.Token{
+						{Expr: "", VarName: path.VarIgnore},
+					},
+				},
+			},
+		}
+	}
+
+	m := &module{
+		info: &rest.Info{
+			Path:    p,
+			Summary: "Cache of GET requests",
+			Tags:    []string{"cache"},
+			Methods: &path.Set{
+				Methods: path.Methods{
+					stdhttp.MethodGET:    chains("Cache statistics by module and chain"),
+					stdhttp.MethodDELETE: chains("Purge cache by module, by scope or entirely"),
+				},
+			},
+			Config: &Config{},
+			DBtype: rest.DBtypeNone,
+		},
+	}
+
+	return rest.ModuleRegistration(m)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (m *module) Info() *rest.Info {
+	return m.info
+}
+
+// Все делается здесь, до обращения к базе
+func (m *module) Prepare(proc *rest.ProcOptions) (result any, code int, err error) {
+	cfg, _ := m.info.Config.(*Config)
+	if cfg != nil && cfg.AdminOnly {
+		if proc.AuthIdentity == nil {
+			code, err = rest.Unauthorized("")
+			return
+		}
+		if !proc.AuthIdentity.IsAdmin {
+			code, err = rest.Forbidden("")
+			return
+		}
+	}
+
+	qp, _ := proc.QueryParams.(*queryParams)
+	if qp == nil {
+		qp = &queryParams{}
+	}
+
+	switch proc.R.Method {
+	case stdhttp.MethodGET:
+		stats := rest.CacheStats()
+		if qp.Module != "" {
+			list := make([]*rest.CacheStat, 0, len(stats))
+			for _, st := range stats {
+				if st.Module == qp.Module {
+					list = append(list, st)
+				}
+			}
+			stats = list
+		}
+
+		result = stats
+		if len(stats) == 0 {
+			result = []*rest.CacheStat{}
+		}
+
+	case stdhttp.MethodDELETE:
+		module := qp.Module
+		if module != "" {
+			module = misc.NormalizeSlashes(module)
+		}
+
+		n := rest.PurgeCache(module, qp.Scope)
+		proc.LogFacility.Message(log.INFO, `[%d] Cache purged (module "%s", scope "%s"): %d entries removed`, proc.ID, qp.Module, qp.Scope, n)
+		result = &PurgeResult{
+			Removed: n,
+		}
+	}
+
+	return
+}
+
+func (m *module) Before(proc *rest.ProcOptions) (result any, code int, err error) {
+	return
+}
+
+func (m *module) After(proc *rest.ProcOptions) (result any, code int, err error) {
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,198 @@
+package cacheadmin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alrusov/auth"
+	"github.com/alrusov/config"
+	"github.com/alrusov/misc"
+	rest "github.com/alrusov/rest/v4"
+	path "github.com/alrusov/rest/v4/path"
+	"github.com/alrusov/stdhttp"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type testAPI struct {
+	info *rest.Info
+}
+
+func (m *testAPI) Info() *rest.Info {
+	return m.info
+}
+
+func (m *testAPI) Prepare(proc *rest.ProcOptions) (result any, code int, err error) {
+	return
+}
+
+func (m *testAPI) Before(proc *rest.ProcOptions) (result any, code int, err error) {
+	return misc.StringMap{"path": m.info.Path}, 0, nil
+}
+
+func (m *testAPI) After(proc *rest.ProcOptions) (result any, code int, err error) {
+	return
+}
+
+// Заполняет кэш ответами двух модулей
+func fillCache(t *testing.T) (cleanup func()) {
+	for _, p := range []string{"/users", "/orders"} {
+		set := &path.Set{
+			Methods: path.Methods{
+				stdhttp.MethodGET: {
+					Chains: path.ChainsList{
+						{Name: "all", Scope: "select.all", Tokens: []*path.Token{{Expr: "", VarName: path.VarIgnore}}, CacheLifetime: config.Duration(time.Minute)},
+					},
+				},
+			},
+		}
+		if err := set.Prepare(); err != nil {
+			t.Fatal(err)
+		}
+
+		m := &rest.Module{RawURL: "/api" + p, LogFacility: rest.Log}
+		m.Handler = &testAPI{info: &rest.Info{Path: p, Methods: set}}
+		m.Info = m.Handler.Info()
+
+		find := func(string) (*rest.Module, string, []string, bool) {
+			return m, m.RawURL, []string{}, true
+		}
+
+		w := httptest.NewRecorder()
+		rest.HandlerEx(find, nil, nil, 1, "", m.RawURL, w, httptest.NewRequest(stdhttp.MethodGET, m.RawURL, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d %q", m.RawURL, w.Code, w.Body.String())
+		}
+	}
+
+	if n := len(rest.CacheStats()); n != 2 {
+		t.Fatalf("got %d cache stats, expected 2", n)
+	}
+
+	return func() {
+		rest.PurgeCache("", "")
+	}
+}
+
+func call(m *module, method string, identity *auth.Identity, qp *queryParams) (result any, code int, err error) {
+	proc := &rest.ProcOptions{
+		R:            httptest.NewRequest(method, "/cache", nil),
+		LogFacility:  rest.Log,
+		AuthIdentity: identity,
+		QueryParams:  qp,
+	}
+
+	return m.Prepare(proc)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestAccess(t *testing.T) {
+	defer fillCache(t)()
+
+	m := &module{info: &rest.Info{Config: &Config{AdminOnly: true}}}
+
+	for _, method := range []string{stdhttp.MethodGET, stdhttp.MethodDELETE} {
+		for _, c := range []struct {
+			identity *auth.Identity
+			code     int
+		}{
+			{nil, http.StatusUnauthorized},
+			{&auth.Identity{User: "user"}, http.StatusForbidden},
+		} {
+			result, code, err := call(m, method, c.identity, &queryParams{})
+			if code != c.code || err == nil || result != nil {
+				t.Errorf("%s %#v: got %d, %v, %#v, expected %d", method, c.identity, code, err, result, c.code)
+			}
+		}
+	}
+
+	// Отказанный DELETE ничего не сбросил
+	for _, st := range rest.CacheStats() {
+		if st.Entries != 1 {
+			t.Errorf("%s: got %d entries, expected 1", st.Module, st.Entries)
+		}
+	}
+
+	// Без AdminOnly проверок нет
+	m.info.Config = &Config{}
+	if _, code, err := call(m, stdhttp.MethodGET, nil, &queryParams{}); code != 0 || err != nil {
+		t.Errorf("got %d, %v", code, err)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestStatsAndPurge(t *testing.T) {
+	defer fillCache(t)()
+
+	m := &module{info: &rest.Info{Config: &Config{AdminOnly: true}}}
+	admin := &auth.Identity{User: "admin", IsAdmin: true}
+
+	stats := func(module string) []*rest.CacheStat {
+		result, code, err := call(m, stdhttp.MethodGET, admin, &queryParams{Module: module})
+		if code != 0 || err != nil {
+			t.Fatalf("GET %s: got %d, %v", module, code, err)
+		}
+
+		list, _ := result.([]*rest.CacheStat)
+		if list == nil {
+			t.Fatalf("GET %s: got %#v", module, result)
+		}
+		return list
+	}
+
+	if list := stats(""); len(list) != 2 {
+		t.Errorf("got %d stats, expected 2", len(list))
+	}
+
+	if list := stats("/api/users"); len(list) != 1 || list[0].Module != "/api/users" || list[0].Entries != 1 || list[0].Misses == 0 {
+		t.Errorf("/api/users: got %d stats", len(list))
+		for _, st := range list {
+			t.Logf("%#v", st)
+		}
+	}
+
+	if list := stats("/api/unknown"); len(list) != 0 {
+		t.Errorf("/api/unknown: got %d stats, expected 0", len(list))
+	}
+
+	purge := func(qp *queryParams, expected int) {
+		result, code, err := call(m, stdhttp.MethodDELETE, admin, qp)
+		if code != 0 || err != nil {
+			t.Fatalf("DELETE %#v: got %d, %v", qp, code, err)
+		}
+
+		res, _ := result.(*PurgeResult)
+		if res == nil || res.Removed != expected {
+			t.Errorf("DELETE %#v: got %#v, expected %d removed", qp, result, expected)
+		}
+	}
+
+	// Счетчики остаются после сброса, проверяются только записи
+	entries := func(expected ...int) {
+		list := stats("")
+		if len(list) != len(expected) {
+			t.Fatalf("got %d stats, expected %d", len(list), len(expected))
+		}
+
+		for i, st := range list {
+			if st.Entries != expected[i] {
+				t.Errorf("%s: got %d entries, expected %d", st.Module, st.Entries, expected[i])
+			}
+		}
+	}
+
+	purge(&queryParams{Scope: "select.unknown"}, 0)
+	entries(1, 1)
+
+	purge(&queryParams{Module: "/api/users/"}, 1)
+	entries(1, 0) // /api/orders, /api/users
+
+	purge(&queryParams{}, 1)
+	entries(0, 0)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
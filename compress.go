@@ -0,0 +1,295 @@
+package rest
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/alrusov/stdhttp"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Кодировщик для Content-Encoding
+	Encoder struct {
+		Name      string                                               // Имя в Accept-Encoding/Content-Encoding
+		NewWriter func(w io.Writer, level int) (io.WriteCloser, error) // level == 0 - уровень по умолчанию
+	}
+
+	// zstd кодировщик, возвращаемый в пул при закрытии
+	zstdWriter struct {
+		*zstd.Encoder
+		pool *sync.Pool
+	}
+)
+
+const (
+	ContentEncodingGzip     = stdhttp.ContentEncodingGzip
+	ContentEncodingDeflate  = "deflate"
+	ContentEncodingZstd     = "zstd"
+	ContentEncodingBrotli   = "br"
+	ContentEncodingIdentity = "identity"
+
+	HTTPheaderVary = "Vary"
+)
+
+var (
+	// Порядок предпочтения при одинаковых весах в Accept-Encoding. Используются только зарегистрированные кодировщики
+	CompressionPreference = []string{ContentEncodingZstd, ContentEncodingBrotli, ContentEncodingGzip, ContentEncodingDeflate}
+
+	// Минимальный размер буферизованного ответа для сжатия, если в цепочке не задано иное. Отрицательное значение - не сжимать
+	CompressionMinSize = 0
+
+	encodersMutex = new(sync.RWMutex)
+
+	// Пулы zstd кодировщиков по уровням. Создание кодировщика дорогое (большие буферы), поэтому они переиспользуются
+	zstdPools [zstd.SpeedBestCompression + 1]sync.Pool
+
+	encoders = map[string]*Encoder{
+		ContentEncodingZstd: {
+			// level - уровень zstd (1..22), приводится к ближайшему уровню кодировщика
+			Name:      ContentEncodingZstd,
+			NewWriter: newZstdWriter,
+		},
+		ContentEncodingBrotli: {
+			Name: ContentEncodingBrotli,
+			NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+				if level == 0 {
+					level = brotli.DefaultCompression
+				}
+				if level < brotli.BestSpeed || level > brotli.BestCompression {
+					return nil, fmt.Errorf("illegal brotli level %d", level)
+				}
+				return brotli.NewWriterLevel(w, level), nil
+			},
+		},
+		ContentEncodingGzip: {
+			Name: ContentEncodingGzip,
+			NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+				if level == 0 {
+					level = gzip.DefaultCompression
+				}
+				return gzip.NewWriterLevel(w, level)
+			},
+		},
+		ContentEncodingDeflate: {
+			// По RFC 9110 deflate - это zlib поток, а не "голый" deflate
+			Name: ContentEncodingDeflate,
+			NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+				if level == 0 {
+					level = flate.DefaultCompression
+				}
+				return zlib.NewWriterLevel(w, level)
+			},
+		},
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// level - уровень zstd (1..22), приводится к ближайшему уровню кодировщика.
+// Кодировщики однопоточные: ответы сжимаются параллельно в разных запросах, а не внутри одного
+func newZstdWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	l := zstd.SpeedDefault
+	if level != 0 {
+		l = zstd.EncoderLevelFromZstd(level)
+	}
+
+	pool := &zstdPools[l]
+
+	enc, _ := pool.Get().(*zstd.Encoder)
+	if enc != nil {
+		enc.Reset(w)
+		return &zstdWriter{Encoder: enc, pool: pool}, nil
+	}
+
+	enc, err := zstd.NewWriter(w, zstd.WithEncoderLevel(l), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+
+	return &zstdWriter{Encoder: enc, pool: pool}, nil
+}
+
+// Повторный Close ничего не делает, чтобы кодировщик не попал в пул дважды
+func (w *zstdWriter) Close() (err error) {
+	if w.Encoder == nil {
+		return
+	}
+
+	err = w.Encoder.Close()
+
+	w.Encoder.Reset(nil)
+	w.pool.Put(w.Encoder)
+	w.Encoder = nil
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Добавить (заменить) кодировщик
+func AddEncoder(enc *Encoder) (err error) {
+	if enc == nil || enc.Name == "" || enc.Name == ContentEncodingIdentity || enc.NewWriter == nil {
+		return fmt.Errorf("illegal encoder %#v", enc)
+	}
+
+	encodersMutex.Lock()
+	encoders[enc.Name] = enc
+	encodersMutex.Unlock()
+
+	return
+}
+
+func GetEncoder(name string) (enc *Encoder, exists bool) {
+	encodersMutex.RLock()
+	defer encodersMutex.RUnlock()
+
+	enc, exists = encoders[name]
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Выбор кодировщика по Accept-Encoding. nil - без сжатия
+func negotiateEncoding(r *http.Request) (enc *Encoder) {
+	if r == nil {
+		return
+	}
+
+	list := parseQList(r.Header, stdhttp.HTTPheaderAcceptEncoding)
+	if len(list) == 0 {
+		return
+	}
+
+	bestQ := 0.
+
+	for _, name := range CompressionPreference {
+		e, exists := GetEncoder(name)
+		if !exists {
+			continue
+		}
+
+		q, found := list.weight(name, "*")
+		if !found || q <= bestQ {
+			continue
+		}
+
+		enc = e
+		bestQ = q
+	}
+
+	return
+}
+
+// Упаковать буфер
+func (enc *Encoder) pack(data []byte, level int) (packed []byte, err error) {
+	b := new(bytes.Buffer)
+	b.Grow(len(data) / 2)
+
+	w, err := enc.NewWriter(b, level)
+	if err != nil {
+		return
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		w.Close()
+		return
+	}
+
+	err = w.Close()
+	if err != nil {
+		return
+	}
+
+	packed = b.Bytes()
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Уровень сжатия для цепочки
+func (proc *ProcOptions) compressLevel() int {
+	if proc.Chain == nil {
+		return 0
+	}
+
+	return proc.ChainLocal.CompressLevel
+}
+
+// Минимальный размер для сжатия для цепочки
+func (proc *ProcOptions) compressMinSize() int {
+	if proc.Chain == nil || proc.ChainLocal.CompressMinSize == 0 {
+		return CompressionMinSize
+	}
+
+	return proc.ChainLocal.CompressMinSize
+}
+
+// Кодировщик для потокового ответа, размер которого заранее неизвестен
+func (proc *ProcOptions) streamEncoder() (enc *Encoder) {
+	if proc.compressMinSize() < 0 || proc.ExtraHeaders[stdhttp.HTTPheaderContentEncoding] != "" {
+		return
+	}
+
+	return negotiateEncoding(proc.R)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Запись буферизованного ответа со сжатием, выбранным по Accept-Encoding.
+// Если Content-Encoding уже задан в ExtraHeaders, то данные считаются подготовленными и не трогаются
+func (proc *ProcOptions) writeReply(code int, contentType string, data []byte) (err error) {
+	h := proc.W.Header()
+
+	encoding := proc.ExtraHeaders[stdhttp.HTTPheaderContentEncoding]
+
+	if encoding == "" && len(data) > 0 {
+		minSize := proc.compressMinSize()
+		if minSize >= 0 {
+			proc.addVary(stdhttp.HTTPheaderAcceptEncoding)
+
+			if len(data) >= minSize {
+				enc := negotiateEncoding(proc.R)
+				if enc != nil {
+					data, err = enc.pack(data, proc.compressLevel())
+					if err != nil {
+						return
+					}
+					encoding = enc.Name
+				}
+			}
+		}
+	}
+
+	if contentType != "" {
+		stdhttp.WriteContentHeader(proc.W, contentType)
+	}
+
+	for n, v := range proc.ExtraHeaders {
+		h.Set(n, v)
+	}
+
+	if encoding != "" {
+		h.Set(stdhttp.HTTPheaderContentEncoding, encoding)
+	}
+
+	proc.W.WriteHeader(code)
+
+	if len(data) > 0 {
+		_, err = proc.W.Write(data)
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,359 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/alrusov/config"
+	"github.com/alrusov/stdhttp"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// CORS (Cross-Origin Resource Sharing).
+//
+// Политика задается глобально (DefaultCORS или блок CORSConfigName в extraConfigs для Init) и для модуля (Info.CORS или
+// поле типа CORSConfig / *CORSConfig в Info.Config, загружаемое вместе с остальными настройками endpoint'а).
+// Политика модуля полностью заменяет глобальную, Disabled отключает CORS для модуля.
+//
+// Preflight (OPTIONS с Origin и Access-Control-Request-Method) отвечается 204 с методами цепочек, подходящих для пути
+// (и разрешенных в AllowedMethods, если они заданы), даже если для OPTIONS описаны свои цепочки.
+// Остальные запросы с разрешенным Origin получают Access-Control-Allow-Origin, а в Access-Control-Expose-Headers
+// кроме ExposedHeaders попадают OutHeaders цепочки и заголовки, которые добавляет сам rest.
+// Запросы с неразрешенным Origin обрабатываются как обычно, но без CORS заголовков.
+
+type (
+	// Настройки CORS
+	CORSConfig struct {
+		Disabled         bool            `toml:"disabled"`          // Отключить CORS (для модуля - даже если задана глобальная политика)
+		AllowedOrigins   []string        `toml:"allowed-origins"`   // Разрешенные Origin. * - любой (нельзя с AllowCredentials), допустим один * в шаблоне: https://*.example.com
+		AllowedMethods   []string        `toml:"allowed-methods"`   // Разрешенные методы. Пусто - все методы цепочек
+		AllowedHeaders   []string        `toml:"allowed-headers"`   // Разрешенные заголовки запроса. Пусто или * - запрошенные в preflight
+		ExposedHeaders   []string        `toml:"exposed-headers"`   // Дополнительные заголовки ответа, доступные клиенту
+		AllowCredentials bool            `toml:"allow-credentials"` // Разрешить cookies и авторизацию
+		MaxAge           config.Duration `toml:"max-age"`           // Время кэширования preflight ответа. 0 - не задавать
+	}
+)
+
+const (
+	// Имя блока глобальных настроек CORS в extraConfigs
+	CORSConfigName = "cors"
+
+	HTTPheaderOrigin                        = "Origin"
+	HTTPheaderAccessControlRequestMethod    = "Access-Control-Request-Method"
+	HTTPheaderAccessControlRequestHeaders   = "Access-Control-Request-Headers"
+	HTTPheaderAccessControlAllowOrigin      = "Access-Control-Allow-Origin"
+	HTTPheaderAccessControlAllowMethods     = "Access-Control-Allow-Methods"
+	HTTPheaderAccessControlAllowHeaders     = "Access-Control-Allow-Headers"
+	HTTPheaderAccessControlAllowCredentials = "Access-Control-Allow-Credentials"
+	HTTPheaderAccessControlExposeHeaders    = "Access-Control-Expose-Headers"
+	HTTPheaderAccessControlMaxAge           = "Access-Control-Max-Age"
+)
+
+var (
+	// Глобальная политика CORS. nil - CORS только для модулей со своей политикой
+	DefaultCORS *CORSConfig
+
+	// Политика, загруженная и проверенная в loadGlobalCORS
+	loadedCORS *CORSConfig
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (x *CORSConfig) Check(cfg any) (err error) {
+	for i, origin := range x.AllowedOrigins {
+		origin = strings.ToLower(strings.TrimRight(strings.TrimSpace(origin), "/"))
+		if origin == "" {
+			return fmt.Errorf("cors: empty origin")
+		}
+
+		if strings.Count(origin, "*") > 1 {
+			return fmt.Errorf(`cors: origin "%s" contains more than one "*"`, origin)
+		}
+
+		x.AllowedOrigins[i] = origin
+	}
+
+	if x.AllowCredentials && slices.Contains(x.AllowedOrigins, "*") {
+		return fmt.Errorf(`cors: allow-credentials can't be used with the "*" origin, list the allowed origins explicitly`)
+	}
+
+	for i, method := range x.AllowedMethods {
+		x.AllowedMethods[i] = strings.ToUpper(strings.TrimSpace(method))
+	}
+
+	for i, name := range x.AllowedHeaders {
+		x.AllowedHeaders[i] = http.CanonicalHeaderKey(strings.TrimSpace(name))
+	}
+
+	for i, name := range x.ExposedHeaders {
+		x.ExposedHeaders[i] = http.CanonicalHeaderKey(strings.TrimSpace(name))
+	}
+
+	if x.MaxAge < 0 {
+		return fmt.Errorf("cors: negative max-age")
+	}
+
+	return
+}
+
+// Разрешен ли Origin
+func (x *CORSConfig) originAllowed(origin string) bool {
+	origin = strings.ToLower(strings.TrimRight(origin, "/"))
+
+	for _, pattern := range x.AllowedOrigins {
+		if matchOrigin(pattern, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Разрешен ли метод
+func (x *CORSConfig) methodAllowed(method string) bool {
+	return len(x.AllowedMethods) == 0 || slices.Contains(x.AllowedMethods, method)
+}
+
+// Сравнение Origin с шаблоном
+func matchOrigin(pattern string, origin string) bool {
+	prefix, suffix, wildcard := strings.Cut(pattern, "*")
+	if !wildcard {
+		return pattern == origin
+	}
+
+	return len(origin) >= len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Действующая политика модуля. nil - CORS не используется
+func (info *Info) corsPolicy() (cors *CORSConfig) {
+	cors = info.CORS
+	if cors == nil {
+		cors = DefaultCORS
+	}
+
+	if cors == nil || cors.Disabled {
+		return nil
+	}
+
+	return
+}
+
+// Загрузка глобальной политики из extraConfigs. Вызывается под configsMutex
+func loadGlobalCORS() (err error) {
+	raw, exists := configs[CORSConfigName]
+	if !exists || !isRawConfig(raw) {
+		return
+	}
+
+	cors := &CORSConfig{}
+
+	err = config.ConvExtra(&raw, cors)
+	if err != nil {
+		return fmt.Errorf("%s: %w", CORSConfigName, err)
+	}
+
+	err = cors.Check(appCfg)
+	if err != nil {
+		return
+	}
+
+	configs[CORSConfigName] = raw
+	DefaultCORS = cors
+	loadedCORS = cors
+	return
+}
+
+// Проверка глобальной политики, заданной программно (загруженная из конфига уже проверена)
+func checkGlobalCORS() (err error) {
+	if DefaultCORS == nil || DefaultCORS == loadedCORS {
+		return
+	}
+
+	return DefaultCORS.Check(appCfg)
+}
+
+// Поиск политики модуля в загруженном Info.Config
+func (info *Info) findCORSConfig() (err error) {
+	if info.CORS != nil {
+		return info.CORS.Check(appCfg)
+	}
+
+	v := reflect.Indirect(reflect.ValueOf(info.Config))
+	if v.Kind() != reflect.Struct {
+		return
+	}
+
+	for i := range v.NumField() {
+		f := v.Field(i)
+		if !v.Type().Field(i).IsExported() {
+			continue
+		}
+
+		var cors *CORSConfig
+
+		switch x := f.Interface().(type) {
+		case CORSConfig:
+			cors = &x
+		case *CORSConfig:
+			cors = x
+		default:
+			continue
+		}
+
+		// Пустой блок (в конфиге не задан) не отменяет глобальную политику
+		if cors == nil || reflect.ValueOf(*cors).IsZero() {
+			continue
+		}
+
+		info.CORS = cors
+		return info.CORS.Check(appCfg)
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Обработка CORS до поиска цепочки. processed == true, если на preflight уже ответили
+func (proc *ProcOptions) cors() (processed bool) {
+	cors := proc.Info.corsPolicy()
+	if cors == nil {
+		return
+	}
+
+	// Ответ зависит от Origin и для запросов без него, иначе кэши отдадут его и запросам с Origin
+	proc.addVary(HTTPheaderOrigin)
+
+	origin := proc.R.Header.Get(HTTPheaderOrigin)
+	if origin == "" {
+		return
+	}
+
+	preflight := proc.R.Method == stdhttp.MethodOPTIONS && proc.R.Header.Get(HTTPheaderAccessControlRequestMethod) != ""
+	if preflight {
+		proc.addVary(HTTPheaderAccessControlRequestMethod, HTTPheaderAccessControlRequestHeaders)
+	}
+
+	if !cors.originAllowed(origin) {
+		return
+	}
+
+	if !preflight {
+		if cors.methodAllowed(proc.R.Method) {
+			proc.corsOrigin(cors, origin)
+		}
+		return
+	}
+
+	var allow []string
+	if proc.Info.Methods != nil {
+		allow = proc.Info.Methods.Allow(proc.Tail)
+	}
+
+	if len(allow) == 0 {
+		proc.reply(nil, http.StatusNotFound, nil)
+		return true
+	}
+
+	methods := make([]string, 0, len(allow))
+	for _, method := range allow {
+		if cors.methodAllowed(method) {
+			methods = append(methods, method)
+		}
+	}
+
+	h := proc.W.Header()
+	h.Set(HTTPheaderAllow, strings.Join(allow, ", "))
+
+	if !slices.Contains(methods, strings.ToUpper(proc.R.Header.Get(HTTPheaderAccessControlRequestMethod))) {
+		// Метод не разрешен - ответ без CORS заголовков
+		proc.reply(nil, http.StatusNoContent, nil)
+		return true
+	}
+
+	proc.corsOrigin(cors, origin)
+	h.Set(HTTPheaderAccessControlAllowMethods, strings.Join(methods, ", "))
+
+	headers := proc.R.Header.Get(HTTPheaderAccessControlRequestHeaders)
+	if len(cors.AllowedHeaders) != 0 && !slices.Contains(cors.AllowedHeaders, "*") {
+		headers = strings.Join(cors.AllowedHeaders, ", ")
+	}
+	if headers != "" {
+		h.Set(HTTPheaderAccessControlAllowHeaders, headers)
+	}
+
+	if cors.MaxAge > 0 {
+		h.Set(HTTPheaderAccessControlMaxAge, strconv.Itoa(int(cors.MaxAge.D().Seconds())))
+	}
+
+	proc.reply(nil, http.StatusNoContent, nil)
+	return true
+}
+
+// Заголовки разрешенного Origin
+func (proc *ProcOptions) corsOrigin(cors *CORSConfig, origin string) {
+	h := proc.W.Header()
+
+	if cors.AllowCredentials || !slices.Contains(cors.AllowedOrigins, "*") {
+		h.Set(HTTPheaderAccessControlAllowOrigin, origin)
+	} else {
+		h.Set(HTTPheaderAccessControlAllowOrigin, "*")
+	}
+
+	if cors.AllowCredentials {
+		h.Set(HTTPheaderAccessControlAllowCredentials, "true")
+	}
+
+	proc.corsAllowed = true
+}
+
+// Access-Control-Expose-Headers после выбора цепочки
+func (proc *ProcOptions) corsExpose() {
+	if !proc.corsAllowed {
+		return
+	}
+
+	cors := proc.Info.corsPolicy()
+	if cors == nil {
+		return
+	}
+
+	names := slices.Clone(cors.ExposedHeaders)
+
+	add := func(name string) {
+		name = http.CanonicalHeaderKey(name)
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	if proc.Chain != nil {
+		for name := range proc.Chain.Params.OutHeaders {
+			add(name)
+		}
+	}
+
+	for name := range DeprecationOutHeaders(proc.Info, proc.Chain) {
+		add(name)
+	}
+
+	if proc.Info.Version != "" {
+		add(VersionHeader)
+	}
+
+	if len(names) == 0 {
+		return
+	}
+
+	slices.Sort(names)
+	proc.W.Header().Set(HTTPheaderAccessControlExposeHeaders, strings.Join(names, ", "))
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
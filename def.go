@@ -48,6 +48,8 @@ type (
 	FuncInit        func(info *Info) (err error)
 	FuncHandler     func(proc *ProcOptions) (result any, code int, err error)
 	FuncResultTuner func(proc *ProcOptions, result0 any, code0 int, err0 error) (result any, code int, err error)
+	FuncCacheKey    func(proc *ProcOptions) (key string)
+	FuncPermission  func(proc *ProcOptions) (allowed bool)
 
 	// Информация о методе
 	Info struct {
@@ -68,11 +70,28 @@ type (
 		After            FuncHandler     // User defined After function
 		shaping          *shaping.S      // Shaper
 		ResultTuner      FuncResultTuner // The last step result tuner
+		CacheKey         FuncCacheKey    // Дополнительная составляющая ключа кэша GET для цепочек, в которых не задан свой Chain.CacheKey
+
+		SoftDelete     bool           // Мягкое удаление: DELETE только помечает запись через поле с role:"deleted"
+		IncludeDeleted FuncPermission // Кому разрешен query параметр includeDeleted. Если nil, то только администраторам
+		deletedField   *deletedField  // Поле с role:"deleted"
+
+		Parent *Parent // Родитель вложенного модуля
+
+		Version string // Версия API (элемент пути перед Path). Заполняется при регистрации версий
+
+		Deprecated   bool      // Устаревший модуль
+		DeprecatedAt time.Time // Дата вывода из эксплуатации, задает и Deprecated
+		Sunset       time.Time // Дата отключения
+		Replacement  string    // URL замены
+
+		CORS *CORSConfig // Политика CORS модуля. Если nil, то из Config или глобальная DefaultCORS
 	}
 
 	// Опции запроса к методу
 	ProcOptions struct {
 		handler            API                 // Интерфейс метода
+		module             *Module             // Обработчик
 		LogFacility        *log.Facility       // Предпочтительная facility для логирования
 		H                  *stdhttp.HTTP       // HTTP листенер
 		LogSrc             string              // Строка с ID запроса для MessageWithSource
@@ -102,12 +121,17 @@ type (
 		DBqueryRows        *sqlx.Rows          // Результат при ResultAsRows==true
 		Fields             []misc.InterfaceMap // Поля (имя из sql запроса) для insert или update. Для select - список полей для выборки из базы, если нужны не все из объекта
 		ExcludedFields     misc.StringMap      // Поля ([name]db_name), которые надо исключить из запроса
+		WithDeleted        bool                // Не исключать мягко удаленные записи из выборки (includeDeleted)
+		ParentKey          any                 // Ключ родителя (uint64 или string) для вложенного модуля
 		InternalExecResult *ExecResult         // Внутренний промежуточный результат выполнения
 		ExecResult         *ExecResult         // Результат выполнения Exec
 		Locale             string              // Locale
 		ExtraHeaders       misc.StringMap      // Дополнительные возвращаемые HTTP заголовки
 		Extra              any                 // Произвольные данные от вызывающего
 		Custom             any                 // Произвольные пользовательские данные
+
+		deprecationDone bool // Заголовки вывода из эксплуатации уже добавлены
+		corsAllowed     bool // Origin разрешен политикой CORS
 	}
 
 	// Обработчик
@@ -117,6 +141,12 @@ type (
 		Handler     API           // Интерфейс метода
 		Info        *Info         // Информация о методе
 		LogFacility *log.Facility // Log facility
+
+		parent   *Module            // Родитель вложенного модуля
+		children map[string]*Module // Вложенные модули, ключ - имя коллекции
+
+		versions    map[string]*Module // Для пути без версии - модули всех версий, ключ - versionKey
+		versionURLs []string           // Для версий и пути без версии - URL всех версий и пути без версии
 	}
 
 	FieldDef struct {
@@ -134,9 +164,10 @@ type (
 	}
 
 	ExecResultRow struct {
-		Code int    `json:"code" comment:"Result code"`
-		ID   uint64 `json:"id,omitempty" comment:"ID of the created record"`
-		GUID string `json:"guid,omitempty" comment:"GUID of the created record"`
+		Code    int    `json:"code" comment:"Result code"`
+		ID      uint64 `json:"id,omitempty" comment:"ID of the created record"`
+		GUID    string `json:"guid,omitempty" comment:"GUID of the created record"`
+		Created *bool  `json:"created,omitempty" comment:"The record was created (true) or updated (false). Only for upsert queries returning the created column"`
 		MessagesBlock
 	}
 
@@ -167,6 +198,7 @@ const (
 
 	FlagLogUnknownParams   = 0x00000001 // Логировать полученные query параметры, которые не описаны в методе
 	FlagConvertReplyToJSON = 0x00000008 // Конвертировать ответ в json? Если он будет заранее подготовлен уже в таком формате, то НЕ СТАВИТЬ этот флаг!
+	FlagSubscriptions      = 0x00000010 // Разрешить подписку на изменения через WebSocket (GET с Upgrade: websocket)
 
 	// Использовать по возможности стандартные имена!
 	ParamCount      = "count"
@@ -175,6 +207,8 @@ const (
 	ParamIDs        = "ids"
 	ParamNames      = "names"
 
+	ParamIncludeDeleted = "includeDeleted" // Показывать мягко удаленные записи (только для тех, кому разрешено)
+
 	// Стандартные Scope цепочек разбора пути, они же и суффиксы именён запросов в базу
 	ScopeSelectAll     = "select.all"
 	ScopeSelectID      = "select.id"
@@ -189,6 +223,13 @@ const (
 	ScopeDeleteID      = "delete.id"
 	ScopeDeleteGUID    = "delete.guid"
 	ScopeDeleteName    = "delete.name"
+	ScopeUpsert        = "upsert"       // Вставка или обновление массива записей (POST, PUT, PATCH)
+	ScopeUpdateIDs     = "update.ids"   // Обновление списка записей по ID (PUT, PATCH)
+	ScopeUpdateGUIDs   = "update.guids" // Обновление списка записей по GUID (PUT, PATCH)
+	ScopeDeleteIDs     = "delete.ids"   // Удаление списка записей по ID
+	ScopeDeleteGUIDs   = "delete.guids" // Удаление списка записей по GUID
+	ScopeRestoreID     = "restore.id"   // Восстановление мягко удаленной записи по ID
+	ScopeRestoreGUID   = "restore.guid" // Восстановление мягко удаленной записи по GUID
 
 	// Признак статуса
 	StatusActive   = "active"
@@ -198,11 +239,14 @@ const (
 	ExprGUID    = "guid"
 	ExprName    = "name"
 	ExprPattern = "pattern"
+	ExprStatus  = "status"
+	ExprAny     = "any"
 
 	// Стандартные регулярки для Expr
 	REempty  = ``
 	REany    = `.+`
 	REid     = `\d+`
+	REname   = `[^/]+`
 	REstatus = StatusActive + "|" + StatusInactive
 	REguid   = `(?i)([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})`
 
@@ -218,6 +262,10 @@ const (
 
 	DBtypeNone = "-"
 
+	SubstConflictFields = "CONFLICT_FIELDS" // Поля конфликта для upsert через запятую
+	SubstUpsertSet      = "UPSERT_SET"      // Список field=EXCLUDED.field для upsert
+	SubstDeletedFilter  = "DELETED_FILTER"  // Условие отбора неудаленных записей при мягком удалении
+
 	CookieLocale = "locale"
 )
 
@@ -249,17 +297,60 @@ func (po *ProcOptions) QueryParamFound(name string) bool {
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
+// path для вложенного модуля - URL родителя, его цепочки включают путь от родителя
 type Enumerator func(path string, info *Info) (err error)
 
+// Перебор модулей, включая вложенные, с их собственными URL (Module.RawURL)
+type ModuleEnumerator func(m *Module) (err error)
+
 func Enumerate(e Enumerator) (err error) {
 	modulesMutex.RLock()
 	defer modulesMutex.RUnlock()
 
 	for path, df := range modules {
+		if df.versions != nil {
+			// Путь без версии дублирует одну из версий
+			continue
+		}
+
 		err = e(path, df.Info)
 		if err != nil {
 			return
 		}
+
+		// Цепочки вложенных модулей включают путь от родителя
+		for _, child := range df.children {
+			err = e(path, child.Info)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+func EnumerateModules(e ModuleEnumerator) (err error) {
+	modulesMutex.RLock()
+	defer modulesMutex.RUnlock()
+
+	for _, df := range modules {
+		if df.versions != nil {
+			// Путь без версии дублирует одну из версий
+			continue
+		}
+
+		err = e(df)
+		if err != nil {
+			return
+		}
+
+		for _, child := range df.children {
+			err = e(child)
+			if err != nil {
+				return
+			}
+		}
 	}
 
 	return
@@ -0,0 +1,311 @@
+package rest
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+	path "github.com/alrusov/rest/v4/path"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Вывод из эксплуатации модулей и цепочек.
+//
+// Deprecated, DeprecatedAt, Sunset и Replacement задаются в Info, Chains и Chain. Deprecated действует, если он
+// или DeprecatedAt задан на любом уровне, DeprecatedAt, Sunset и Replacement берутся с самого конкретного уровня,
+// где они заданы (Chain, затем Chains, затем Info). Ответ на запрос к устаревшему получает заголовки (RFC 9745, RFC 8594)
+//
+//	Deprecation: @<unix-seconds>
+//	Sunset: <HTTP-date>
+//	Link: <Replacement>; rel="successor-version"
+//
+// Если дата DeprecatedAt не задана, то отправляется Deprecation: true (как до RFC 9745), а при регистрации
+// модуля пишется предупреждение.
+//
+// Использование устаревших цепочек подсчитывается для каждого пользователя, первое обращение
+// и каждое DeprecatedLogEvery следующее пишутся в лог. Хранится не больше DeprecatedUsageMaxEntries записей,
+// при переполнении вытесняется давно не использовавшаяся, DeprecatedUsageReset очищает статистику.
+
+type (
+	// Сведения о выводе из эксплуатации
+	Deprecation struct {
+		Deprecated   bool
+		DeprecatedAt time.Time
+		Sunset       time.Time
+		Replacement  string
+	}
+
+	// Использование устаревшей цепочки
+	DeprecatedUsage struct {
+		URL      string    `json:"url" comment:"Module URL"`
+		Method   string    `json:"method" comment:"HTTP method"`
+		Chain    string    `json:"chain" comment:"Chain name"`
+		User     string    `json:"user" comment:"User"`
+		Count    uint64    `json:"count" comment:"Number of requests"`
+		LastUsed time.Time `json:"lastUsed" comment:"Time of the last request"`
+	}
+
+	deprecatedEntry struct {
+		key   string
+		usage DeprecatedUsage
+	}
+)
+
+const (
+	HTTPheaderDeprecation = "Deprecation"
+	HTTPheaderSunset      = "Sunset"
+	HTTPheaderLink        = "Link"
+)
+
+var (
+	// Писать в лог каждое N-е обращение пользователя к устаревшей цепочке (первое пишется всегда)
+	DeprecatedLogEvery = uint64(1000)
+
+	// Максимальное количество записей статистики использования устаревших цепочек. 0 - без ограничений
+	DeprecatedUsageMaxEntries = 10000
+
+	deprecatedMutex sync.Mutex
+	deprecatedUsage = map[string]*list.Element{}
+	deprecatedLRU   = list.New() // *deprecatedEntry, в начале - последние использованные
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Итоговые сведения для цепочки модуля. chain может быть nil
+func ResolveDeprecation(info *Info, chain *path.Chain) (d Deprecation) {
+	if info != nil {
+		d.merge(info.Deprecated, info.DeprecatedAt, info.Sunset, info.Replacement)
+	}
+
+	if chain == nil {
+		return
+	}
+
+	if chain.Parent != nil {
+		d.merge(chain.Parent.Deprecated, chain.Parent.DeprecatedAt, chain.Parent.Sunset, chain.Parent.Replacement)
+	}
+
+	d.merge(chain.Deprecated, chain.DeprecatedAt, chain.Sunset, chain.Replacement)
+	return
+}
+
+func (d *Deprecation) merge(deprecated bool, deprecatedAt time.Time, sunset time.Time, replacement string) {
+	d.Deprecated = d.Deprecated || deprecated || !deprecatedAt.IsZero()
+
+	if !deprecatedAt.IsZero() {
+		d.DeprecatedAt = deprecatedAt
+	}
+
+	if !sunset.IsZero() {
+		d.Sunset = sunset
+	}
+
+	if replacement != "" {
+		d.Replacement = replacement
+	}
+}
+
+// Задано ли что-нибудь
+func (d Deprecation) Active() bool {
+	return d.Deprecated || !d.Sunset.IsZero() || d.Replacement != ""
+}
+
+// Значение заголовка Deprecation (RFC 9745). Без даты - true, как до RFC 9745
+func (d Deprecation) header() string {
+	if d.DeprecatedAt.IsZero() {
+		return "true"
+	}
+
+	return "@" + strconv.FormatInt(d.DeprecatedAt.Unix(), 10)
+}
+
+// Проверка при регистрации: предупреждение для устаревшего без даты
+func (info *Info) checkDeprecation(url string) {
+	for _, s := range info.undatedDeprecation() {
+		Log.Message(log.WARNING, "[%s] %s without DeprecatedAt, Deprecation: true will be sent", url, s)
+	}
+}
+
+// Устаревшее без даты
+func (info *Info) undatedDeprecation() (undated []string) {
+	if d := ResolveDeprecation(info, nil); d.Deprecated && d.DeprecatedAt.IsZero() {
+		// Цепочки без своей даты - по той же причине
+		return []string{"deprecated module"}
+	}
+
+	if info.Methods != nil {
+		for method, chains := range info.Methods.Methods {
+			for _, chain := range chains.Chains {
+				if d := ResolveDeprecation(info, chain); d.Deprecated && d.DeprecatedAt.IsZero() {
+					undated = append(undated, fmt.Sprintf(`deprecated %s chain "%s"`, method, chain.Name))
+				}
+			}
+		}
+	}
+
+	sort.Strings(undated)
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Заголовки вывода из эксплуатации, которые может вернуть цепочка (для OpenAPI)
+func DeprecationOutHeaders(info *Info, chain *path.Chain) (headers misc.StringMap) {
+	d := ResolveDeprecation(info, chain)
+	if !d.Active() {
+		return
+	}
+
+	headers = make(misc.StringMap, 3)
+
+	switch {
+	case d.Deprecated && d.DeprecatedAt.IsZero():
+		headers[HTTPheaderDeprecation] = "The operation is deprecated (true)"
+	case d.Deprecated:
+		headers[HTTPheaderDeprecation] = "The operation is deprecated since " + d.DeprecatedAt.UTC().Format(http.TimeFormat) + " (@<unix-seconds>)"
+	}
+
+	if !d.Sunset.IsZero() {
+		headers[HTTPheaderSunset] = "The operation will be disabled after " + d.Sunset.UTC().Format(http.TimeFormat)
+	}
+
+	if d.Replacement != "" {
+		headers[HTTPheaderLink] = "Link to the replacement (successor-version): " + d.Replacement
+	}
+
+	return
+}
+
+// Заголовки ответа и учет использования устаревшего. Вызывается после выбора цепочки и в reply
+func (proc *ProcOptions) deprecation() {
+	if proc.deprecationDone || proc.Info == nil || proc.W == nil {
+		return
+	}
+
+	proc.deprecationDone = true
+
+	d := ResolveDeprecation(proc.Info, proc.Chain)
+	if !d.Active() {
+		return
+	}
+
+	h := proc.W.Header()
+
+	if d.Deprecated {
+		h.Set(HTTPheaderDeprecation, d.header())
+	}
+
+	if !d.Sunset.IsZero() {
+		h.Set(HTTPheaderSunset, d.Sunset.UTC().Format(http.TimeFormat))
+	}
+
+	if d.Replacement != "" {
+		h.Add(HTTPheaderLink, fmt.Sprintf(`<%s>; rel="successor-version"`, d.Replacement))
+	}
+
+	if _, internal := proc.W.(*responseBuffer); d.Deprecated && proc.Chain != nil && !internal {
+		// Внутренние повторы запросов (обновление кэша, подписки) не учитываются
+		proc.countDeprecated()
+	}
+}
+
+// Учет обращения к устаревшей цепочке
+func (proc *ProcOptions) countDeprecated() {
+	url := ""
+	if proc.module != nil {
+		url = proc.module.RawURL
+	}
+
+	user := "-"
+	if proc.AuthIdentity != nil && proc.AuthIdentity.User != "" {
+		user = proc.AuthIdentity.User
+	}
+
+	key := fmt.Sprintf("%s\x00%s\x00%s\x00%s", url, proc.R.Method, proc.Chain.Name, user)
+
+	deprecatedMutex.Lock()
+	e, exists := deprecatedUsage[key]
+	if exists {
+		deprecatedLRU.MoveToFront(e)
+	} else {
+		for DeprecatedUsageMaxEntries > 0 && len(deprecatedUsage) >= DeprecatedUsageMaxEntries {
+			evictDeprecatedUsage()
+		}
+
+		e = deprecatedLRU.PushFront(
+			&deprecatedEntry{
+				key: key,
+				usage: DeprecatedUsage{
+					URL:    url,
+					Method: proc.R.Method,
+					Chain:  proc.Chain.Name,
+					User:   user,
+				},
+			},
+		)
+		deprecatedUsage[key] = e
+	}
+	u := &e.Value.(*deprecatedEntry).usage
+	u.Count++
+	u.LastUsed = misc.NowUTC()
+	count := u.Count
+	deprecatedMutex.Unlock()
+
+	if count == 1 || (DeprecatedLogEvery > 0 && count%DeprecatedLogEvery == 0) {
+		proc.LogFacility.MessageWithSource(log.WARNING, proc.LogSrc, `Deprecated %s %s (chain "%s") is used by "%s" (%d times)`, proc.R.Method, url, proc.Chain.Name, user, count)
+	}
+}
+
+// Удаление давно не использовавшейся записи. Вызывается под deprecatedMutex
+func evictDeprecatedUsage() {
+	e := deprecatedLRU.Back()
+	if e == nil {
+		return
+	}
+
+	deprecatedLRU.Remove(e)
+	delete(deprecatedUsage, e.Value.(*deprecatedEntry).key)
+}
+
+// Очистка статистики использования устаревших цепочек
+func DeprecatedUsageReset() {
+	deprecatedMutex.Lock()
+	deprecatedUsage = map[string]*list.Element{}
+	deprecatedLRU.Init()
+	deprecatedMutex.Unlock()
+}
+
+// Статистика использования устаревших цепочек
+func DeprecatedUsageStat() (list []DeprecatedUsage) {
+	deprecatedMutex.Lock()
+	list = make([]DeprecatedUsage, 0, len(deprecatedUsage))
+	for _, e := range deprecatedUsage {
+		list = append(list, e.Value.(*deprecatedEntry).usage)
+	}
+	deprecatedMutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		a, b := &list[i], &list[j]
+		if a.URL != b.URL {
+			return a.URL < b.URL
+		}
+		if a.Method != b.Method {
+			return a.Method < b.Method
+		}
+		if a.Chain != b.Chain {
+			return a.Chain < b.Chain
+		}
+		return a.User < b.User
+	})
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -3,8 +3,8 @@ module github.com/alrusov/rest/v4
 go 1.26.2
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
 	github.com/alrusov/auth v0.1.11
-	github.com/alrusov/cache v0.1.5
 	github.com/alrusov/config v0.1.69
 	github.com/alrusov/db v0.1.60
 	github.com/alrusov/jsonw v0.1.3
@@ -12,12 +12,13 @@ require (
 	github.com/alrusov/misc v1.1.35
 	github.com/alrusov/shaping v0.1.3
 	github.com/alrusov/stdhttp v0.1.130
+	github.com/andybalholm/brotli v1.2.0
 	github.com/getkin/kin-openapi v0.135.0
 	github.com/jmoiron/sqlx v1.4.0
+	github.com/klauspost/compress v1.18.0
 )
 
 require (
-	github.com/DATA-DOG/go-sqlmock v1.5.2 // indirect
 	github.com/alrusov/initializer v0.1.3 // indirect
 	github.com/alrusov/loadavg v0.1.6 // indirect
 	github.com/alrusov/panic v0.1.16 // indirect
@@ -0,0 +1,262 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alrusov/misc"
+	path "github.com/alrusov/rest/v4/path"
+	"github.com/alrusov/stdhttp"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+const (
+	HTTPheaderLastModified    = "Last-Modified"
+	HTTPheaderIfModifiedSince = "If-Modified-Since"
+)
+
+var (
+	// Индекс поля с role:"modified" для типа, nil - поля нет
+	modifiedFields sync.Map // reflect.Type -> []int
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Значение Cache-Control для цепочки. Пустая строка - заголовок не нужен
+func cacheControlValue(chain *path.Chain) string {
+	p := chain.HTTPCache
+	if p == nil && chain.CacheLifetime <= 0 {
+		return ""
+	}
+
+	if p != nil && p.NoStore {
+		return "no-store"
+	}
+
+	cc := make([]string, 0, 6)
+
+	private := slices.Contains(chain.CacheVary, path.CacheVaryIdentity) || slices.Contains(chain.CacheVary, path.CacheVaryGroups)
+	maxAge := time.Duration(chain.CacheLifetime)
+
+	if p != nil {
+		private = private || p.Private
+		if p.MaxAge > 0 {
+			maxAge = time.Duration(p.MaxAge)
+		}
+
+		if private {
+			cc = append(cc, "private")
+		} else {
+			cc = append(cc, "public")
+		}
+	} else if private {
+		cc = append(cc, "private")
+	}
+
+	if maxAge <= 0 {
+		// Только с проверкой актуальности (Last-Modified)
+		cc = append(cc, "no-cache")
+		return strings.Join(cc, ", ")
+	}
+
+	cc = append(cc, fmt.Sprintf("max-age=%d", int(maxAge.Seconds())))
+
+	if p != nil && p.SMaxAge > 0 && !private {
+		cc = append(cc, fmt.Sprintf("s-maxage=%d", int(time.Duration(p.SMaxAge).Seconds())))
+	}
+
+	if v := time.Duration(chain.CacheStaleWhileRevalidate); v > 0 {
+		cc = append(cc, fmt.Sprintf("stale-while-revalidate=%d", int(v.Seconds())))
+	}
+
+	if v := time.Duration(chain.CacheStaleIfError); v > 0 {
+		cc = append(cc, fmt.Sprintf("stale-if-error=%d", int(v.Seconds())))
+	}
+
+	return strings.Join(cc, ", ")
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Индекс поля с role:"modified" в структуре (или в элементе слайса структур)
+func modifiedField(tp reflect.Type) (idx []int) {
+	for tp != nil && (tp.Kind() == reflect.Pointer || tp.Kind() == reflect.Slice || tp.Kind() == reflect.Array) {
+		tp = tp.Elem()
+	}
+
+	if tp == nil || tp.Kind() != reflect.Struct {
+		return
+	}
+
+	if v, exists := modifiedFields.Load(tp); exists {
+		return v.([]int)
+	}
+
+	for _, f := range reflect.VisibleFields(tp) {
+		if f.IsExported() && f.Tag.Get(path.TagRole) == path.RoleModified {
+			idx = f.Index
+			break
+		}
+	}
+
+	modifiedFields.Store(tp, idx)
+	return
+}
+
+// Время последнего изменения: максимальное значение поля с role:"modified" в результате
+func lastModified(result any) (t time.Time) {
+	if misc.IsNil(result) {
+		return
+	}
+
+	v := reflect.ValueOf(result)
+
+	idx := modifiedField(v.Type())
+	if idx == nil {
+		return
+	}
+
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+
+	check := func(item reflect.Value) {
+		for item.Kind() == reflect.Pointer {
+			if item.IsNil() {
+				return
+			}
+			item = item.Elem()
+		}
+
+		f, err := item.FieldByIndexErr(idx)
+		if err != nil {
+			return
+		}
+
+		if tm, ok := timeValue(f); ok && tm.After(t) {
+			t = tm
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := range v.Len() {
+			check(v.Index(i))
+		}
+	case reflect.Struct:
+		check(v)
+	}
+
+	return
+}
+
+// time.Time, *time.Time или nullable структура с полем Time
+func timeValue(v reflect.Value) (t time.Time, ok bool) {
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+
+	if !v.CanInterface() {
+		return
+	}
+
+	switch x := v.Interface().(type) {
+	case time.Time:
+		return x, !x.IsZero()
+	}
+
+	if v.Kind() == reflect.Struct {
+		if valid := v.FieldByName("Valid"); valid.IsValid() && valid.Kind() == reflect.Bool && !valid.Bool() {
+			return
+		}
+
+		if f := v.FieldByName("Time"); f.IsValid() && f.Type() == reflect.TypeFor[time.Time]() {
+			return timeValue(f)
+		}
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// HTTP кэширование успешного ответа на GET: Cache-Control, Last-Modified и проверка If-Modified-Since
+func (proc *ProcOptions) httpCache(result any) (notModified bool) {
+	if proc.Chain == nil {
+		return
+	}
+
+	if proc.ExtraHeaders == nil {
+		proc.ExtraHeaders = make(misc.StringMap, 4)
+	}
+
+	if _, exists := proc.ExtraHeaders[HTTPheaderCacheControl]; !exists {
+		if cc := cacheControlValue(&proc.ChainLocal); cc != "" {
+			proc.ExtraHeaders[HTTPheaderCacheControl] = cc
+		}
+	}
+
+	modified := lastModified(result)
+	if modified.IsZero() {
+		return
+	}
+
+	modified = modified.UTC().Truncate(time.Second)
+	proc.ExtraHeaders[HTTPheaderLastModified] = modified.Format(http.TimeFormat)
+
+	ims := proc.R.Header.Get(HTTPheaderIfModifiedSince)
+	if ims == "" || proc.R.Header.Get("If-None-Match") != "" {
+		return
+	}
+
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return
+	}
+
+	return !modified.After(since)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Заголовки HTTP кэширования, которые может вернуть цепочка (для OpenAPI)
+func HTTPCacheOutHeaders(method string, chain *path.Chain) (headers misc.StringMap) {
+	if method != stdhttp.MethodGET {
+		return
+	}
+
+	headers = make(misc.StringMap, 3)
+
+	if cc := cacheControlValue(chain); cc != "" {
+		headers[HTTPheaderCacheControl] = "Caching policy: " + cc
+	}
+
+	if chain.CacheLifetime > 0 {
+		headers[HTTPheaderAge] = "Seconds since the response was cached on the server"
+	}
+
+	if modifiedField(chain.Params.Response.Type) != nil {
+		headers[HTTPheaderLastModified] = "Time of the latest modification of the returned data. " +
+			"If-Modified-Since is supported, 304 is returned if nothing was modified"
+	}
+
+	if len(headers) == 0 {
+		headers = nil
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
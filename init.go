@@ -24,11 +24,16 @@ func Init(cfg any, hh *stdhttp.HTTP, basePath string, defaultDB string, extraCon
 	defDB = defaultDB
 	configsMutex.Lock()
 	configs = extraConfigs
+	err = loadGlobalCORS()
 	configsMutex.Unlock()
+	if err != nil {
+		return
+	}
 
 	path.SaveObject(ErrorResultName, reflect.TypeOf(stdhttp.ErrorResponse{}), false, false)
 	path.SaveObject(ExecResultName, reflect.TypeOf(ExecResult{}), false, false)
 	path.SaveObject(ExecResultRowName, reflect.TypeOf(ExecResultRow{}), false, false)
+	path.SaveObject(ByRowErrorRecordName, reflect.TypeOf(ByRowErrorRecord{}), false, false)
 
 	Log.Message(log.INFO, "Initialized")
 	return
@@ -45,9 +50,18 @@ func ModuleRegistration(handler API) (err error) {
 		return fmt.Errorf(`info is nil for [%#v]"`, handler)
 	}
 
+	_, err = registerModule(handler, info)
+	return
+}
+
+// Регистрация модуля. Вызывается под modulesMutex
+func registerModule(handler API, info *Info) (p *Module, err error) {
 	defer func() {
 		if err != nil {
 			err = fmt.Errorf("[%s] %w", info.Path, err)
+			if info.Version != "" {
+				err = fmt.Errorf("%s: %w", info.Version, err)
+			}
 		}
 	}()
 
@@ -60,26 +74,36 @@ func ModuleRegistration(handler API) (err error) {
 		info.Name = strings.ReplaceAll(info.Path, "/", ".")
 	}
 
-	url := info.Path
-	relURL := url
-	if url == "/" {
-		url = ""
-	}
+	url, relURL := moduleURL(info.Path, info.Version)
 
-	if len(url) == 0 || url[0] != '/' {
-		url = fmt.Sprintf("%s/%s", base, info.Path)
-	}
-	url = misc.NormalizeSlashes(url)
+	var parent *Module
+
+	if info.Parent != nil {
+		parent = findParentModule(info.Parent.Module, info.Version)
+		if parent == nil {
+			return nil, fmt.Errorf(`parent module "%s" not found`, info.Parent.Module)
+		}
+
+		err = info.Parent.prepare(info, parent)
+		if err != nil {
+			return
+		}
+
+		if _, exists := parent.children[info.Parent.Name]; exists {
+			return nil, fmt.Errorf(`nested module "%s" already registered in %s`, info.Parent.Name, parent.RawURL)
+		}
+
+		url = fmt.Sprintf("%s/{%s}/%s", parent.RawURL, info.Parent.KeyVar, info.Parent.Name)
 
-	if _, exists := modules[url]; exists {
-		return fmt.Errorf(`%s already registered"`, url)
+	} else if _, exists := modules[url]; exists {
+		return nil, fmt.Errorf(`%s already registered"`, url)
 	}
 
 	if len(info.Tags) == 0 {
 		ss := strings.Split(url, "/")
 		b := strings.Trim(base, "/")
 		for _, s := range ss {
-			if s != "" && s != b {
+			if s != "" && s != b && s != info.Version {
 				info.Tags = []string{s}
 				break
 			}
@@ -99,16 +123,38 @@ func ModuleRegistration(handler API) (err error) {
 		return
 	}
 
+	err = info.findCORSConfig()
+	if err != nil {
+		return
+	}
+
 	err = info.Methods.Prepare()
 	if err != nil {
 		return
 	}
 
+	err = checkRoutes(url, info)
+	if err != nil {
+		return
+	}
+
 	err = info.makeParamsDescription()
 	if err != nil {
 		return
 	}
 
+	err = info.findDeletedField()
+	if err != nil {
+		return
+	}
+
+	err = info.checkCacheKeys()
+	if err != nil {
+		return
+	}
+
+	info.checkDeprecation(url)
+
 	switch info.DBtype {
 	case "":
 		info.DBtype = defDB
@@ -116,11 +162,21 @@ func ModuleRegistration(handler API) (err error) {
 		info.DBtype = ""
 	}
 
+	if info.Parent != nil && info.DBtype == "" {
+		err = fmt.Errorf("nested module doesn't use a database, parent existence can't be checked")
+		return
+	}
+
 	if info.QueryPrefix != "" && !strings.HasSuffix(info.QueryPrefix, ".") {
 		info.QueryPrefix += "."
 	}
 
-	p := &Module{
+	err = info.checkDeletedFilter()
+	if err != nil {
+		return
+	}
+
+	p = &Module{
 		RawURL:      url,
 		RelativeURL: relURL,
 		Handler:     handler,
@@ -128,7 +184,17 @@ func ModuleRegistration(handler API) (err error) {
 		LogFacility: log.NewFacility(url),
 	}
 
-	modules[url] = p
+	if parent != nil {
+		if parent.children == nil {
+			parent.children = make(map[string]*Module, 4)
+		}
+		parent.children[info.Parent.Name] = p
+		p.parent = parent
+	} else {
+		modules[url] = p
+	}
+
+	rebuildRoutes()
 
 	httpHdl.AddEndpointsInfo(
 		misc.StringMap{
@@ -150,15 +216,63 @@ func ModuleRegistration(handler API) (err error) {
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
+// Удаление модуля, в том числе всех его версий
 func RemoveModuleRegistration(handler API) (err error) {
 	modulesMutex.Lock()
 	defer modulesMutex.Unlock()
 
+	removed := false
+
 	for name, df := range modules {
 		if df.Handler == handler {
 			delete(modules, name)
 			httpHdl.DelEndpointsInfo(misc.StringMap{df.RawURL: ""})
-			break
+			removed = true
+			continue
+		}
+
+		for childName, child := range df.children {
+			if child.Handler == handler {
+				delete(df.children, childName)
+				httpHdl.DelEndpointsInfo(misc.StringMap{child.RawURL: ""})
+				removed = true
+			}
+		}
+	}
+
+	if removed {
+		rebuildRoutes()
+	}
+
+	return
+}
+
+// URL модуля: полный и относительный
+func moduleURL(infoPath string, version string) (url string, relURL string) {
+	url = infoPath
+	relURL = url
+	if url == "/" {
+		url = ""
+	}
+
+	switch {
+	case len(url) == 0 || url[0] != '/':
+		url = fmt.Sprintf("%s/%s/%s", base, version, infoPath)
+	case version != "":
+		url = fmt.Sprintf("/%s%s", version, url)
+	}
+
+	url = misc.NormalizeSlashes(url)
+	return
+}
+
+// Поиск модуля верхнего уровня по Info.Path и версии. Вызывается под modulesMutex
+func findParentModule(p string, version string) (module *Module) {
+	p = misc.NormalizeSlashes(strings.TrimSpace(p))
+
+	for _, df := range modules {
+		if df.versions == nil && df.Info.Path == p && df.Info.Version == version {
+			return df
 		}
 	}
 
@@ -234,6 +348,11 @@ func Start() (err error) {
 		return
 	}
 
+	err = checkGlobalCORS()
+	if err != nil {
+		return
+	}
+
 	return
 }
 
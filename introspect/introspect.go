@@ -0,0 +1,294 @@
+/*
+Модуль интроспекции: список всех модулей, их цепочек, scope и запросов к базе.
+Для отладки конфигурации шлюза. Требует аутентификации, подключается через Register
+*/
+package introspect
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/alrusov/config"
+	rest "github.com/alrusov/rest/v4"
+	path "github.com/alrusov/rest/v4/path"
+	"github.com/alrusov/stdhttp"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Настройки в конфиге
+	Config struct {
+		AdminOnly bool `toml:"admin-only"` // Только для пользователей с IsAdmin
+	}
+
+	module struct {
+		info *rest.Info
+	}
+
+	queryParams struct {
+		Tag string `json:"tag" comment:"Tag name. Empty - all modules"`
+	}
+
+	// Описание модуля
+	Module struct {
+		URL         string     `json:"url" comment:"Module URL. For a nested module - including the parent key and the collection name"`
+		Name        string     `json:"name" comment:"Module name"`
+		Summary     string     `json:"summary,omitempty" comment:"Summary"`
+		Tags        []string   `json:"tags,omitempty" comment:"Tags"`
+		Version     string     `json:"version,omitempty" comment:"API version"`
+		Parent      string     `json:"parent,omitempty" comment:"Parent module path for a nested module"`
+		DBtype      string     `json:"dbType,omitempty" comment:"Database type"`
+		QueryPrefix string     `json:"queryPrefix,omitempty" comment:"Prefix of database query names"`
+		Flags       path.Flags `json:"flags,omitempty" comment:"Module flags"`
+		Deprecated  bool       `json:"deprecated,omitempty" comment:"Module is deprecated"`
+		Chains      []*Chain   `json:"chains" comment:"Chains"`
+	}
+
+	// Описание цепочки
+	Chain struct {
+		Method         string          `json:"method" comment:"HTTP method"`
+		Name           string          `json:"name,omitempty" comment:"Chain name"`
+		Path           string          `json:"path" comment:"Path template relative to the module URL"`
+		Tokens         []*path.Token   `json:"tokens" comment:"Path tokens relative to the module URL"`
+		Scope          string          `json:"scope,omitempty" comment:"Scope"`
+		Query          string          `json:"query,omitempty" comment:"Database query name (QueryPrefix + Scope)"`
+		Flags          path.Flags      `json:"flags,omitempty" comment:"Chain flags"`
+		ParamsFlags    path.Flags      `json:"paramsFlags,omitempty" comment:"Chain parameters flags"`
+		CacheLifetime  config.Duration `json:"cacheLifetime,omitempty" comment:"Server cache lifetime"`
+		RequestObject  string          `json:"requestObject,omitempty" comment:"Request object name"`
+		ResponseObject string          `json:"responseObject,omitempty" comment:"Response object name"`
+		Deprecated     bool            `json:"deprecated,omitempty" comment:"Chain is deprecated"`
+	}
+)
+
+const (
+	// Путь по умолчанию
+	DefaultPath = "/introspect"
+)
+
+var (
+	// Перебор модулей, подменяется в тестах
+	enumerate = rest.EnumerateModules
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (x *Config) Check(cfg any) (err error) {
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Регистрация модуля. Если p пустой, то DefaultPath
+func Register(p string) (err error) {
+	if p == "" {
+		p = DefaultPath
+	}
+
+	m := &module{
+		info: &rest.Info{
+			Path:    p,
+			Summary: "Registered modules, chains and scopes",
+			Tags:    []string{"introspect"},
+			Methods: &path.Set{
+				Methods: path.Methods{
+					stdhttp.MethodGET: &path.Chains{
+						Summary: "All modules with their chains",
+						StdParams: path.Params{
+							QueryParamsPattern: queryParams{},
+						},
+						Chains: path.ChainsList{
+							{
+								Name: "all",
+								Tokens: []*path.Token{
+									{Expr: "", VarName: path.VarIgnore},
+								},
+							},
+						},
+					},
+				},
+			},
+			Config: &Config{},
+			DBtype: rest.DBtypeNone,
+		},
+	}
+
+	return rest.ModuleRegistration(m)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (m *module) Info() *rest.Info {
+	return m.info
+}
+
+// Все делается здесь, до обращения к базе
+func (m *module) Prepare(proc *rest.ProcOptions) (result any, code int, err error) {
+	if proc.AuthIdentity == nil {
+		code, err = rest.Unauthorized("")
+		return
+	}
+
+	cfg, _ := m.info.Config.(*Config)
+	if cfg != nil && cfg.AdminOnly && !proc.AuthIdentity.IsAdmin {
+		code, err = rest.Forbidden("")
+		return
+	}
+
+	qp, _ := proc.QueryParams.(*queryParams)
+	if qp == nil {
+		qp = &queryParams{}
+	}
+
+	list, err := Modules(qp.Tag)
+	if err != nil {
+		return
+	}
+
+	result = list
+	return
+}
+
+func (m *module) Before(proc *rest.ProcOptions) (result any, code int, err error) {
+	return
+}
+
+func (m *module) After(proc *rest.ProcOptions) (result any, code int, err error) {
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Описания модулей, упорядоченные по URL. Если tag не пустой, то только модули с этим тегом
+func Modules(tag string) (list []*Module, err error) {
+	list = []*Module{}
+
+	err = enumerate(
+		func(module *rest.Module) (err error) {
+			if tag != "" && !hasTag(module.Info.Tags, tag) {
+				return
+			}
+
+			list = append(list, describe(module))
+			return
+		},
+	)
+	if err != nil {
+		return
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].URL != list[j].URL {
+			return list[i].URL < list[j].URL
+		}
+		return list[i].Parent < list[j].Parent
+	})
+
+	return
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Описание модуля
+func describe(module *rest.Module) (m *Module) {
+	info := module.Info
+
+	m = &Module{
+		URL:         module.RawURL,
+		Name:        info.Name,
+		Summary:     info.Summary,
+		Tags:        info.Tags,
+		Version:     info.Version,
+		DBtype:      info.DBtype,
+		QueryPrefix: info.QueryPrefix,
+		Flags:       info.Flags,
+		Deprecated:  rest.ResolveDeprecation(info, nil).Deprecated,
+		Chains:      []*Chain{},
+	}
+
+	// Цепочки вложенного модуля начинаются с ключа родителя и имени коллекции, они уже есть в URL
+	skip := 0
+	if info.Parent != nil {
+		m.Parent = info.Parent.Module
+		skip = 2
+	}
+
+	if info.Methods == nil {
+		return
+	}
+
+	methods := make([]string, 0, len(info.Methods.Methods))
+	for method := range info.Methods.Methods {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	for _, method := range methods {
+		chains := info.Methods.Methods[method]
+		if chains == nil {
+			continue
+		}
+
+		for _, chain := range chains.Chains {
+			tokens := chain.Tokens[min(skip, len(chain.Tokens)):]
+
+			c := &Chain{
+				Method:         method,
+				Name:           chain.Name,
+				Path:           chainPath(chain.Flags, tokens),
+				Tokens:         tokens,
+				Scope:          chain.Scope,
+				Flags:          chain.Flags,
+				ParamsFlags:    chain.Params.Flags,
+				CacheLifetime:  chain.CacheLifetime,
+				RequestObject:  chain.Params.Request.Name,
+				ResponseObject: chain.Params.Response.Name,
+				Deprecated:     rest.ResolveDeprecation(info, chain).Deprecated,
+			}
+
+			if chain.Scope != "" && info.DBtype != "" {
+				c.Query = info.QueryPrefix + chain.Scope
+			}
+
+			m.Chains = append(m.Chains, c)
+		}
+	}
+
+	return
+}
+
+// Шаблон пути цепочки
+func chainPath(flags path.Flags, tokens []*path.Token) string {
+	elems := make([]string, 0, len(tokens)+1)
+
+	for _, token := range tokens {
+		switch {
+		case token.Expr == "" && token.VarName == path.VarIgnore:
+			// Корень модуля
+			continue
+		case token.IsTail():
+			elems = append(elems, "*"+token.VarName+":"+token.Expr)
+		case token.VarName == path.VarIgnore:
+			elems = append(elems, token.Display())
+		default:
+			elems = append(elems, "{"+token.VarName+":"+token.Expr+"}")
+		}
+	}
+
+	if flags&path.FlagChainEnableTail != 0 && (len(tokens) == 0 || !tokens[len(tokens)-1].IsTail()) {
+		elems = append(elems, "*")
+	}
+
+	return "/" + strings.Join(elems, "/")
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,221 @@
+package introspect
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/alrusov/auth"
+	rest "github.com/alrusov/rest/v4"
+	path "github.com/alrusov/rest/v4/path"
+	"github.com/alrusov/stdhttp"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func testModules() (cleanup func()) {
+	users := &rest.Module{
+		RawURL: "/api/users",
+		Info: &rest.Info{
+			Path:        "/users",
+			Tags:        []string{"users"},
+			DBtype:      "main",
+			QueryPrefix: "users.",
+			Methods: &path.Set{
+				Methods: path.Methods{
+					stdhttp.MethodGET: {
+						Chains: path.ChainsList{
+							{Name: "all", Scope: "select.all", Tokens: []*path.Token{{Expr: "", VarName: path.VarIgnore}}},
+							{Name: "byID", Scope: "select.id", Tokens: []*path.Token{{Expr: `\d+`, VarName: "ID"}}},
+							// Статический элемент шаблона "v1.0" хранится экранированным
+							{Name: "v1", Scope: "select.v1", Tokens: []*path.Token{{Expr: `v1\.0`, VarName: path.VarIgnore}, {Expr: `\d+`, VarName: "ID"}}},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// Цепочки вложенного модуля - после регистрации, с ключом родителя и именем коллекции
+	orders := &rest.Module{
+		RawURL: "/api/users/{ParentID}/orders",
+		Info: &rest.Info{
+			Path:        "/orders",
+			Tags:        []string{"orders"},
+			DBtype:      "main",
+			QueryPrefix: "orders.",
+			Parent:      &rest.Parent{Module: "/users", Name: "orders", KeyVar: "ParentID"},
+			Methods: &path.Set{
+				Methods: path.Methods{
+					stdhttp.MethodGET: {
+						Chains: path.ChainsList{
+							{Name: "all", Scope: "select.all", Tokens: []*path.Token{
+								{Expr: `\d+`, VarName: "ParentID"},
+								{Expr: "orders", VarName: path.VarIgnore},
+							}},
+							{Name: "byID", Scope: "select.id", Tokens: []*path.Token{
+								{Expr: `\d+`, VarName: "ParentID"},
+								{Expr: "orders", VarName: path.VarIgnore},
+								{Expr: `\d+`, VarName: "ID"},
+							}},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// Без базы
+	ping := &rest.Module{
+		RawURL: "/api/ping",
+		Info: &rest.Info{
+			Path: "/ping",
+			Tags: []string{"service"},
+			Methods: &path.Set{
+				Methods: path.Methods{
+					stdhttp.MethodGET: {
+						Chains: path.ChainsList{
+							{Name: "ping", Scope: "ping", Flags: path.FlagChainEnableTail, Tokens: []*path.Token{{Expr: "", VarName: path.VarIgnore}}},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	saved := enumerate
+	enumerate = func(e rest.ModuleEnumerator) (err error) {
+		for _, m := range []*rest.Module{ping, orders, users} {
+			err = e(m)
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	return func() {
+		enumerate = saved
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestModules(t *testing.T) {
+	defer testModules()()
+
+	list, err := Modules("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 3 || list[0].URL != "/api/ping" || list[1].URL != "/api/users" || list[2].URL != "/api/users/{ParentID}/orders" {
+		for _, m := range list {
+			t.Logf("%s", m.URL)
+		}
+		t.Fatalf("got %d modules", len(list))
+	}
+
+	type chain struct {
+		path  string
+		query string
+	}
+
+	for i, expected := range [][]chain{
+		{{"/*", ""}},
+		{{"/", "users.select.all"}, {`/{ID:\d+}`, "users.select.id"}, {`/v1.0/{ID:\d+}`, "users.select.v1"}},
+		{{"/", "orders.select.all"}, {`/{ID:\d+}`, "orders.select.id"}},
+	} {
+		m := list[i]
+		if len(m.Chains) != len(expected) {
+			t.Errorf("%s: got %d chains, expected %d", m.URL, len(m.Chains), len(expected))
+			continue
+		}
+
+		for j, c := range expected {
+			got := m.Chains[j]
+			if got.Method != stdhttp.MethodGET || got.Path != c.path || got.Query != c.query {
+				t.Errorf(`%s [%d]: got %s "%s" "%s", expected "%s" "%s"`, m.URL, j, got.Method, got.Path, got.Query, c.path, c.query)
+			}
+		}
+	}
+
+	if list[2].Parent != "/users" || list[1].Parent != "" {
+		t.Errorf(`got parents "%s", "%s"`, list[1].Parent, list[2].Parent)
+	}
+
+	for _, c := range []struct {
+		tag string
+		url string
+	}{
+		{"orders", "/api/users/{ParentID}/orders"},
+		{"USERS", "/api/users"},
+		{"unknown", ""},
+	} {
+		list, err := Modules(c.tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.url == "" {
+			if len(list) != 0 {
+				t.Errorf(`tag "%s": got %d modules, expected 0`, c.tag, len(list))
+			}
+			continue
+		}
+
+		if len(list) != 1 || list[0].URL != c.url {
+			t.Errorf(`tag "%s": got %d modules, expected %s`, c.tag, len(list), c.url)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestPrepare(t *testing.T) {
+	defer testModules()()
+
+	m := &module{info: &rest.Info{Config: &Config{AdminOnly: true}}}
+
+	for _, c := range []struct {
+		identity *auth.Identity
+		tag      string
+		code     int
+		n        int
+	}{
+		{nil, "", http.StatusUnauthorized, 0},
+		{&auth.Identity{User: "user"}, "", http.StatusForbidden, 0},
+		{&auth.Identity{User: "admin", IsAdmin: true}, "", 0, 3},
+		{&auth.Identity{User: "admin", IsAdmin: true}, "service", 0, 1},
+	} {
+		proc := &rest.ProcOptions{
+			AuthIdentity: c.identity,
+			QueryParams:  &queryParams{Tag: c.tag},
+		}
+
+		result, code, err := m.Prepare(proc)
+		if code != c.code {
+			t.Errorf("%#v: got code %d, expected %d (%v)", c.identity, code, c.code, err)
+			continue
+		}
+
+		if c.code != 0 {
+			if err == nil {
+				t.Errorf("%#v: error expected", c.identity)
+			}
+			continue
+		}
+
+		list, _ := result.([]*Module)
+		if err != nil || len(list) != c.n {
+			t.Errorf(`%#v, tag "%s": got %d modules, expected %d (%v)`, c.identity, c.tag, len(list), c.n, err)
+		}
+	}
+
+	// Без AdminOnly достаточно аутентификации
+	m.info.Config = &Config{}
+	if _, code, err := m.Prepare(&rest.ProcOptions{AuthIdentity: &auth.Identity{User: "user"}}); code != 0 || err != nil {
+		t.Errorf("got %d, %v", code, err)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
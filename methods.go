@@ -0,0 +1,106 @@
+package rest
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/alrusov/stdhttp"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Методы, которые не требуют своих цепочек:
+//   - OPTIONS - ответ 204 с заголовком Allow по методам, цепочки которых подходят для пути;
+//   - HEAD - обрабатывается цепочкой GET, тело ответа не отправляется.
+//
+// Если для OPTIONS или HEAD описаны свои цепочки, то используются они.
+// Ответ 405 всегда содержит заголовок Allow.
+
+type (
+	// Отбрасывает тело ответа на HEAD
+	headWriter struct {
+		http.ResponseWriter
+	}
+)
+
+const (
+	HTTPheaderAllow = "Allow"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Запрос HEAD без своих цепочек превращается в GET с ответом без тела
+func (proc *ProcOptions) headAsGet() {
+	set := proc.Info.Methods
+	if proc.R.Method != stdhttp.MethodHEAD || set == nil {
+		return
+	}
+
+	if _, exists := set.Methods[stdhttp.MethodHEAD]; exists {
+		return
+	}
+
+	if _, exists := set.Methods[stdhttp.MethodGET]; !exists {
+		return
+	}
+
+	r := proc.R.Clone(proc.R.Context())
+	r.Method = stdhttp.MethodGET
+	proc.R = r
+	proc.W = &headWriter{ResponseWriter: proc.W}
+}
+
+// Ответ на OPTIONS без своих цепочек. processed == false, если обрабатывать надо обычным образом
+func (proc *ProcOptions) options() (processed bool) {
+	set := proc.Info.Methods
+	if proc.R.Method != stdhttp.MethodOPTIONS || set == nil {
+		return
+	}
+
+	if _, exists := set.Methods[stdhttp.MethodOPTIONS]; exists {
+		return
+	}
+
+	allow := set.Allow(proc.Tail)
+	if len(allow) == 0 {
+		proc.reply(nil, http.StatusNotFound, nil)
+		return true
+	}
+
+	proc.W.Header().Set(HTTPheaderAllow, strings.Join(allow, ", "))
+	proc.reply(nil, http.StatusNoContent, nil)
+	return true
+}
+
+// Значение заголовка Allow для ответа 405
+func (proc *ProcOptions) allowHeader() string {
+	set := proc.Info.Methods
+	if set == nil {
+		return ""
+	}
+
+	allow := set.Allow(proc.Tail)
+	if len(allow) == 0 {
+		allow = set.Allow(nil)
+	}
+
+	return strings.Join(allow, ", ")
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w *headWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *headWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,93 @@
+package rest
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	// Элемент заголовков вида Accept, Accept-Encoding: значение, параметры и вес
+	qItem struct {
+		Value  string
+		Params map[string]string
+		Q      float64
+	}
+
+	qList []*qItem
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Разбор заголовка со списком значений с весами (q), результат отсортирован по убыванию веса с сохранением исходного порядка.
+// Значения с q=0 остаются в списке, так как они явно запрещают использование
+func parseQList(h http.Header, name string) (list qList) {
+	for _, s := range h.Values(name) {
+		for v := range strings.SplitSeq(s, ",") {
+			parts := strings.Split(v, ";")
+
+			value := strings.ToLower(strings.TrimSpace(parts[0]))
+			if value == "" {
+				continue
+			}
+
+			item := &qItem{
+				Value: value,
+				Q:     1,
+			}
+
+			for _, p := range parts[1:] {
+				n, v, _ := strings.Cut(p, "=")
+				n = strings.ToLower(strings.TrimSpace(n))
+				v = strings.Trim(strings.TrimSpace(v), `"`)
+
+				if n == "q" {
+					q, err := strconv.ParseFloat(v, 64)
+					if err == nil && q >= 0 && q <= 1 {
+						item.Q = q
+					}
+					continue
+				}
+
+				if item.Params == nil {
+					item.Params = make(map[string]string, 2)
+				}
+				item.Params[n] = v
+			}
+
+			list = append(list, item)
+		}
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Q > list[j].Q
+	})
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Вес значения: явно указанное значение, иначе wildcard. found == false, если не подходит ничего
+func (list qList) weight(value string, wildcards ...string) (q float64, found bool) {
+	for _, item := range list {
+		if item.Value == value {
+			return item.Q, true
+		}
+	}
+
+	for _, w := range wildcards {
+		for _, item := range list {
+			if item.Value == w {
+				return item.Q, true
+			}
+		}
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,210 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	path "github.com/alrusov/rest/v4/path"
+	"github.com/alrusov/stdhttp"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Вложенные модули (коллекции родителя), например /customers/{ParentID}/orders/{ID}.
+//
+// Вложенный модуль описывается как обычный, но с Info.Parent. Его цепочки пишутся относительно коллекции,
+// а в начало каждой из них при регистрации добавляются токены ключа родителя и имени коллекции.
+// Поле ключа (Parent.KeyVar) должно быть в PathParamsPattern цепочек.
+//
+// Перед обработкой проверяется существование родителя запросом Parent.ExistsQuery, который должен вернуть
+// одну колонку, например
+//
+//	SELECT 1 FROM customers WHERE id=$1
+//
+// Если родителя нет, то 404. Ключ родителя передается в ProcOptions.ParentKey и дальше:
+//   - при создании (POST и ScopeUpsert) - в поле Parent.Field каждой записи;
+//   - в остальных случаях - первой переменной в DBqueryVars ($1 в запросе).
+//
+// Вложенный модуль должен работать с базой (DBtype), иначе он не регистрируется.
+// Вложенным может быть только модуль, родитель которого - модуль верхнего уровня.
+
+type (
+	// Описание родителя вложенного модуля
+	Parent struct {
+		Module      string // Path родительского модуля (как в его Info.Path). Он должен быть зарегистрирован раньше
+		Name        string // Имя коллекции в URL. По умолчанию последний элемент Info.Path
+		KeyVar      string // Имя поля ключа родителя в PathParamsPattern. По умолчанию ParentID
+		ByGUID      bool   // Ключ родителя - GUID, иначе ID
+		Field       string // db name поля, заполняемого ключом родителя при создании записей. Если пусто, то не заполняется
+		ExistsQuery string // Имя запроса проверки существования родителя. По умолчанию QueryPrefix родителя + exists.id (exists.guid)
+	}
+)
+
+const (
+	// Имя поля ключа родителя по умолчанию
+	DefaultParentKeyVar = "ParentID"
+
+	ScopeExistsID   = "exists.id"
+	ScopeExistsGUID = "exists.guid"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Проверка и заполнение значений по умолчанию при регистрации вложенного модуля
+func (link *Parent) prepare(info *Info, parent *Module) (err error) {
+	if info.Methods == nil {
+		return fmt.Errorf("nested module without methods")
+	}
+
+	if link.Name == "" {
+		link.Name = info.Path[strings.LastIndexByte(info.Path, '/')+1:]
+	}
+
+	if link.Name == "" || strings.Contains(link.Name, "/") {
+		return fmt.Errorf(`illegal nested collection name "%s"`, link.Name)
+	}
+
+	if link.KeyVar == "" {
+		link.KeyVar = DefaultParentKeyVar
+	}
+
+	if link.ExistsQuery == "" {
+		link.ExistsQuery = parent.Info.QueryPrefix + ScopeExistsID
+		if link.ByGUID {
+			link.ExistsQuery = parent.Info.QueryPrefix + ScopeExistsGUID
+		}
+	}
+
+	link.addPrefix(info.Methods)
+	return
+}
+
+// Добавление в начало цепочек токенов ключа родителя и имени коллекции
+func (link *Parent) addPrefix(set *path.Set) {
+	keyExpr := REid
+	if link.ByGUID {
+		keyExpr = REguid
+	}
+
+	for _, chains := range set.Methods {
+		if chains == nil {
+			continue
+		}
+
+		for _, chain := range chains.Chains {
+			if chain == nil {
+				continue
+			}
+
+			prefix := []*path.Token{
+				{Expr: keyExpr, VarName: link.KeyVar, Description: "Parent key"},
+				{Expr: link.Name, VarName: path.VarIgnore},
+			}
+
+			if len(chain.Tokens) == 1 && chain.Tokens[0].Expr == "" {
+				// Вся коллекция
+				chain.Tokens = prefix
+				continue
+			}
+
+			chain.Tokens = append(prefix, chain.Tokens...)
+		}
+	}
+}
+
+// Ключ родителя из первого элемента пути
+func (link *Parent) parseKey(s string) (key any, err error) {
+	if link.ByGUID {
+		return s, nil
+	}
+
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return
+	}
+
+	key = id
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Вложенный модуль для остатка пути родителя: [ключ, имя коллекции, ...]
+func (m *Module) findChild(tail []string) (child *Module) {
+	if len(tail) < 2 {
+		return
+	}
+
+	tree := routes.Load()
+	if tree == nil {
+		return
+	}
+
+	return tree.children[m][tail[1]]
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Проверка существования родителя
+func (proc *ProcOptions) checkParent() (code int, err error) {
+	link := proc.Info.Parent
+	if link == nil {
+		return
+	}
+
+	if proc.Info.DBtype == "" && proc.DBtype == "" {
+		code = http.StatusInternalServerError
+		err = fmt.Errorf("parent check: module doesn't use a database")
+		return
+	}
+
+	err = proc.setDB()
+	if err != nil {
+		code = http.StatusInternalServerError
+		return
+	}
+
+	var found []int64
+	err = proc.db.QueryTx(proc.dbTx, &found, link.ExistsQuery, nil, []any{proc.ParentKey})
+	if err != nil {
+		code = http.StatusInternalServerError
+		return
+	}
+
+	if len(found) == 0 {
+		code, err = NotFound(`parent "%v" not found`, proc.ParentKey)
+		return
+	}
+
+	return
+}
+
+// Передача ключа родителя в запрос
+func (proc *ProcOptions) injectParentKey() {
+	if proc.Info.Parent == nil || proc.isCreate() {
+		return
+	}
+
+	proc.DBqueryVars = append([]any{proc.ParentKey}, proc.DBqueryVars...)
+}
+
+// Заполнение ключа родителя в создаваемых записях
+func (proc *ProcOptions) fillParentKey() {
+	link := proc.Info.Parent
+	if link == nil || link.Field == "" {
+		return
+	}
+
+	for _, fields := range proc.Fields {
+		fields[link.Field] = proc.ParentKey
+	}
+}
+
+// Запрос на создание записей?
+func (proc *ProcOptions) isCreate() bool {
+	return proc.R.Method == stdhttp.MethodPOST || proc.Scope == ScopeUpsert
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
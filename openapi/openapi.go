@@ -2,7 +2,9 @@ package openapi
 
 import (
 	"context"
+	"encoding"
 	"fmt"
+	"maps"
 	"net/http"
 	"os"
 	"reflect"
@@ -133,7 +135,38 @@ func AddSecurityScheme(name string, sr *oa.SecuritySchemeRef) {
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
+// Документ для всех модулей всех версий
 func Compose(logFacility *log.Facility, cfg *Config, httpCfg *config.Listener, prefix string) (result *oa.T, err error) {
+	return compose(logFacility, cfg, httpCfg, prefix, nil)
+}
+
+// Документ для версии API: модули этой версии и модули без версий
+func ComposeVersion(logFacility *log.Facility, cfg *Config, httpCfg *config.Listener, prefix string, version string) (result *oa.T, err error) {
+	result, err = compose(logFacility, cfg, httpCfg, prefix, &version)
+	if err != nil {
+		return
+	}
+
+	result.Info.Version = version
+	return
+}
+
+// Документы для всех версий API, ключ - версия
+func ComposeVersions(logFacility *log.Facility, cfg *Config, httpCfg *config.Listener, prefix string) (result map[string]*oa.T, err error) {
+	versions := rest.Versions()
+	result = make(map[string]*oa.T, len(versions))
+
+	for _, v := range versions {
+		result[v], err = ComposeVersion(logFacility, cfg, httpCfg, prefix, v)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func compose(logFacility *log.Facility, cfg *Config, httpCfg *config.Listener, prefix string, version *string) (result *oa.T, err error) {
 	if prefix != "" {
 		prefix = "/" + strings.Trim(prefix, "/")
 	}
@@ -165,6 +198,10 @@ func Compose(logFacility *log.Facility, cfg *Config, httpCfg *config.Listener, p
 
 	err = rest.Enumerate(
 		func(urlPath string, info *rest.Info) (err error) {
+			if version != nil && info.Version != "" && info.Version != *version {
+				return
+			}
+
 			pi := &oa.PathItem{
 				Summary:     info.Summary,
 				Description: info.Description,
@@ -507,7 +544,25 @@ func (proc *processor) scanChains(chains *path.Set, urlPath string, info *rest.I
 				responseHeaders = make(map[string]*oa.HeaderRef, 16)
 			}
 
-			for name, descr := range chain.Params.OutHeaders {
+			outHeaders := chain.Params.OutHeaders
+			addOutHeaders := func(headers misc.StringMap) {
+				if len(headers) == 0 {
+					return
+				}
+				outHeaders = maps.Clone(outHeaders)
+				if outHeaders == nil {
+					outHeaders = make(misc.StringMap, len(headers))
+				}
+				maps.Copy(outHeaders, headers)
+			}
+
+			if chain.Params.Flags&path.FlagResponseByRow != 0 {
+				addOutHeaders(rest.ByRowOutHeaders)
+			}
+			addOutHeaders(rest.HTTPCacheOutHeaders(method, chain))
+			addOutHeaders(rest.DeprecationOutHeaders(info, chain))
+
+			for name, descr := range outHeaders {
 				err = proc.addComponentHeader(name, descr)
 				if err != nil {
 					return
@@ -609,6 +664,11 @@ func (proc *processor) scanChains(chains *path.Set, urlPath string, info *rest.I
 				Summary:     strings.TrimSpace(strings.Join([]string{info.Summary, chains.Summary, chain.Summary}, " ")),
 				Description: strings.TrimSpace(strings.Join([]string{info.Description, chains.Description, chain.Description}, " ")),
 				OperationID: oid,
+				Deprecated:  rest.ResolveDeprecation(info, chain).Deprecated,
+			}
+
+			if chain.Params.Flags&path.FlagResponseByRow != 0 {
+				op.Description = strings.TrimSpace(op.Description + " " + rest.ByRowFailureDescription)
 			}
 
 			if requestSchema != nil {
@@ -770,9 +830,12 @@ func (proc *processor) makePathParameters(urlPath string, chain *path.Chain) (fu
 		if len(token.Expr) != 0 {
 			descrElems = append(descrElems, "("+token.Expr+")")
 		}
+		if token.IsTail() {
+			descrElems = append(descrElems, "...")
+		}
 
 		if token.VarName == path.VarIgnore {
-			pathElems = append(pathElems, token.Expr)
+			pathElems = append(pathElems, token.Display())
 			continue
 		}
 
@@ -784,7 +847,12 @@ func (proc *processor) makePathParameters(urlPath string, chain *path.Chain) (fu
 			return
 		}
 
-		_, tp, format, e := proc.entityType(field.Type)
+		tp, format, e := proc.pathParamType(field.Type)
+		if token.IsTail() {
+			// Остаток пути передается строкой с элементами через /
+			tp, format, e = "string", "", nil
+			enumItems = nil
+		}
 		if e != nil {
 			err = fmt.Errorf("%s: %s", token.VarName, e)
 			return
@@ -808,6 +876,13 @@ func (proc *processor) makePathParameters(urlPath string, chain *path.Chain) (fu
 			return
 		}
 
+		if token.IsTail() {
+			if tokenDescr != "" {
+				tokenDescr += ". "
+			}
+			tokenDescr += "Multi-segment parameter: the rest of the path, segments are separated by /"
+		}
+
 		pathElems = append(pathElems, "{"+token.VarName+"}")
 
 		oaTp := field.Tag.Get(path.TagOAtype)
@@ -837,6 +912,10 @@ func (proc *processor) makePathParameters(urlPath string, chain *path.Chain) (fu
 		//p.Schema.Value.Example = sample
 		//}
 
+		if token.IsTail() {
+			p.Extensions = map[string]any{"x-multi-segment": true}
+		}
+
 		pathParams = append(pathParams, p)
 	}
 
@@ -989,11 +1068,9 @@ func (proc *processor) makeObjectSchema(topName string, t reflect.Type, withoutR
 				}
 			}
 
-			if withoutReadOnly {
-				readonly := field.Tag.Get(path.TagReadonly)
-				if readonly == "true" {
-					return nil
-				}
+			readOnly := path.IsReadonly(field)
+			if withoutReadOnly && readOnly {
+				return nil
 			}
 
 			descr := field.Tag.Get(path.TagComment)
@@ -1038,6 +1115,7 @@ func (proc *processor) makeObjectSchema(topName string, t reflect.Type, withoutR
 						Format:      format,
 						Properties:  make(oa.Schemas),
 						Enum:        enumItems,
+						ReadOnly:    readOnly,
 					},
 				}
 				//if sample != "" {
@@ -1079,6 +1157,8 @@ type (
 )
 
 var (
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
 	specialTypes = map[string]tpData{
 		reflect.TypeOf(time.Time{}).String():      {"string", "date-time"},
 		reflect.TypeOf(db.NullFloat64{}).String(): {"number", "double"},
@@ -1150,11 +1230,8 @@ func (proc *processor) scanObject(parentList *misc.BoolMap, parent *oa.SchemaRef
 			continue
 		}
 
-		if withoutReadOnly {
-			readonly := field.Tag.Get(path.TagReadonly)
-			if readonly == "true" {
-				continue
-			}
+		if withoutReadOnly && path.IsReadonly(&field) {
+			continue
 		}
 
 		fType := field.Type
@@ -1334,6 +1411,26 @@ func (proc *processor) entityType(t reflect.Type) (kind reflect.Kind, tp string,
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
+// Тип параметра пути с учетом типов, которые преобразуются из строки
+func (proc *processor) pathParamType(t reflect.Type) (tp string, format string, err error) {
+	if d, exists := specialTypes[t.String()]; exists {
+		return d.tp, d.format, nil
+	}
+
+	if path.IsUUID(t) {
+		return "string", "uuid", nil
+	}
+
+	if reflect.PointerTo(t).Implements(textUnmarshalerType) {
+		return "string", "", nil
+	}
+
+	_, tp, format, err = proc.entityType(t)
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
 func conv(tp string, v string) (any, error) {
 	if v == path.DefaultValueNull {
 		return nil, nil
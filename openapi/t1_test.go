@@ -2,6 +2,8 @@ package openapi
 
 import (
 	"testing"
+
+	path "github.com/alrusov/rest/v4/path"
 )
 
 //----------------------------------------------------------------------------------------------------------------------------//
@@ -11,3 +13,24 @@ func Test1(t *testing.T) {
 }
 
 //----------------------------------------------------------------------------------------------------------------------------//
+
+func TestStaticPathElements(t *testing.T) {
+	// Статический элемент шаблона "v1.0" хранится экранированным
+	chain := &path.Chain{
+		Tokens: []*path.Token{
+			{Expr: `v1\.0`, VarName: path.VarIgnore},
+			{Expr: `a|b`, VarName: path.VarIgnore},
+		},
+	}
+
+	fullPath, _, params, err := (&processor{}).makePathParameters("/api/x", chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fullPath != "/api/x/v1.0/a|b" || len(params) != 0 {
+		t.Errorf(`got "%s", %d params`, fullPath, len(params))
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
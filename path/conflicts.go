@@ -0,0 +1,302 @@
+package path
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Анализ цепочек на конфликты: недостижимые цепочки, цепочки, которые могут совпасть с одним и тем же путем,
+// несколько цепочек по умолчанию. Пересечение регулярных выражений определяется приблизительно - по примерам
+// строк, которые они допускают, поэтому это предупреждения, а не гарантия.
+// Пересечение не считается конфликтом, если более ранняя цепочка частная, а более поздняя ее полностью покрывает
+// (стандартные byID с \d+ и byName с [^/]+) - такие пути разрешаются порядком цепочек
+
+var (
+	// Выражения, которым соответствует любой элемент пути
+	catchAllExprs = map[string]bool{
+		`.*`:     true,
+		`.+`:     true,
+		`(?s).*`: true,
+		`(?s).+`: true,
+		`[^/]*`:  true,
+		`[^/]+`:  true,
+	}
+)
+
+const (
+	// Максимальное количество примеров строк для выражения
+	maxSamples = 16
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Конфликты во всех методах
+func (set *Set) Conflicts() (reports []string) {
+	methods := make([]string, 0, len(set.Methods))
+	for m := range set.Methods {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+
+	for _, m := range methods {
+		for _, r := range set.Methods[m].Conflicts() {
+			reports = append(reports, m+": "+r)
+		}
+	}
+
+	return
+}
+
+// Конфликты цепочек. Цепочки должны быть подготовлены (Prepare)
+func (chains *Chains) Conflicts() (reports []string) {
+	if !chains.prepared {
+		return
+	}
+
+	var defaults []string
+
+	for _, chain := range chains.Chains {
+		if chain.Flags&FlagChainDefault != 0 {
+			defaults = append(defaults, chainName(chain))
+		}
+	}
+
+	if len(defaults) > 1 {
+		reports = append(reports, fmt.Sprintf("multiple default chains: %s", strings.Join(defaults, ", ")))
+	}
+
+	for j, cj := range chains.Chains {
+		if cj.Flags&FlagChainDefault != 0 {
+			continue
+		}
+
+		for _, ci := range chains.Chains[:j] {
+			if ci.Flags&FlagChainDefault != 0 {
+				continue
+			}
+
+			if ci.covers(cj) {
+				reports = append(reports, fmt.Sprintf("chain %s is unreachable, it is shadowed by %s", chainName(cj), chainName(ci)))
+				break
+			}
+
+			if len(ci.Tokens) == len(cj.Tokens) && ci.intersects(cj) && !cj.covers(ci) {
+				reports = append(reports, fmt.Sprintf("chains %s and %s may match the same path, %s wins", chainName(ci), chainName(cj), chainName(ci)))
+			}
+		}
+	}
+
+	return
+}
+
+// Может ли какая-нибудь цепочка совпасть с путем, который начинается с prefix
+func (set *Set) MayMatchPrefix(prefix []string) bool {
+	for _, chains := range set.Methods {
+		for _, chain := range chains.Chains {
+			if len(chain.Tokens) < len(prefix) && chain.Flags&FlagChainEnableTail == 0 {
+				continue
+			}
+
+			matched := true
+			for i, token := range chain.Tokens {
+				if i == len(prefix) {
+					break
+				}
+				if token.re != nil && !token.re.MatchString(prefix[i]) {
+					matched = false
+					break
+				}
+			}
+
+			if matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func chainName(chain *Chain) string {
+	if chain.Name != "" {
+		return `"` + chain.Name + `"`
+	}
+
+	exprs := make([]string, len(chain.Tokens))
+	for i, token := range chain.Tokens {
+		exprs[i] = token.Expr
+	}
+
+	return "/" + strings.Join(exprs, "/")
+}
+
+// Все пути цепочки other совпадают с этой цепочкой (и она стоит раньше)
+func (chain *Chain) covers(other *Chain) bool {
+	ln := len(chain.Tokens)
+
+	switch {
+	case ln == len(other.Tokens):
+	case ln < len(other.Tokens) && chain.Flags&FlagChainEnableTail != 0:
+	default:
+		return false
+	}
+
+	for i, token := range chain.Tokens {
+		if !token.covers(other.Tokens[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Могут ли цепочки одинаковой длины совпасть с одним путем
+func (chain *Chain) intersects(other *Chain) bool {
+	for i, token := range chain.Tokens {
+		if !token.intersects(other.Tokens[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (token *Token) covers(other *Token) bool {
+	if token.Expr == other.Expr || catchAllExprs[token.Expr] {
+		return true
+	}
+
+	values, ok := staticValues(other.Expr)
+	if !ok || token.re == nil {
+		return false
+	}
+
+	for _, v := range values {
+		if !token.re.MatchString(v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (token *Token) intersects(other *Token) bool {
+	if token.Expr == other.Expr || catchAllExprs[token.Expr] || catchAllExprs[other.Expr] {
+		return true
+	}
+
+	if token.re == nil || other.re == nil {
+		return false
+	}
+
+	for _, s := range exprSamples(token.Expr) {
+		if other.re.MatchString(s) {
+			return true
+		}
+	}
+
+	for _, s := range exprSamples(other.Expr) {
+		if token.re.MatchString(s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Примеры строк, которые допускает выражение
+func exprSamples(expr string) (samples []string) {
+	if values, ok := staticValues(expr); ok {
+		return values
+	}
+
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return
+	}
+
+	return regexpSamples(re.Simplify())
+}
+
+func regexpSamples(re *syntax.Regexp) (samples []string) {
+	limit := func(list []string) []string {
+		if len(list) > maxSamples {
+			list = list[:maxSamples]
+		}
+		return list
+	}
+
+	switch re.Op {
+	default:
+		return []string{""}
+
+	case syntax.OpLiteral:
+		s := string(re.Rune)
+		if re.Flags&syntax.FoldCase != 0 {
+			return []string{s, strings.ToLower(s), strings.ToUpper(s)}
+		}
+		return []string{s}
+
+	case syntax.OpCharClass:
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			samples = append(samples, string(re.Rune[i]))
+			if re.Rune[i+1] != re.Rune[i] {
+				samples = append(samples, string(re.Rune[i+1]))
+			}
+		}
+		return limit(samples)
+
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return []string{"a", "0", "-"}
+
+	case syntax.OpCapture:
+		return regexpSamples(re.Sub[0])
+
+	case syntax.OpStar, syntax.OpQuest:
+		return limit(append([]string{""}, regexpSamples(re.Sub[0])...))
+
+	case syntax.OpPlus:
+		return regexpSamples(re.Sub[0])
+
+	case syntax.OpRepeat:
+		sub := regexpSamples(re.Sub[0])
+		for _, s := range sub {
+			samples = append(samples, strings.Repeat(s, max(re.Min, 1)))
+		}
+		if re.Min == 0 {
+			samples = append(samples, "")
+		}
+		return limit(samples)
+
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			samples = append(samples, regexpSamples(sub)...)
+		}
+		return limit(samples)
+
+	case syntax.OpConcat:
+		samples = []string{""}
+		for _, sub := range re.Sub {
+			next := make([]string, 0, maxSamples)
+			for _, prefix := range samples {
+				for _, s := range regexpSamples(sub) {
+					next = append(next, prefix+s)
+				}
+			}
+			samples = limit(next)
+		}
+		return samples
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,243 @@
+package path
+
+import (
+	"encoding"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Преобразование элементов пути в поля PathParamsPattern.
+//
+// Поддерживаются строки, целые, числа с плавающей точкой, bool, time.Time (через ParseTime),
+// UUID ([16]byte и производные типы) и любые типы, реализующие encoding.TextUnmarshaler.
+// Для строк с тегом enum значение проверяется по списку, а при подготовке проверяется,
+// что все варианты выражения токена входят в этот список.
+// Токен с FlagTokenTail заполняет строку (элементы через /) или []string.
+
+type (
+	converter     func(s string, v reflect.Value) error
+	tailConverter func(s []string, v reflect.Value) error
+)
+
+var (
+	timeType            = reflect.TypeOf(time.Time{})
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Преобразовать строку во время
+func ParseTime(s string) (t time.Time, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		err = fmt.Errorf(`time cannot be empty`)
+		return
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err == nil {
+		t = misc.UnixNano2UTC(n)
+		return
+	}
+
+	x, err := misc.ParseJSONtime(s)
+	if err != nil {
+		return
+	}
+
+	t = x.UTC()
+	return
+}
+
+// Преобразовать строку в UUID
+func ParseUUID(s string) (u [16]byte, err error) {
+	src := s
+	if len(src) == 36 {
+		if src[8] != '-' || src[13] != '-' || src[18] != '-' || src[23] != '-' {
+			err = fmt.Errorf(`illegal UUID "%s"`, s)
+			return
+		}
+		src = src[0:8] + src[9:13] + src[14:18] + src[19:23] + src[24:]
+	}
+
+	if len(src) != 32 {
+		err = fmt.Errorf(`illegal UUID "%s"`, s)
+		return
+	}
+
+	_, err = hex.Decode(u[:], []byte(src))
+	if err != nil {
+		err = fmt.Errorf(`illegal UUID "%s"`, s)
+		return
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Преобразователь для поля
+func makeConverter(field *reflect.StructField, expr string) (conv converter, err error) {
+	t := field.Type
+
+	switch {
+	case t == timeType:
+		conv = func(s string, v reflect.Value) error {
+			x, err := ParseTime(s)
+			if err != nil {
+				return err
+			}
+			v.Set(reflect.ValueOf(x))
+			return nil
+		}
+		return
+
+	case reflect.PointerTo(t).Implements(textUnmarshalerType):
+		conv = func(s string, v reflect.Value) error {
+			return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+		}
+		return
+	}
+
+	switch t.Kind() {
+	default:
+		err = fmt.Errorf(`field "%s" has unsupported type %s`, field.Name, t)
+
+	case reflect.String:
+		enum, exists := field.Tag.Lookup(TagEnum)
+		if !exists {
+			conv = func(s string, v reflect.Value) error {
+				v.SetString(s)
+				return nil
+			}
+			return
+		}
+
+		allowed := make(misc.BoolMap)
+		for _, e := range strings.Split(enum, ",") {
+			allowed[strings.TrimSpace(e)] = true
+		}
+
+		if values, ok := staticValues(expr); ok {
+			for _, s := range values {
+				if !allowed[s] {
+					err = fmt.Errorf(`field "%s": value "%s" of the expression is not in the enum`, field.Name, s)
+					return
+				}
+			}
+		}
+
+		conv = func(s string, v reflect.Value) error {
+			if !allowed[s] {
+				return fmt.Errorf(`"%s" is not one of %s`, s, enum)
+			}
+			v.SetString(s)
+			return nil
+		}
+
+	case reflect.Bool:
+		conv = func(s string, v reflect.Value) error {
+			x, err := strconv.ParseBool(s)
+			if err != nil {
+				return err
+			}
+			v.SetBool(x)
+			return nil
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		bits := t.Bits()
+		conv = func(s string, v reflect.Value) error {
+			x, err := strconv.ParseInt(s, 10, bits)
+			if err != nil {
+				return err
+			}
+			v.SetInt(x)
+			return nil
+		}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		bits := t.Bits()
+		conv = func(s string, v reflect.Value) error {
+			x, err := strconv.ParseUint(s, 10, bits)
+			if err != nil {
+				return err
+			}
+			v.SetUint(x)
+			return nil
+		}
+
+	case reflect.Float32, reflect.Float64:
+		bits := t.Bits()
+		conv = func(s string, v reflect.Value) error {
+			x, err := strconv.ParseFloat(s, bits)
+			if err != nil {
+				return err
+			}
+			v.SetFloat(x)
+			return nil
+		}
+
+	case reflect.Array:
+		if !IsUUID(t) {
+			err = fmt.Errorf(`field "%s" has unsupported type %s`, field.Name, t)
+			return
+		}
+
+		conv = func(s string, v reflect.Value) error {
+			x, err := ParseUUID(s)
+			if err != nil {
+				return err
+			}
+			reflect.Copy(v, reflect.ValueOf(x[:]))
+			return nil
+		}
+	}
+
+	return
+}
+
+// Преобразователь остатка пути: в строку через / или в []string
+func makeTailConverter(field *reflect.StructField) (conv tailConverter, err error) {
+	t := field.Type
+
+	switch {
+	case t.Kind() == reflect.String:
+		conv = func(s []string, v reflect.Value) error {
+			v.SetString(strings.Join(s, "/"))
+			return nil
+		}
+
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String:
+		conv = func(s []string, v reflect.Value) error {
+			list := reflect.MakeSlice(t, len(s), len(s))
+			for i, x := range s {
+				list.Index(i).SetString(x)
+			}
+			v.Set(list)
+			return nil
+		}
+
+	default:
+		err = fmt.Errorf(`tail field "%s" must be a string or []string, not %s`, field.Name, t)
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Является ли поле UUID
+func IsUUID(t reflect.Type) bool {
+	return t.Kind() == reflect.Array && t.Len() == 16 && t.Elem().Kind() == reflect.Uint8
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -38,7 +38,13 @@ type (
 		DefaultHttpCode   int        `json:"defaultHttpCode"`
 		HttpCodes         []int      `json:"httpCodes"`
 
+		Deprecated   bool      `json:"deprecated,omitempty"`   // Устаревшие цепочки
+		DeprecatedAt time.Time `json:"deprecatedAt,omitempty"` // Дата вывода из эксплуатации, задает и Deprecated
+		Sunset       time.Time `json:"sunset,omitempty"`       // Дата отключения
+		Replacement  string    `json:"replacement,omitempty"`  // URL замены
+
 		prepared bool
+		tree     *chainsTree
 	}
 
 	ChainsList []*Chain
@@ -52,14 +58,41 @@ type (
 		Scope         string          `json:"scope,omitempty"`
 		Params        Params          `json:"params"`
 		Tokens        []*Token        `json:"tokens"`
-		CacheLifetime config.Duration `json:"cacheLifetime"` // Время жизни кэша, если 0, то не использовать
+		CacheLifetime config.Duration `json:"cacheLifetime"`          // Время жизни кэша, если 0, то не использовать
+		CacheVary     []string        `json:"cacheVary,omitempty"`    // Дополнительные составляющие ключа кэша: identity, groups, locale или имена заголовков запроса
+		CacheKey      any             `json:"-"`                      // Дополнительная составляющая ключа кэша (rest.FuncCacheKey), если ответ зависит от чего-то еще кроме CacheVary
+		StreamFormat  string          `json:"streamFormat,omitempty"` // Формат вывода ByRow по умолчанию (json, ndjson, csv, tsv)
+
+		CacheStaleWhileRevalidate config.Duration `json:"cacheStaleWhileRevalidate,omitempty"` // Сколько после CacheLifetime отдавать протухшие данные, обновляя их в фоне
+		CacheStaleIfError         config.Duration `json:"cacheStaleIfError,omitempty"`         // Сколько после CacheLifetime отдавать протухшие данные, если обновление завершилось ошибкой
+
+		HTTPCache *HTTPCachePolicy `json:"httpCache,omitempty"` // Политика кэширования ответа на GET клиентами и прокси. Если не задана, то по CacheLifetime
+
+		CompressMinSize int `json:"compressMinSize,omitempty"` // Минимальный размер ответа для сжатия, 0 - по умолчанию, <0 - не сжимать
+		CompressLevel   int `json:"compressLevel,omitempty"`   // Уровень сжатия, 0 - по умолчанию для кодировщика
+
+		Deprecated   bool      `json:"deprecated,omitempty"`   // Устаревшая цепочка
+		DeprecatedAt time.Time `json:"deprecatedAt,omitempty"` // Дата вывода из эксплуатации, задает и Deprecated
+		Sunset       time.Time `json:"sunset,omitempty"`       // Дата отключения
+		Replacement  string    `json:"replacement,omitempty"`  // URL замены
+	}
+
+	// Политика HTTP кэширования (Cache-Control)
+	HTTPCachePolicy struct {
+		Private bool            `json:"private,omitempty"` // Только для клиента (private), иначе public
+		NoStore bool            `json:"noStore,omitempty"` // Не сохранять (no-store)
+		MaxAge  config.Duration `json:"maxAge,omitempty"`  // max-age. Если 0, то CacheLifetime, если и он 0, то no-cache
+		SMaxAge config.Duration `json:"sMaxAge,omitempty"` // s-maxage для общих кэшей
 	}
 
 	Token struct {
 		Description string `json:"description"`
 		Expr        string `json:"expr"`
 		VarName     string `json:"varName"`
+		Flags       Flags  `json:"flags,omitempty"`
 		re          *regexp.Regexp
+		conv        converter
+		tailConv    tailConverter
 	}
 
 	Object struct {
@@ -98,6 +131,14 @@ type (
 		ReadonlyFields  misc.StringMap    `json:"-"`                      // поля только на чтение, ключ - путь до поля, значение - db name
 		UniqueKeyFields []string          `json:"requestUniqueKeyFields"` // уникальные поля, первый - primary key (формально)
 		SkippedFields   misc.StringMap    `json:"-"`                      // поля для которых не производится стандартная обработка, ключ - путь до поля, значение - без разницы
+		AuditFields     AuditFields       `json:"-"`                      // поля аудита, заполняемые сервером, ключ - role
+	}
+
+	AuditFields map[string]*AuditField
+
+	AuditField struct {
+		DbName string
+		Type   reflect.Type
 	}
 
 	ResponseParams struct {
@@ -128,10 +169,13 @@ const (
 	FlagUDqueriesReturnsID       = Flags(0x00000008)
 	FlagWithoutCU                = Flags(0x00000010)
 	FlagDontReadBody             = Flags(0x00000020)
+	FlagResponseByRow            = Flags(0x00000040) // Ответ отдается потоком через ByRow (для документирования)
 
 	FlagChainDefault    = Flags(0x00000001)
 	FlagChainEnableTail = Flags(0x00000002)
 
+	FlagTokenTail = Flags(0x00000001) // Токен захватывает весь остаток пути (один и более элементов), только последний в цепочке
+
 	// VarName
 	VarIgnore = "_"
 	VarID     = "ID"
@@ -159,9 +203,22 @@ const (
 
 	RolePrimary     = "primary"
 	RoleKey         = "key"
+	RoleModified    = "modified" // Время изменения записи, используется для Last-Modified
+	RoleDeleted     = "deleted"  // Признак (bool) или время мягкого удаления записи
 	StdPrimaryField = VarID
 
+	// Поля аудита, заполняются сервером при сохранении и не могут быть изменены клиентом
+	RoleCreatedAt = "createdAt" // Время создания
+	RoleUpdatedAt = "updatedAt" // Время последнего изменения
+	RoleCreatedBy = "createdBy" // Кто создал
+	RoleUpdatedBy = "updatedBy" // Кто изменил последним
+
 	DefaultValueNull = db.DefaultValueNull
+
+	// Составляющие ключа кэша (остальные значения CacheVary - имена заголовков)
+	CacheVaryIdentity = "identity" // Пользователь
+	CacheVaryGroups   = "groups"   // Группы пользователя
+	CacheVaryLocale   = "locale"   // Locale
 )
 
 var (
@@ -289,23 +346,38 @@ func (chains *Chains) Prepare(m string) (err error) {
 					continue
 				}
 
-				k := field.Type.Kind()
-				switch k {
-				default:
-					msgs.Add(`[%d.%d] field "%s" is not a string or integer`, ci, ti, token.VarName)
+				if token.IsTail() {
+					token.tailConv, err = makeTailConverter(&field)
+				} else {
+					token.conv, err = makeConverter(&field, token.Expr)
+				}
+				if err != nil {
+					msgs.Add(`[%d.%d] %s`, ci, ti, err)
 					continue
-				case reflect.String:
-				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 				}
 			}
 
-			if token.Expr == "" && len(chain.Tokens) > 1 {
+			expr := token.Expr
+
+			if token.IsTail() {
+				if ti != len(chain.Tokens)-1 {
+					msgs.Add("[%d.%d] a tail token must be the last one in the chain", ci, ti)
+					continue
+				}
+
+				chain.Flags |= FlagChainEnableTail
+
+				if expr == "" {
+					expr = `.+`
+				}
+
+			} else if expr == "" && len(chain.Tokens) > 1 {
 				msgs.Add("[%d.%d] an empty expression is allowed only in a chain with one element", ci, ti)
 				continue
 			}
 
 			var re *regexp.Regexp
-			re, err = regexp.Compile(`^(` + token.Expr + `)$`)
+			re, err = regexp.Compile(`^(` + expr + `)$`)
 			if err != nil {
 				msgs.Add("[%d.%d] %s", ci, ti, err)
 				continue
@@ -320,12 +392,68 @@ func (chains *Chains) Prepare(m string) (err error) {
 
 	sort.Sort(chains)
 
+	chains.tree = buildChainsTree(chains.Chains)
+
 	chains.prepared = true
 	return
 }
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
+// Методы, цепочки которых подходят для пути, отсортированные. Если path == nil, то все методы.
+// HEAD добавляется при наличии GET, OPTIONS - всегда, если есть хоть один метод
+func (set *Set) Allow(path []string) (methods []string) {
+	exists := make(misc.BoolMap, len(set.Methods)+2)
+
+	for m, chains := range set.Methods {
+		if chains == nil || len(chains.Chains) == 0 {
+			continue
+		}
+
+		if path != nil && !chains.Match(path) {
+			continue
+		}
+
+		exists[m] = true
+	}
+
+	if len(exists) == 0 {
+		return
+	}
+
+	if exists[stdhttp.MethodGET] {
+		exists[stdhttp.MethodHEAD] = true
+	}
+	exists[stdhttp.MethodOPTIONS] = true
+
+	methods = make([]string, 0, len(exists))
+	for m := range exists {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+
+	return
+}
+
+// Есть ли цепочка для пути (без разбора параметров)
+func (chains *Chains) Match(path []string) bool {
+	if !chains.prepared {
+		return false
+	}
+
+	if len(path) == 0 && len(chains.Chains[0].Tokens) == 1 && chains.Chains[0].Tokens[0].Expr == "" {
+		return true
+	}
+
+	if chains.tree.find(path) >= 0 {
+		return true
+	}
+
+	return chains.Chains[len(chains.Chains)-1].Flags&FlagChainDefault != 0
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
 func (chains *Chains) Find(path []string) (matched *Chain, pathParams any, code int, err error) {
 	code = 0
 	msgs := misc.NewMessages()
@@ -360,9 +488,16 @@ func (chains *Chains) Find(path []string) (matched *Chain, pathParams any, code
 				break
 			}
 
-			err = misc.Iface2IfacePtr(path[i], ppe.FieldByName(token.VarName).Addr().Interface())
+			field := ppe.FieldByName(token.VarName)
+
+			if token.IsTail() {
+				err = token.tailConv(path[i:], field)
+			} else {
+				err = token.conv(path[i], field)
+			}
 			if err != nil {
-				msgs.AddError(err)
+				msgs.Add(`path parameter "%s": %s`, token.VarName, err)
+				code = http.StatusBadRequest
 			}
 		}
 
@@ -390,32 +525,8 @@ func (chains *Chains) Find(path []string) (matched *Chain, pathParams any, code
 		return
 	}
 
-	for ci := range len(chains.Chains) {
-		chain := chains.Chains[ci]
-
-		if len(chain.Tokens) < ln && chain.Flags&FlagChainEnableTail == 0 {
-			continue
-		}
-
-		if len(chain.Tokens) > ln {
-			return
-		}
-
-		for i, token := range chain.Tokens {
-			if !token.re.MatchString(path[i]) {
-				chain = nil
-				break
-			}
-		}
-
-		if chain != nil {
-			matched = chain
-			break
-		}
-	}
-
-	if matched == nil {
-		return
+	if ci := chains.tree.find(path); ci >= 0 {
+		matched = chains.Chains[ci]
 	}
 
 	return
@@ -571,6 +682,39 @@ func (token *Token) Clone() *Token {
 	return &new
 }
 
+// Токен захватывает остаток пути?
+func (token *Token) IsTail() bool {
+	return token.Flags&FlagTokenTail != 0
+}
+
+// Выражение для отображения в документации: если оно задает единственную строку, то эта строка без экранирования
+// (шаблон "v1.0" хранится как v1\.0), иначе само выражение
+func (token *Token) Display() string {
+	values, ok := staticValues(token.Expr)
+	if !ok || len(values) != 1 {
+		return token.Expr
+	}
+
+	return values[0]
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Роль поля аудита?
+func IsAuditRole(role string) bool {
+	switch role {
+	case RoleCreatedAt, RoleUpdatedAt, RoleCreatedBy, RoleUpdatedBy:
+		return true
+	default:
+		return false
+	}
+}
+
+// Поле только на чтение (явно или как поле аудита)?
+func IsReadonly(f *reflect.StructField) bool {
+	return f.Tag.Get(TagReadonly) == "true" || IsAuditRole(f.Tag.Get(TagRole))
+}
+
 //----------------------------------------------------------------------------------------------------------------------------//
 
 func StructType(v any) (t reflect.Type, err error) {
@@ -624,6 +768,10 @@ func (p *Params) Prepare(m string, msgs *misc.Messages) (err error) {
 		p.Request.ReadonlyFields = make(misc.StringMap, 16)
 	}
 
+	if len(p.Request.AuditFields) == 0 {
+		p.Request.AuditFields = make(AuditFields, 4)
+	}
+
 	if p.Request.Pattern != nil {
 		if p.Request.Name == "" {
 			msgs.Add("RequestObjectName not defined")
@@ -821,7 +969,14 @@ func (p *Params) typeFlatModelIterator(tagDB string, base string, model *misc.St
 				p.Request.RequiredFields[fName] = dbName
 			}
 
-			if f.Tag.Get(TagReadonly) == "true" {
+			if role := f.Tag.Get(TagRole); IsAuditRole(role) {
+				p.Request.AuditFields[role] = &AuditField{
+					DbName: dbName,
+					Type:   ft,
+				}
+			}
+
+			if IsReadonly(&f) {
 				p.Request.ReadonlyFields[fName] = dbName
 				continue
 			}
@@ -1,8 +1,12 @@
 package path
 
 import (
+	"fmt"
+	"net/http"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 //----------------------------------------------------------------------------------------------------------------------------//
@@ -50,7 +54,7 @@ func TestPrepareIllegal(t *testing.T) {
 		},
 		{
 			StdParams: Params{
-				PathParamsPattern: struct{ X float64 }{},
+				PathParamsPattern: struct{ X []int }{},
 			},
 			Chains: []*Chain{
 				{
@@ -371,3 +375,424 @@ func TestParser(t *testing.T) {
 }
 
 //----------------------------------------------------------------------------------------------------------------------------//
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Прежний последовательный перебор цепочек - для сравнения
+func (chains *Chains) findLinear(path []string) (matched *Chain) {
+	ln := len(path)
+
+	for _, chain := range chains.Chains {
+		if len(chain.Tokens) < ln && chain.Flags&FlagChainEnableTail == 0 {
+			continue
+		}
+
+		if len(chain.Tokens) > ln {
+			return
+		}
+
+		for i, token := range chain.Tokens {
+			if token.IsTail() {
+				if i >= ln {
+					chain = nil
+					break
+				}
+				for _, p := range path[i:] {
+					if !token.re.MatchString(p) {
+						chain = nil
+						break
+					}
+				}
+				break
+			}
+
+			if !token.re.MatchString(path[i]) {
+				chain = nil
+				break
+			}
+		}
+
+		if chain != nil {
+			return chain
+		}
+	}
+
+	return
+}
+
+func testManyChains(n int) *Chains {
+	c := &Chains{
+		StdParams: Params{
+			PathParamsPattern: pathParamsPattern{},
+		},
+	}
+
+	for i := range n {
+		var tokens []*Token
+		switch i % 4 {
+		case 0:
+			tokens = []*Token{{Expr: fmt.Sprintf("obj%d", i), VarName: "Tp"}}
+		case 1:
+			tokens = []*Token{{Expr: fmt.Sprintf("obj%d", i), VarName: "Tp"}, {Expr: `\d+`, VarName: "ID"}}
+		case 2:
+			tokens = []*Token{{Expr: fmt.Sprintf("obj%d|alt%d", i, i), VarName: "Tp"}, {Expr: `\d+`, VarName: "GID"}, {Expr: `active|blocked`, VarName: "Status"}}
+		case 3:
+			tokens = []*Token{{Expr: `x\d+`, VarName: "Tp"}, {Expr: `\d+`, VarName: "ID"}}
+		}
+
+		c.Chains = append(c.Chains, &Chain{Name: fmt.Sprintf("c%d", i), Tokens: tokens})
+	}
+
+	c.Chains = append(c.Chains,
+		&Chain{Name: "tail", Flags: FlagChainEnableTail, Tokens: []*Token{{Expr: "files", VarName: VarIgnore}}},
+		&Chain{Name: "rest", Tokens: []*Token{{Expr: "docs", VarName: VarIgnore}, {Expr: `[a-z0-9.]+`, VarName: "Status", Flags: FlagTokenTail}}},
+		&Chain{Name: "default", Flags: FlagChainDefault, Tokens: []*Token{{Expr: `.*`, VarName: VarIgnore}}},
+	)
+
+	return c
+}
+
+var testChainPaths = [][]string{
+	{"obj0"},
+	{"obj1", "15"},
+	{"obj2", "3", "active"},
+	{"alt2", "3", "blocked"},
+	{"alt2", "3", "deleted"},
+	{"x12", "5"},
+	{"obj398"},
+	{"obj397", "1"},
+	{"files", "a", "b"},
+	{"docs", "a", "b.txt"},
+	{"docs"},
+	{"docs", "A"},
+	{"unknown"},
+	{"obj1"},
+	{"obj1", "x"},
+}
+
+func TestTreeEquivalence(t *testing.T) {
+	c := testManyChains(400)
+	err := c.Prepare("GET")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range testChainPaths {
+		expected := c.findLinear(p)
+
+		var got *Chain
+		if ci := c.tree.find(p); ci >= 0 {
+			got = c.Chains[ci]
+		}
+
+		if got != expected {
+			t.Errorf("%v: got %v, expected %v", p, got, expected)
+		}
+	}
+
+	for _, expr := range []string{"abc", "a|b|c", "", `\.info`} {
+		if _, ok := staticValues(expr); !ok {
+			t.Errorf(`"%s": static expected`, expr)
+		}
+	}
+
+	for _, expr := range []string{`\d+`, "(?i)abc", "a.c", "ab|ac"} {
+		if _, ok := staticValues(expr); ok {
+			t.Errorf(`"%s": dynamic expected`, expr)
+		}
+	}
+}
+
+func BenchmarkChainsFind(b *testing.B) {
+	c := testManyChains(400)
+	err := c.Prepare("GET")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := range b.N {
+		c.tree.find(testChainPaths[i%len(testChainPaths)])
+	}
+}
+
+func BenchmarkChainsFindLinear(b *testing.B) {
+	c := testManyChains(400)
+	err := c.Prepare("GET")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := range b.N {
+		c.findLinear(testChainPaths[i%len(testChainPaths)])
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestConflicts(t *testing.T) {
+	c := &Chains{
+		StdParams: Params{
+			PathParamsPattern: pathParamsPattern{},
+		},
+		Chains: []*Chain{
+			{Name: "byID", Tokens: []*Token{{Expr: `\d+`, VarName: "ID"}}},
+			{Name: "byHex", Tokens: []*Token{{Expr: `[0-9a-f]+`, VarName: "Tp"}}},
+			{Name: "status", Tokens: []*Token{{Expr: `active|blocked`, VarName: "Status"}}},
+			{Name: "active", Tokens: []*Token{{Expr: `active`, VarName: "Status"}}},
+			{Name: "group", Tokens: []*Token{{Expr: `group`, VarName: "Tp"}, {Expr: `\d+`, VarName: "GID"}}},
+			{Name: "files", Flags: FlagChainEnableTail, Tokens: []*Token{{Expr: `files`, VarName: VarIgnore}}},
+			{Name: "file", Tokens: []*Token{{Expr: `files`, VarName: VarIgnore}, {Expr: `\d+`, VarName: "ID"}}},
+			{Name: "d1", Flags: FlagChainDefault, Tokens: []*Token{{Expr: `.*`, VarName: VarIgnore}}},
+			{Name: "d2", Flags: FlagChainDefault, Tokens: []*Token{{Expr: `.*`, VarName: VarIgnore}}},
+		},
+	}
+
+	err := c.Prepare("GET")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reports := strings.Join(c.Conflicts(), "\n")
+
+	for _, expected := range []string{
+		`multiple default chains: "d1", "d2"`,
+		`chains "byID" and "byHex" may match the same path`,
+		`chain "active" is unreachable, it is shadowed by "status"`,
+		`chain "file" is unreachable, it is shadowed by "files"`,
+	} {
+		if !strings.Contains(reports, expected) {
+			t.Errorf("not found: %s", expected)
+		}
+	}
+
+	for _, unexpected := range []string{`"group"`, `"byID" and "status"`} {
+		if strings.Contains(reports, unexpected) {
+			t.Errorf("unexpected: %s", unexpected)
+		}
+	}
+
+	set := &Set{Methods: Methods{"GET": c}}
+	if !set.MayMatchPrefix([]string{"files", "x", "y"}) || set.MayMatchPrefix([]string{"group", "x"}) {
+		t.Errorf("MayMatchPrefix failed")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type testPathStatus string
+
+type testPathCode struct {
+	v string
+}
+
+func (c *testPathCode) UnmarshalText(b []byte) error {
+	if len(b) != 3 {
+		return fmt.Errorf("code must be 3 chars long")
+	}
+	c.v = strings.ToUpper(string(b))
+	return nil
+}
+
+func TestConverters(t *testing.T) {
+	type params struct {
+		UUID   [16]byte
+		At     time.Time
+		Flag   bool
+		Ratio  float64
+		Status testPathStatus `enum:"active,blocked"`
+		Code   testPathCode
+		Small  int8
+	}
+
+	chains := &Chains{
+		StdParams: Params{
+			PathParamsPattern: params{},
+		},
+		Chains: ChainsList{
+			{
+				Tokens: []*Token{
+					{Expr: `[0-9a-fA-F-]+`, VarName: "UUID"},
+					{Expr: `[^/]+`, VarName: "At"},
+					{Expr: `true|false`, VarName: "Flag"},
+					{Expr: `[\d.]+`, VarName: "Ratio"},
+					{Expr: `active|blocked`, VarName: "Status"},
+					{Expr: `\w+`, VarName: "Code"},
+					{Expr: `-?\d+`, VarName: "Small"},
+				},
+			},
+		},
+	}
+
+	err := chains.Prepare("GET")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, pp, code, err := chains.Find([]string{"0f8fad5b-d9cb-469f-a165-70867728950e", "2026-10-18T12:00:00Z", "true", "0.25", "blocked", "abc", "-7"})
+	if err != nil || code != 0 {
+		t.Fatalf("code %d: %v", code, err)
+	}
+
+	p := pp.(*params)
+	at, _ := ParseTime("2026-10-18T12:00:00Z")
+	expected := params{
+		UUID:   [16]byte{0x0f, 0x8f, 0xad, 0x5b, 0xd9, 0xcb, 0x46, 0x9f, 0xa1, 0x65, 0x70, 0x86, 0x77, 0x28, 0x95, 0x0e},
+		At:     at,
+		Flag:   true,
+		Ratio:  0.25,
+		Status: "blocked",
+		Code:   testPathCode{v: "ABC"},
+		Small:  -7,
+	}
+	if !reflect.DeepEqual(*p, expected) {
+		t.Fatalf("got %#v, expected %#v", *p, expected)
+	}
+
+	bad := [][]string{
+		{"0f8fad5b", "2026-10-18T12:00:00Z", "true", "0.25", "blocked", "abc", "-7"},
+		{"0f8fad5b-d9cb-469f-a165-70867728950e", "yesterday", "true", "0.25", "blocked", "abc", "-7"},
+		{"0f8fad5b-d9cb-469f-a165-70867728950e", "2026-10-18T12:00:00Z", "true", "0..25", "blocked", "abc", "-7"},
+		{"0f8fad5b-d9cb-469f-a165-70867728950e", "2026-10-18T12:00:00Z", "true", "0.25", "blocked", "abcd", "-7"},
+		{"0f8fad5b-d9cb-469f-a165-70867728950e", "2026-10-18T12:00:00Z", "true", "0.25", "blocked", "abc", "-700"},
+	}
+
+	vars := []string{"UUID", "At", "Ratio", "Code", "Small"}
+
+	for i, path := range bad {
+		_, _, code, err := chains.Find(path)
+		if code != http.StatusBadRequest {
+			t.Errorf("[%d] got code %d, expected %d (%v)", i, code, http.StatusBadRequest, err)
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), `"`+vars[i]+`"`) {
+			t.Errorf(`[%d] error "%v" does not name %s`, i, err, vars[i])
+		}
+	}
+
+	// Вариант выражения не входит в enum
+	illegal := &Chains{
+		StdParams: Params{
+			PathParamsPattern: params{},
+		},
+		Chains: ChainsList{
+			{
+				Tokens: []*Token{
+					{Expr: `active|deleted`, VarName: "Status"},
+				},
+			},
+		},
+	}
+
+	err = illegal.Prepare("GET")
+	if err == nil {
+		t.Fatal("error expected, but not found")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestTailToken(t *testing.T) {
+	type params struct {
+		Tp       string
+		Path     string
+		Segments []string
+	}
+
+	chains := &Chains{
+		StdParams: Params{
+			PathParamsPattern: params{},
+		},
+		Chains: ChainsList{
+			{
+				Tokens: []*Token{
+					{Expr: "files", VarName: "Tp"},
+					{Expr: `[^/]+`, VarName: "Path", Flags: FlagTokenTail},
+				},
+			},
+			{
+				Tokens: []*Token{
+					{Expr: "parts", VarName: "Tp"},
+					{Expr: `\d+`, VarName: "Segments", Flags: FlagTokenTail},
+				},
+			},
+		},
+	}
+
+	err := chains.Prepare("GET")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if chains.Chains[0].Flags&FlagChainEnableTail == 0 {
+		t.Fatal("FlagChainEnableTail expected")
+	}
+
+	_, pp, code, err := chains.Find([]string{"files", "a", "b", "c.txt"})
+	if err != nil || code != 0 {
+		t.Fatalf("code %d: %v", code, err)
+	}
+	if p := pp.(*params); p.Path != "a/b/c.txt" {
+		t.Errorf(`got "%s", expected "a/b/c.txt"`, p.Path)
+	}
+
+	_, pp, code, err = chains.Find([]string{"parts", "1", "22"})
+	if err != nil || code != 0 {
+		t.Fatalf("code %d: %v", code, err)
+	}
+	if p := pp.(*params); !reflect.DeepEqual(p.Segments, []string{"1", "22"}) {
+		t.Errorf(`got %v, expected [1 22]`, p.Segments)
+	}
+
+	for _, path := range [][]string{{"files"}, {"parts", "1", "x"}} {
+		_, _, code, _ = chains.Find(path)
+		if code != http.StatusNotFound {
+			t.Errorf("%v: got code %d, expected %d", path, code, http.StatusNotFound)
+		}
+	}
+
+	illegal := []*Chains{
+		{
+			StdParams: Params{PathParamsPattern: params{}},
+			Chains: ChainsList{
+				{Name: "tail is not last", Tokens: []*Token{{Expr: `.+`, VarName: "Path", Flags: FlagTokenTail}, {Expr: "x", VarName: VarIgnore}}},
+			},
+		},
+		{
+			StdParams: Params{PathParamsPattern: pathParamsPattern{}},
+			Chains: ChainsList{
+				{Name: "illegal tail field type", Tokens: []*Token{{Expr: `\d+`, VarName: "ID", Flags: FlagTokenTail}}},
+			},
+		},
+	}
+
+	for i, c := range illegal {
+		if c.Prepare("GET") == nil {
+			t.Errorf("[%d] error expected, but not found", i)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestTokenDisplay(t *testing.T) {
+	for _, c := range []struct {
+		expr     string
+		expected string
+	}{
+		{"", ""},
+		{"orders", "orders"},
+		{`v1\.0`, "v1.0"},
+		{`a\+b\(c\)`, "a+b(c)"},
+		{`v1|v2`, `v1|v2`},
+		{`\d+`, `\d+`},
+	} {
+		token := &Token{Expr: c.expr, VarName: VarIgnore}
+		if s := token.Display(); s != c.expected {
+			t.Errorf(`"%s": got "%s", expected "%s"`, c.expr, s, c.expected)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
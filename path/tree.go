@@ -0,0 +1,244 @@
+package path
+
+import (
+	"regexp"
+	"regexp/syntax"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Дерево разбора цепочек.
+//
+// Каждый уровень дерева - элемент пути. Токены, которые являются строкой или перечислением строк (a|b|c),
+// разбираются по словарю, регулярные выражения проверяются только для остальных.
+// Результат тот же, что и у последовательного перебора отсортированных цепочек: из подходящих выбирается
+// цепочка с минимальным индексом, но только среди тех, что стоят до первой цепочки длиннее пути.
+
+type (
+	chainsTree struct {
+		root   *treeNode
+		cutoff []int // [длина пути] индекс первой цепочки длиннее пути
+	}
+
+	treeNode struct {
+		static  map[string]*treeNode
+		dynamic []*treeEdge
+		chains  []int       // цепочки, которые заканчиваются на этом уровне
+		tails   []int       // цепочки с FlagChainEnableTail, которые заканчиваются на этом уровне
+		rests   []*treeRest // цепочки, последний токен которых (на этом уровне) захватывает остаток пути
+	}
+
+	// Цепочка, последний токен которой захватывает остаток пути
+	treeRest struct {
+		ci int
+		re *regexp.Regexp
+	}
+
+	treeEdge struct {
+		expr string
+		re   *regexp.Regexp
+		node *treeNode
+	}
+)
+
+const (
+	// Максимальное количество вариантов в перечислении, которое еще разбирается по словарю
+	maxStaticAlternatives = 32
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Строки, которым соответствует выражение, если это строка или перечисление строк
+func staticValues(expr string) (values []string, ok bool) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return
+	}
+
+	values, ok = regexpValues(re.Simplify(), nil)
+	return
+}
+
+func regexpValues(re *syntax.Regexp, values []string) ([]string, bool) {
+	switch re.Op {
+	case syntax.OpEmptyMatch:
+		values = append(values, "")
+
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil, false
+		}
+		values = append(values, string(re.Rune))
+
+	case syntax.OpCharClass:
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			if int(re.Rune[i+1]-re.Rune[i])+len(values) >= maxStaticAlternatives {
+				return nil, false
+			}
+			for r := re.Rune[i]; r <= re.Rune[i+1]; r++ {
+				values = append(values, string(r))
+			}
+		}
+
+	case syntax.OpCapture:
+		return regexpValues(re.Sub[0], values)
+
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			var ok bool
+			values, ok = regexpValues(sub, values)
+			if !ok {
+				return nil, false
+			}
+		}
+
+	default:
+		return nil, false
+	}
+
+	if len(values) > maxStaticAlternatives {
+		return nil, false
+	}
+
+	return values, true
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func newTreeNode() *treeNode {
+	return &treeNode{
+		static: make(map[string]*treeNode),
+	}
+}
+
+// Построение дерева по отсортированным цепочкам
+func buildChainsTree(list ChainsList) (tree *chainsTree) {
+	tree = &chainsTree{
+		root: newTreeNode(),
+	}
+
+	maxLen := 0
+
+	for ci, chain := range list {
+		maxLen = max(maxLen, len(chain.Tokens))
+		tree.root.add(ci, chain, 0)
+	}
+
+	tree.cutoff = make([]int, maxLen+1)
+	for ln := range tree.cutoff {
+		tree.cutoff[ln] = len(list)
+		for ci, chain := range list {
+			if len(chain.Tokens) > ln {
+				tree.cutoff[ln] = ci
+				break
+			}
+		}
+	}
+
+	return
+}
+
+func (node *treeNode) add(ci int, chain *Chain, level int) {
+	if level == len(chain.Tokens) {
+		node.chains = append(node.chains, ci)
+		if chain.Flags&FlagChainEnableTail != 0 {
+			node.tails = append(node.tails, ci)
+		}
+		return
+	}
+
+	token := chain.Tokens[level]
+
+	if token.IsTail() {
+		node.rests = append(node.rests, &treeRest{ci: ci, re: token.re})
+		return
+	}
+
+	if values, ok := staticValues(token.Expr); ok {
+		for _, v := range values {
+			next, exists := node.static[v]
+			if !exists {
+				next = newTreeNode()
+				node.static[v] = next
+			}
+			next.add(ci, chain, level+1)
+		}
+		return
+	}
+
+	for _, edge := range node.dynamic {
+		if edge.expr == token.Expr {
+			edge.node.add(ci, chain, level+1)
+			return
+		}
+	}
+
+	edge := &treeEdge{
+		expr: token.Expr,
+		re:   token.re,
+		node: newTreeNode(),
+	}
+	node.dynamic = append(node.dynamic, edge)
+	edge.node.add(ci, chain, level+1)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Индекс подходящей цепочки, -1 - не найдена
+func (tree *chainsTree) find(path []string) (ci int) {
+	cutoff := tree.cutoff[min(len(path), len(tree.cutoff)-1)]
+	ci = -1
+	tree.root.find(path, 0, cutoff, &ci)
+	return
+}
+
+func (node *treeNode) find(path []string, level int, cutoff int, best *int) {
+	better := func(list []int) {
+		// Список упорядочен, поэтому достаточно первого элемента
+		if len(list) > 0 && list[0] < cutoff && (*best < 0 || list[0] < *best) {
+			*best = list[0]
+		}
+	}
+
+	if level == len(path) {
+		better(node.chains)
+		return
+	}
+
+	better(node.tails)
+
+	for _, r := range node.rests {
+		if r.ci >= cutoff || (*best >= 0 && r.ci > *best) {
+			continue
+		}
+
+		if r.match(path[level:]) {
+			*best = r.ci
+		}
+	}
+
+	if next, exists := node.static[path[level]]; exists {
+		next.find(path, level+1, cutoff, best)
+	}
+
+	for _, edge := range node.dynamic {
+		if edge.re.MatchString(path[level]) {
+			edge.node.find(path, level+1, cutoff, best)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Все элементы остатка пути соответствуют выражению
+func (r *treeRest) match(path []string) bool {
+	for _, p := range path {
+		if !r.re.MatchString(p) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -2,7 +2,6 @@ package rest
 
 import (
 	"fmt"
-	"maps"
 	"net/http"
 	"reflect"
 	"slices"
@@ -10,7 +9,6 @@ import (
 
 	"github.com/jmoiron/sqlx"
 
-	"github.com/alrusov/cache"
 	"github.com/alrusov/db"
 	"github.com/alrusov/misc"
 	path "github.com/alrusov/rest/v4/path"
@@ -77,10 +75,59 @@ func (proc *ProcOptions) do() (result any, code int, err error) {
 			err = e
 			result = nil
 		}
+
+		if success && e == nil {
+			proc.changed()
+		}
 	}()
 
+	code, err = proc.checkParent()
+	if err != nil {
+		return
+	}
+
+	proc.injectParentKey()
+
 	// processing
 
+	if proc.Scope == ScopeUpsert {
+		switch proc.R.Method {
+		case stdhttp.MethodPOST, stdhttp.MethodPUT, stdhttp.MethodPATCH:
+			return proc.Upsert()
+		}
+	}
+
+	if proc.Info.deletedField != nil {
+		switch proc.Scope {
+		case ScopeDeleteID, ScopeDeleteGUID, ScopeDeleteName:
+			if proc.R.Method == stdhttp.MethodDELETE {
+				return proc.SoftDelete(true)
+			}
+
+		case ScopeRestoreID, ScopeRestoreGUID:
+			switch proc.R.Method {
+			case stdhttp.MethodPUT, stdhttp.MethodPATCH, stdhttp.MethodPOST:
+				return proc.SoftDelete(false)
+			}
+
+			code, err = NotAllowed("allowed: %s, %s, %s", stdhttp.MethodPATCH, stdhttp.MethodPOST, stdhttp.MethodPUT)
+			return
+		}
+	}
+
+	switch proc.Scope {
+	case ScopeUpdateIDs, ScopeUpdateGUIDs:
+		switch proc.R.Method {
+		case stdhttp.MethodPUT, stdhttp.MethodPATCH:
+			return proc.UpdateKeys()
+		}
+
+	case ScopeDeleteIDs, ScopeDeleteGUIDs:
+		if proc.R.Method == stdhttp.MethodDELETE {
+			return proc.DeleteKeys()
+		}
+	}
+
 	switch proc.R.Method {
 	default:
 		return proc.Others()
@@ -104,38 +151,29 @@ func (proc *ProcOptions) do() (result any, code int, err error) {
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
-type (
-	cachedData struct {
-		headers misc.StringMap
-		result  any
-	}
-)
-
 // Get -- получить данные
 func (proc *ProcOptions) Get() (result any, code int, err error) {
-	if proc.ChainLocal.CacheLifetime > 0 {
-		ce, res, resCode := cache.Get(proc.ID, proc.Path, proc.R.RequestURI, proc.PathParams, proc.QueryParams)
-		if ce == nil {
-			cd, ok := res.(cachedData)
-			if !ok {
-				code, err = InternalServerError("Illegal cached data: got %T, expected %T", res, cd)
-				return
-			}
+	if proc.Info.deletedField != nil {
+		// До обращения к кэшу, чтобы не отдать из него то, что не разрешено
+		proc.WithDeleted, code, err = proc.includeDeleted()
+		if err != nil {
+			return
+		}
+	}
 
-			result = cd.result
-			proc.ExtraHeaders = maps.Clone(cd.headers)
-			code = resCode
+	if proc.ChainLocal.CacheLifetime > 0 {
+		fill, cachedResult, cachedCode, found := proc.cacheGet()
+		if found {
+			result = cachedResult
+			code = cachedCode
 			return
 		}
 
-		defer func() {
-			cd := cachedData{
-				headers: maps.Clone(proc.ExtraHeaders),
-				result:  result,
-			}
-			delete(cd.headers, stdhttp.HTTPheaderContentEncoding)
-			ce.Commit(proc.ID, cd, code, proc.ChainLocal.CacheLifetime)
-		}()
+		if fill != nil {
+			defer func() {
+				result, code, err = proc.cachePut(fill, result, code, err)
+			}()
+		}
 	}
 
 	result, code, err = proc.before()
@@ -211,6 +249,8 @@ func (proc *ProcOptions) Get() (result any, code int, err error) {
 		db.Subst(db.SubstJbFields, proc.ChainLocal.Params.DBFields.JbFieldsStr()),
 	)
 
+	proc.addDeletedFilter()
+
 	for {
 		var res any
 		if proc.ResultAsRows {
@@ -271,30 +311,42 @@ func (proc *ProcOptions) Get() (result any, code int, err error) {
 
 // POST
 func (proc *ProcOptions) Post() (result any, code int, err error) {
-	return proc.save(false, false)
+	return proc.save(false, false, false)
 }
 
 // PUT
 func (proc *ProcOptions) Put() (result any, code int, err error) {
-	return proc.save(true, true)
+	return proc.save(true, true, false)
 }
 
 // PATCH
 func (proc *ProcOptions) Patch() (result any, code int, err error) {
-	return proc.save(true, false)
+	return proc.save(true, false, false)
+}
+
+// Upsert -- вставка или обновление массива записей, конфликт определяется по UniqueKeyFields.
+// В запрос передаются подстановки SubstConflictFields и SubstUpsertSet, например:
+//
+//	INSERT INTO ... ON CONFLICT (@CONFLICT_FIELDS@) DO UPDATE SET @UPSERT_SET@ RETURNING id, guid, (xmax = 0) AS created
+//
+// Если запрос возвращает created, то в результате для каждой записи видно, создана она (201) или обновлена (200).
+// Пропущенные поля при вставке получают пустые значения, а при обновлении не меняются. Поле, пропущенное хотя бы в одной
+// записи, не обновляется ни в одной
+func (proc *ProcOptions) Upsert() (result any, code int, err error) {
+	return proc.save(false, true, true)
 }
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
 // common save
-func (proc *ProcOptions) save(forUpdate bool, addBlank bool) (result any, code int, err error) {
+func (proc *ProcOptions) save(forUpdate bool, addBlank bool, upsert bool) (result any, code int, err error) {
 	proc.InternalExecResult = NewExecResult()
 
 	defer func() {
 		proc.InternalExecResult.MultiDefer(&result, &code, &err)
 	}()
 
-	err = proc.prepareFields(proc.InternalExecResult, addBlank)
+	blanked, err := proc.prepareFields(proc.InternalExecResult, addBlank)
 	if err != nil {
 		code = http.StatusUnprocessableEntity
 		return
@@ -310,8 +362,26 @@ func (proc *ProcOptions) save(forUpdate bool, addBlank bool) (result any, code i
 		return
 	}
 
+	var conflictFields []string
+	if upsert {
+		conflictFields, ok = proc.checkConflictFields(proc.InternalExecResult)
+		if !ok {
+			return
+		}
+	}
+
+	proc.fillAuditFields(!forUpdate || upsert)
+
+	if !forUpdate || upsert {
+		proc.fillParentKey()
+	}
+
 	startIdx, fieldNames := proc.makeQueryVars(forUpdate)
 
+	if upsert {
+		proc.addUpsertVars(conflictFields, fieldNames, blanked, proc.InternalExecResult)
+	}
+
 	// Тип шаблона запроса
 
 	patternType := db.PatternTypeInsert
@@ -362,7 +432,8 @@ func (proc *ProcOptions) save(forUpdate bool, addBlank bool) (result any, code i
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
-func (proc *ProcOptions) prepareFields(execResult *ExecResult, addBlank bool) (err error) {
+// blanked - поля (db name), заполненные из BlankTemplate хотя бы в одной записи
+func (proc *ProcOptions) prepareFields(execResult *ExecResult, addBlank bool) (blanked []string, err error) {
 	if proc.ChainLocal.Params.Flags&path.FlagRequestDontMakeFlatModel != 0 {
 		return
 	}
@@ -380,6 +451,9 @@ func (proc *ProcOptions) prepareFields(execResult *ExecResult, addBlank bool) (e
 				for name, val := range blank {
 					if _, exists := fields[name]; !exists {
 						fields[name] = val
+						if !slices.Contains(blanked, name) {
+							blanked = append(blanked, name)
+						}
 					}
 				}
 			}
@@ -507,6 +581,120 @@ func (proc *ProcOptions) checkFields(forUpdate bool, execResult *ExecResult) (su
 
 //----------------------------------------------------------------------------------------------------------------------------//
 
+// Поля (db name) для определения конфликта при upsert: изменяемые UniqueKeyFields (readonly, например автоматически
+// генерируемый primary key, в теле не передаются), все они должны присутствовать в каждой записи
+func (proc *ProcOptions) checkConflictFields(execResult *ExecResult) (conflictFields []string, success bool) {
+	request := proc.ChainLocal.Params.Request
+
+	conflictFields = make([]string, 0, len(request.UniqueKeyFields))
+	names := make([]string, 0, len(request.UniqueKeyFields))
+
+	for _, name := range request.UniqueKeyFields {
+		if name == "" {
+			continue
+		}
+
+		dbName, exists := request.FlatModel[name]
+		if !exists {
+			continue
+		}
+
+		conflictFields = append(conflictFields, dbName)
+		names = append(names, name)
+	}
+
+	if len(conflictFields) == 0 {
+		execResult.Rows[0].AddMessage("no unique key fields defined for upsert")
+		return
+	}
+
+	success = true
+
+	for i, fields := range proc.Fields {
+		for j, dbName := range conflictFields {
+			if v, exists := fields[dbName]; exists && v != nil {
+				continue
+			}
+
+			execResult.Rows[i].AddMessage(`key field "%s" is not found`, names[j])
+			success = false
+		}
+	}
+
+	return
+}
+
+// Подстановки для upsert запроса
+func (proc *ProcOptions) addUpsertVars(conflictFields []string, fieldNames []string, blanked []string, execResult *ExecResult) {
+	set := proc.upsertSet(conflictFields, fieldNames, blanked, execResult)
+
+	proc.DBqueryVars = append(proc.DBqueryVars,
+		db.Subst(SubstConflictFields, strings.Join(conflictFields, ",")),
+		db.Subst(SubstUpsertSet, strings.Join(set, ",")),
+	)
+}
+
+// Список обновляемых при конфликте полей. Поля из blanked клиент передал не во всех записях, они не обновляются
+func (proc *ProcOptions) upsertSet(conflictFields []string, fieldNames []string, blanked []string, execResult *ExecResult) (set []string) {
+	// Поля создания при обновлении не меняются
+	var created []string
+	for _, role := range []string{path.RoleCreatedAt, path.RoleCreatedBy} {
+		if af, exists := proc.ChainLocal.Params.Request.AuditFields[role]; exists {
+			created = append(created, af.DbName)
+		}
+	}
+
+	set = make([]string, 0, len(fieldNames))
+	for _, name := range fieldNames {
+		if slices.Contains(conflictFields, name) || slices.Contains(created, name) {
+			continue
+		}
+
+		if slices.Contains(blanked, name) {
+			proc.upsertSkipped(name, execResult)
+			continue
+		}
+
+		set = append(set, fmt.Sprintf("%s=EXCLUDED.%s", name, name))
+	}
+
+	// Обновлять нечего (переданы только ключи), но пустой DO UPDATE SET - ошибка синтаксиса.
+	// Присваивание ключа самому себе ничего не меняет, а RETURNING по-прежнему возвращает существующую запись
+	if len(set) == 0 && len(conflictFields) != 0 {
+		set = append(set, fmt.Sprintf("%s=EXCLUDED.%s", conflictFields[0], conflictFields[0]))
+	}
+
+	return
+}
+
+// Сообщение для записей, в которых поле передано, но не будет обновлено
+func (proc *ProcOptions) upsertSkipped(dbName string, execResult *ExecResult) {
+	name := dbName
+	for jsonName, n := range proc.ChainLocal.Params.Request.FlatModel {
+		if n == dbName {
+			name = jsonName
+			break
+		}
+	}
+
+	blank := proc.ChainLocal.Params.Request.BlankTemplate[dbName]
+
+	for i, fields := range proc.Fields {
+		if i >= len(execResult.Rows) {
+			break
+		}
+
+		v, exists := fields[dbName]
+		if !exists || reflect.DeepEqual(v, blank) {
+			continue
+		}
+
+		execResult.Rows[i].AddMessage(`field "%s" is not updated on conflict: it is missing in other records`, name)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
 func (proc *ProcOptions) makeQueryVars(forUpdate bool) (startIdx int, fieldNames []string) {
 	jbPairs, fieldNames, fieldVals := proc.ChainLocal.Params.DBFields.Prepare(proc.Fields)
 
@@ -618,6 +806,20 @@ func (proc *ProcOptions) Delete() (result any, code int, err error) {
 	return
 }
 
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Вызывается после успешного (и зафиксированного, если используются транзакции) выполнения запроса
+func (proc *ProcOptions) changed() {
+	switch proc.R.Method {
+	default:
+		return
+	case stdhttp.MethodPOST, stdhttp.MethodPUT, stdhttp.MethodPATCH, stdhttp.MethodDELETE:
+	}
+
+	proc.invalidateCache()
+	proc.notifySubscribers()
+}
+
 // ----------------------------------------------------------------------------------------------------------------------------//
 
 // Other -- другой запрос
@@ -976,7 +1178,11 @@ func (execResult *ExecResult) DbResultParser(dbExecResult *db.Result, returnsObj
 			} else {
 				r.ID = src.ID
 				r.GUID = src.GUID
+				r.Created = src.Created
 				r.Code = http.StatusOK
+				if src.Created != nil && *src.Created {
+					r.Code = http.StatusCreated
+				}
 				execResult.SuccessRows++
 			}
 		}
@@ -0,0 +1,218 @@
+package rest
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/alrusov/log"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Дерево поиска модулей по элементам пути.
+// Пересобирается под modulesMutex при регистрации и удалении модулей, а читается без блокировок
+
+type (
+	routeTree struct {
+		root     *routeNode
+		children map[*Module]map[string]*Module // вложенные модули
+	}
+
+	routeNode struct {
+		seg    string
+		few    []*routeNode          // немного потомков - перебор
+		next   map[string]*routeNode // много потомков - словарь
+		module *Module
+		key    string // ключ модуля в modules
+	}
+)
+
+const (
+	// Количество потомков узла, начиная с которого используется словарь
+	routeMapThreshold = 8
+)
+
+var (
+	// Ошибка регистрации модуля при конфликтах маршрутов. Если false, то только предупреждения в лог
+	StrictRouting = false
+
+	routes atomic.Pointer[routeTree]
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Пересборка дерева. Вызывается под modulesMutex
+func rebuildRoutes() {
+	tree := &routeTree{
+		root:     &routeNode{},
+		children: make(map[*Module]map[string]*Module),
+	}
+
+	for key, module := range modules {
+		node := tree.root
+
+		for _, seg := range strings.Split(key, "/") {
+			next := node.child(seg)
+			if next == nil {
+				next = &routeNode{seg: seg}
+				node.few = append(node.few, next)
+			}
+			node = next
+		}
+
+		node.module = module
+		node.key = key
+
+		if len(module.children) > 0 {
+			children := make(map[string]*Module, len(module.children))
+			for name, child := range module.children {
+				children[name] = child
+			}
+			tree.children[module] = children
+		}
+	}
+
+	tree.root.compile()
+	routes.Store(tree)
+}
+
+// Узлы с большим количеством потомков переводятся на словарь
+func (node *routeNode) compile() {
+	if len(node.few) >= routeMapThreshold {
+		node.next = make(map[string]*routeNode, len(node.few))
+		for _, n := range node.few {
+			node.next[n.seg] = n
+		}
+	}
+
+	for _, n := range node.few {
+		n.compile()
+	}
+}
+
+func (node *routeNode) child(seg string) *routeNode {
+	if node.next != nil {
+		return node.next[seg]
+	}
+
+	for _, n := range node.few {
+		if n.seg == seg {
+			return n
+		}
+	}
+
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Модуль с самым длинным совпадающим по целым элементам префиксом пути
+func findModule(path string) (module *Module, basePath string, extraPath []string, found bool) {
+	tree := routes.Load()
+	if tree == nil {
+		return
+	}
+
+	var matched *routeNode
+
+	node := tree.root
+	rest := path
+
+	for k := 0; ; k++ {
+		seg, tail, more := strings.Cut(rest, "/")
+
+		node = node.child(seg)
+		if node == nil {
+			break
+		}
+
+		// Пустой префикс (путь начинается с /) не рассматривается
+		if node.module != nil && (k > 0 || seg != "") {
+			matched = node
+		}
+
+		if !more {
+			break
+		}
+		rest = tail
+	}
+
+	if matched == nil {
+		return
+	}
+
+	module = matched.module
+	basePath = matched.key
+	found = true
+
+	if len(path) > len(basePath) {
+		tail := path[len(basePath)+1:]
+
+		extraPath = strings.Split(strings.Trim(tail, "/"), "/")
+		if len(extraPath) == 1 && extraPath[0] == "" {
+			extraPath = []string{}
+		} else {
+			for i, p := range extraPath {
+				extraPath[i], _ = url.PathUnescape(p)
+			}
+		}
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Проверка маршрутов регистрируемого модуля. Вызывается под modulesMutex
+func checkRoutes(url string, info *Info) (err error) {
+	if info.Methods == nil {
+		return
+	}
+
+	reports := info.Methods.Conflicts()
+
+	if info.Parent == nil {
+		reports = append(reports, moduleShadowing(url, info)...)
+	}
+
+	if len(reports) == 0 {
+		return
+	}
+
+	if StrictRouting {
+		return fmt.Errorf("route conflicts: %s", strings.Join(reports, "; "))
+	}
+
+	for _, r := range reports {
+		Log.Message(log.WARNING, "[%s] Route conflict: %s", url, r)
+	}
+
+	return
+}
+
+// Перекрытие путей модулей, один из которых вложен в другой
+func moduleShadowing(url string, info *Info) (reports []string) {
+	for other, m := range modules {
+		switch {
+		case strings.HasPrefix(url, other+"/"):
+			// Новый модуль внутри пути существующего
+			if m.Info.Methods != nil && m.Info.Methods.MayMatchPrefix(strings.Split(url[len(other)+1:], "/")) {
+				reports = append(reports, fmt.Sprintf("module shadows paths %s/... of module %s", url, other))
+			}
+
+		case strings.HasPrefix(other, url+"/"):
+			// Существующий модуль внутри пути нового
+			if info.Methods.MayMatchPrefix(strings.Split(other[len(url)+1:], "/")) {
+				reports = append(reports, fmt.Sprintf("paths %s/... of the module are shadowed by module %s", url, other))
+			}
+		}
+	}
+
+	sort.Strings(reports)
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,356 @@
+package rest
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/alrusov/db"
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+	path "github.com/alrusov/rest/v4/path"
+	"github.com/alrusov/stdhttp"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Мягкое удаление (Info.SoftDelete).
+//
+// Признак удаления - поле с role:"deleted" в request или response объекте: bool или время удаления.
+// DELETE (ScopeDeleteID, ScopeDeleteGUID, ScopeDeleteName, ScopeDeleteIDs, ScopeDeleteGUIDs) выполняется
+// через соответствующий update запрос (update.id, update.guid, ...) с полями признака удаления и аудита изменения
+// (updatedAt, updatedBy). Поля аудита берутся из модели запроса цепочки, а если ее нет (обычно у DELETE) - из PUT или PATCH.
+// ScopeRestoreID и ScopeRestoreGUID так же через update.id и update.guid снимают этот признак.
+// В select запросы передается подстановка SubstDeletedFilter, например:
+//
+//	SELECT @FIELDS@ FROM ... WHERE @DELETED_FILTER@ AND ...
+//
+// С query параметром includeDeleted=true (если он разрешен) подстановка - TRUE.
+// Наличие подстановки в select запросах проверяется при регистрации модуля через QueryText, если он задан.
+// Восстановление выполняется только методами PUT, PATCH и POST
+
+var (
+	// Текст запроса по типу базы и полному имени запроса. Задается приложением, без него не проверяется,
+	// что select запросы модулей с мягким удалением содержат SubstDeletedFilter
+	QueryText func(dbType string, name string) (text string, exists bool)
+)
+
+type (
+	deletedField struct {
+		dbName      string
+		isTime      bool
+		auditFields path.AuditFields // Поля аудита update цепочек
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Поиск поля с role:"deleted" по всем цепочкам
+func (info *Info) findDeletedField() (err error) {
+	info.deletedField = nil
+
+	if !info.SoftDelete {
+		return
+	}
+
+	for _, chains := range info.Methods.Methods {
+		for _, chain := range chains.Chains {
+			for _, tp := range []reflect.Type{chain.Params.Request.Type, chain.Params.Response.Type} {
+				info.deletedField = lookupDeletedField(tp)
+				if info.deletedField != nil {
+					info.deletedField.auditFields = info.updateAuditFields()
+					return
+				}
+			}
+		}
+	}
+
+	err = fmt.Errorf(`soft delete: field with %s:"%s" not found`, path.TagRole, path.RoleDeleted)
+	return
+}
+
+// Проверка, что SubstDeletedFilter есть во всех select запросах модуля. Вызывается после определения DBtype и QueryPrefix
+func (info *Info) checkDeletedFilter() (err error) {
+	if info.deletedField == nil {
+		return
+	}
+
+	if info.DBtype == "" {
+		return fmt.Errorf("soft delete: module doesn't use a database")
+	}
+
+	if QueryText == nil {
+		Log.Message(log.WARNING, "[%s] Soft delete: QueryText is not defined, select queries are not checked for @%s@", info.Path, SubstDeletedFilter)
+		return
+	}
+
+	chains, exists := info.Methods.Methods[stdhttp.MethodGET]
+	if !exists {
+		return
+	}
+
+	msgs := misc.NewMessages()
+	defer msgs.Free()
+
+	subst := "@" + SubstDeletedFilter + "@"
+
+	for _, chain := range chains.Chains {
+		name := info.QueryPrefix + chain.Scope
+
+		text, exists := QueryText(info.DBtype, name)
+		if !exists {
+			msgs.Add(`soft delete: query "%s" not found`, name)
+			continue
+		}
+
+		if !strings.Contains(text, subst) {
+			msgs.Add(`soft delete: query "%s" doesn't contain %s`, name, subst)
+		}
+	}
+
+	return msgs.Error()
+}
+
+// Поля аудита из модели запроса PUT или PATCH
+func (info *Info) updateAuditFields() path.AuditFields {
+	for _, method := range []string{stdhttp.MethodPUT, stdhttp.MethodPATCH} {
+		chains, exists := info.Methods.Methods[method]
+		if !exists {
+			continue
+		}
+
+		for _, chain := range chains.Chains {
+			if len(chain.Params.Request.AuditFields) != 0 {
+				return chain.Params.Request.AuditFields
+			}
+		}
+	}
+
+	return nil
+}
+
+func lookupDeletedField(tp reflect.Type) (df *deletedField) {
+	for tp != nil && (tp.Kind() == reflect.Pointer || tp.Kind() == reflect.Slice || tp.Kind() == reflect.Array) {
+		tp = tp.Elem()
+	}
+
+	if tp == nil || tp.Kind() != reflect.Struct {
+		return
+	}
+
+	for _, f := range reflect.VisibleFields(tp) {
+		if !f.IsExported() || f.Tag.Get(path.TagRole) != path.RoleDeleted {
+			continue
+		}
+
+		name := misc.StructTagName(&f, path.TagDB)
+		if name == "" || name == "-" {
+			continue
+		}
+
+		ft := f.Type
+		for ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+
+		return &deletedField{
+			dbName: name,
+			isTime: ft.Kind() != reflect.Bool,
+		}
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Значение признака удаления
+func (df *deletedField) value(deleted bool) any {
+	if !df.isTime {
+		return deleted
+	}
+
+	if deleted {
+		return misc.NowUTC()
+	}
+
+	return nil
+}
+
+// Условие отбора
+func (df *deletedField) filter(includeDeleted bool) string {
+	switch {
+	case includeDeleted:
+		return "TRUE"
+	case df.isTime:
+		return df.dbName + " IS NULL"
+	default:
+		return df.dbName + " IS NOT TRUE"
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Запрошен ли includeDeleted и разрешен ли он
+func (proc *ProcOptions) includeDeleted() (include bool, code int, err error) {
+	s := proc.R.URL.Query().Get(ParamIncludeDeleted)
+	if s == "" {
+		return
+	}
+
+	include, err = strconv.ParseBool(s)
+	if err != nil {
+		code = http.StatusBadRequest
+		err = fmt.Errorf(`bad %s value "%s"`, ParamIncludeDeleted, s)
+		return
+	}
+
+	if !include {
+		return
+	}
+
+	allowed := false
+	if proc.Info.IncludeDeleted != nil {
+		allowed = proc.Info.IncludeDeleted(proc)
+	} else {
+		allowed = proc.AuthIdentity != nil && proc.AuthIdentity.IsAdmin
+	}
+
+	if !allowed {
+		include = false
+		code, err = Forbidden(ParamIncludeDeleted + " is not allowed")
+		return
+	}
+
+	return
+}
+
+// Подстановка SubstDeletedFilter для select запросов
+func (proc *ProcOptions) addDeletedFilter() {
+	df := proc.Info.deletedField
+	if df == nil {
+		return
+	}
+
+	proc.DBqueryVars = append(proc.DBqueryVars,
+		db.Subst(SubstDeletedFilter, df.filter(proc.WithDeleted)),
+	)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Имя update запроса, соответствующего delete/restore scope
+func (proc *ProcOptions) softDeleteQueryName() string {
+	_, key, _ := strings.Cut(proc.Scope, ".")
+	return proc.Info.QueryPrefix + "update." + key
+}
+
+// Поля update запроса: признак удаления и аудит изменения
+func (proc *ProcOptions) softDeleteFields(deleted bool) {
+	df := proc.Info.deletedField
+
+	proc.Fields = []misc.InterfaceMap{
+		{df.dbName: df.value(deleted)},
+	}
+
+	if len(proc.ChainLocal.Params.Request.AuditFields) == 0 {
+		proc.ChainLocal.Params.Request.AuditFields = df.auditFields
+	}
+
+	proc.fillAuditFields(false)
+}
+
+// Переменные update запроса из полей, подготовленных softDeleteFields
+func (proc *ProcOptions) softDeleteVars() (startIdx int, fieldNames []string) {
+	fields := proc.Fields[0]
+
+	fieldNames = slices.Sorted(maps.Keys(fields))
+	vals := make([]any, len(fieldNames))
+	for i, name := range fieldNames {
+		vals[i] = fields[name]
+	}
+
+	commonVals := make([]any, 0, len(proc.DBqueryVars)+1)
+
+	for _, v := range proc.DBqueryVars {
+		switch v.(type) {
+		default:
+			commonVals = append(commonVals, v)
+
+		case *db.SubstArg:
+		}
+	}
+
+	startIdx = len(commonVals) + 1
+
+	proc.DBqueryVars = append(proc.DBqueryVars,
+		db.Subst(db.SubstJbFields, []*db.JbPair{}),
+		[][]any{append(commonVals, vals...)},
+	)
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// SoftDelete -- пометить запись удаленной (deleted == true) или восстановить ее
+func (proc *ProcOptions) SoftDelete(deleted bool) (result any, code int, err error) {
+	execResult := NewExecResult()
+	resultRow := NewExecResultRow()
+	execResult.AddRow(resultRow)
+
+	defer func() {
+		execResult.MultiDefer(&result, &code, &err)
+	}()
+
+	proc.DBqueryName = proc.softDeleteQueryName()
+	proc.softDeleteFields(deleted)
+
+	result, code, err = proc.before()
+	if code != 0 || !misc.IsNil(result) || err != nil {
+		return
+	}
+
+	var returnsObj *[]*ExecResultRow
+
+	if proc.ChainLocal.Params.Flags&path.FlagUDqueriesReturnsID != 0 {
+		requestRes := NewExecResult()
+		returnsObj = &requestRes.Rows
+	}
+
+	err = proc.setDB()
+	if err != nil {
+		return
+	}
+
+	startIdx, fieldNames := proc.softDeleteVars()
+
+	var dbResult *db.Result
+	dbResult, err = proc.db.ExecTxEx(proc.dbTx, returnsObj, proc.DBqueryName, db.PatternTypeUpdate, startIdx, fieldNames, proc.DBqueryVars)
+
+	if err != nil {
+		code = http.StatusInternalServerError
+		return
+	}
+
+	err = execResult.DbResultParser(dbResult, returnsObj)
+	if err != nil {
+		code = http.StatusInternalServerError
+		return
+	}
+
+	proc.ExecResult = execResult
+
+	result, code, err = proc.after()
+	if code != 0 || !misc.IsNil(result) || err != nil {
+		return
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
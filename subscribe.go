@@ -0,0 +1,416 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/alrusov/jsonw"
+	"github.com/alrusov/log"
+	"github.com/alrusov/misc"
+	path "github.com/alrusov/rest/v4/path"
+	"github.com/alrusov/stdhttp"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+/*
+Подписка на изменения ресурса через WebSocket.
+
+Для модуля с флагом FlagSubscriptions GET запрос с заголовками Upgrade: websocket на любой из его URL
+(например /api/orders/123) превращается в подписку. Подписка использует те же цепочки, идентификацию и
+схему ответа, что и обычный GET: при каждом изменении, прошедшем через save()/Delete() этого модуля,
+GET выполняется повторно и его результат отправляется клиенту в SubscriptionMessage.
+
+Подписки регистрируются в SubscriptionHub по ключу "URL модуля + непустые path параметры".
+*/
+
+type (
+	// Хранилище подписок
+	SubscriptionHub interface {
+		// Регистрирует получателя событий по топику, возвращает функцию отписки
+		Subscribe(topic string, ch chan<- *SubscriptionEvent) (cancel func())
+
+		// Рассылает событие всем подписчикам топика
+		Publish(topic string, event *SubscriptionEvent)
+	}
+
+	// Событие изменения ресурса
+	SubscriptionEvent struct {
+		Module string    // URL модуля
+		Topic  string    // Топик
+		Method string    // HTTP метод, которым сделано изменение
+		Scope  string    // Scope цепочки, которой сделано изменение
+		Time   time.Time // Время изменения
+	}
+
+	// Сообщение, отправляемое подписчику
+	SubscriptionMessage struct {
+		Event  string          `json:"event" comment:"Event type (snapshot, change)"`
+		Method string          `json:"method,omitempty" comment:"HTTP method of the change"`
+		Code   int             `json:"code" comment:"HTTP code of the GET request for the resource"`
+		Data   json.RawMessage `json:"data,omitempty" comment:"GET result for the resource"`
+	}
+
+	// Хранилище подписок в памяти
+	MemoryHub struct {
+		mutex  sync.RWMutex
+		topics map[string]map[chan<- *SubscriptionEvent]struct{}
+	}
+
+	// Буфер для выполнения внутреннего GET запроса
+	responseBuffer struct {
+		header http.Header
+		code   int
+		buf    bytes.Buffer
+	}
+)
+
+const (
+	SubscriptionEventSnapshot = "snapshot"
+	SubscriptionEventChange   = "change"
+)
+
+var (
+	subscriptionHubMutex sync.RWMutex
+	subscriptionHub      SubscriptionHub = NewMemoryHub()
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func SetSubscriptionHub(hub SubscriptionHub) {
+	if hub == nil {
+		hub = NewMemoryHub()
+	}
+
+	subscriptionHubMutex.Lock()
+	subscriptionHub = hub
+	subscriptionHubMutex.Unlock()
+}
+
+func GetSubscriptionHub() SubscriptionHub {
+	subscriptionHubMutex.RLock()
+	defer subscriptionHubMutex.RUnlock()
+
+	return subscriptionHub
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func NewMemoryHub() *MemoryHub {
+	return &MemoryHub{
+		topics: make(map[string]map[chan<- *SubscriptionEvent]struct{}, 64),
+	}
+}
+
+func (hub *MemoryHub) Subscribe(topic string, ch chan<- *SubscriptionEvent) (cancel func()) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	subs, exists := hub.topics[topic]
+	if !exists {
+		subs = make(map[chan<- *SubscriptionEvent]struct{}, 4)
+		hub.topics[topic] = subs
+	}
+
+	subs[ch] = struct{}{}
+
+	var once sync.Once
+
+	cancel = func() {
+		once.Do(func() {
+			hub.mutex.Lock()
+			defer hub.mutex.Unlock()
+
+			subs := hub.topics[topic]
+			delete(subs, ch)
+			if len(subs) == 0 {
+				delete(hub.topics, topic)
+			}
+		})
+	}
+
+	return
+}
+
+// Не блокируется: если у подписчика уже есть необработанное событие, то новое не добавляется,
+// так как подписчик все равно перечитает актуальное состояние ресурса
+func (hub *MemoryHub) Publish(topic string, event *SubscriptionEvent) {
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+
+	for ch := range hub.topics[topic] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Количество подписчиков топика
+func (hub *MemoryHub) Len(topic string) int {
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+
+	return len(hub.topics[topic])
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Топик подписки: URL модуля и непустые параметры в каноническом виде
+func SubscriptionTopic(moduleURL string, params any) string {
+	vals := url.Values{}
+
+	switch p := params.(type) {
+	case nil:
+	case misc.InterfaceMap:
+		for n, v := range p {
+			addTopicValue(vals, n, reflect.ValueOf(v))
+		}
+	case map[string]any:
+		for n, v := range p {
+			addTopicValue(vals, n, reflect.ValueOf(v))
+		}
+	default:
+		v := reflect.Indirect(reflect.ValueOf(params))
+		if v.Kind() == reflect.Struct {
+			t := v.Type()
+			for i := range t.NumField() {
+				if !t.Field(i).IsExported() {
+					continue
+				}
+				addTopicValue(vals, t.Field(i).Name, v.Field(i))
+			}
+		}
+	}
+
+	if len(vals) == 0 {
+		return moduleURL
+	}
+
+	return moduleURL + "?" + vals.Encode()
+}
+
+func addTopicValue(vals url.Values, name string, v reflect.Value) {
+	if !v.IsValid() || v.IsZero() {
+		return
+	}
+
+	vals.Set(name, fmt.Sprint(v.Interface()))
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Оповестить подписчиков модуля об изменении. Для использования в нестандартных обработчиках
+func PublishChange(moduleURL string, method string, scope string, params ...any) {
+	hub := GetSubscriptionHub()
+
+	topics := make(misc.BoolMap, len(params)+1)
+	topics[moduleURL] = true // подписчики на всю коллекцию
+
+	for _, p := range params {
+		topics[SubscriptionTopic(moduleURL, p)] = true
+	}
+
+	now := misc.NowUTC()
+
+	for topic := range topics {
+		hub.Publish(topic,
+			&SubscriptionEvent{
+				Module: moduleURL,
+				Topic:  topic,
+				Method: method,
+				Scope:  scope,
+				Time:   now,
+			},
+		)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Вызывается после успешного завершения изменяющего запроса
+func (proc *ProcOptions) notifySubscribers() {
+	if proc.module == nil || proc.ExecResult == nil || proc.ExecResult.SuccessRows == 0 {
+		return
+	}
+
+	params := make([]any, 0, 1+2*len(proc.ExecResult.Rows))
+	params = append(params, proc.PathParams)
+
+	for _, r := range proc.ExecResult.Rows {
+		if r.Code/100 != 2 {
+			continue
+		}
+
+		if r.ID != 0 {
+			params = append(params, misc.InterfaceMap{path.VarID: r.ID})
+		}
+
+		if r.GUID != "" {
+			params = append(params, misc.InterfaceMap{path.VarGUID: r.GUID})
+		}
+	}
+
+	for _, u := range proc.moduleURLs() {
+		PublishChange(u, proc.R.Method, proc.Scope, params...)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Обслуживание подписки. Блокируется до закрытия соединения
+func (proc *ProcOptions) subscribe() {
+	ws, code, err := wsAccept(proc.W, proc.R)
+	if err != nil {
+		if code != 0 {
+			proc.reply(nil, code, err)
+			return
+		}
+		proc.LogFacility.Message(log.NOTICE, "[%d] websocket: %s", proc.ID, err)
+		return
+	}
+
+	topic := SubscriptionTopic(proc.module.RawURL, proc.PathParams)
+
+	proc.LogFacility.Message(log.DEBUG, "[%d] Subscribed to %s", proc.ID, topic)
+	defer proc.LogFacility.Message(log.DEBUG, "[%d] Unsubscribed from %s", proc.ID, topic)
+
+	events := make(chan *SubscriptionEvent, 1)
+	cancel := GetSubscriptionHub().Subscribe(topic, events)
+	defer cancel()
+
+	closed := make(chan struct{})
+
+	// Читатель: обрабатывает управляющие фреймы, все остальное игнорируется
+	go func() {
+		defer close(closed)
+
+		for {
+			op, payload, err := ws.ReadFrame()
+			if err != nil {
+				if errors.Is(err, errWsFrameTooBig) {
+					ws.Close(wsCloseTooBig, "")
+				}
+				return
+			}
+
+			switch op {
+			case wsOpClose:
+				ws.Close(wsCloseNormal, "")
+				return
+			case wsOpPing:
+				if ws.WriteMessage(wsOpPong, payload) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	err = proc.pushSnapshot(ws, SubscriptionEventSnapshot, "")
+	if err != nil {
+		ws.Close(wsCloseGoingWay, "")
+		return
+	}
+
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			ws.conn.Close()
+			return
+
+		case <-misc.ApplicationStopped():
+			ws.Close(wsCloseGoingWay, "")
+			return
+
+		case <-ticker.C:
+			err = ws.WriteMessage(wsOpPing, nil)
+
+		case ev := <-events:
+			err = proc.pushSnapshot(ws, SubscriptionEventChange, ev.Method)
+		}
+
+		if err != nil {
+			proc.LogFacility.Message(log.NOTICE, "[%d] websocket: %s", proc.ID, err)
+			ws.Close(wsCloseGoingWay, "")
+			return
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Выполняет GET для ресурса подписки и отправляет результат
+func (proc *ProcOptions) pushSnapshot(ws *wsConn, event string, method string) (err error) {
+	r := proc.R.Clone(proc.R.Context())
+	r.Method = stdhttp.MethodGET
+	r.Body = http.NoBody
+	r.ContentLength = 0
+	for _, name := range []string{"Upgrade", "Connection", "Sec-WebSocket-Key", "Sec-WebSocket-Version", "Sec-WebSocket-Extensions", "Sec-WebSocket-Protocol", stdhttp.HTTPheaderAcceptEncoding} {
+		r.Header.Del(name)
+	}
+
+	module := proc.module
+	tail := proc.Tail
+
+	find := func(string) (*Module, string, []string, bool) {
+		return module, module.RawURL, tail, true
+	}
+
+	w := newResponseBuffer()
+	HandlerEx(find, proc.Extra, proc.H, proc.ID, proc.Prefix, proc.Path, w, r)
+
+	msg := &SubscriptionMessage{
+		Event:  event,
+		Method: method,
+		Code:   w.code,
+	}
+
+	data := bytes.TrimSpace(w.buf.Bytes())
+	if len(data) != 0 && json.Valid(data) {
+		msg.Data = data
+	}
+
+	j, err := jsonw.Marshal(msg)
+	if err != nil {
+		return
+	}
+
+	return ws.WriteMessage(wsOpText, j)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{
+		header: make(http.Header, 8),
+	}
+}
+
+func (w *responseBuffer) Header() http.Header {
+	return w.header
+}
+
+func (w *responseBuffer) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.buf.Write(p)
+}
+
+func (w *responseBuffer) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -1,10 +1,39 @@
 package rest
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/andybalholm/brotli"
+	"github.com/jmoiron/sqlx"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/alrusov/auth"
+	"github.com/alrusov/config"
 	"github.com/alrusov/misc"
+	"github.com/alrusov/rest/v4/path"
+	"github.com/alrusov/stdhttp"
 )
 
 //----------------------------------------------------------------------------------------------------------------------------//
@@ -42,3 +71,2569 @@ func TestParseTime(t *testing.T) {
 }
 
 //----------------------------------------------------------------------------------------------------------------------------//
+
+func TestSubscriptionTopic(t *testing.T) {
+	type params struct {
+		ID   uint64
+		Name string
+		skip int
+	}
+
+	variants := []struct {
+		params   any
+		expected string
+	}{
+		{nil, "/api/orders"},
+		{&params{}, "/api/orders"},
+		{&params{ID: 12, skip: 1}, "/api/orders?ID=12"},
+		{params{ID: 12, Name: "x y"}, "/api/orders?ID=12&Name=x+y"},
+		{misc.InterfaceMap{"ID": uint64(12)}, "/api/orders?ID=12"},
+		{misc.InterfaceMap{"GUID": ""}, "/api/orders"},
+	}
+
+	for i, v := range variants {
+		topic := SubscriptionTopic("/api/orders", v.params)
+		if topic != v.expected {
+			t.Errorf(`[%d] got "%s", expected "%s"`, i, topic, v.expected)
+		}
+	}
+}
+
+func TestMemoryHub(t *testing.T) {
+	hub := NewMemoryHub()
+
+	ch1 := make(chan *SubscriptionEvent, 1)
+	ch2 := make(chan *SubscriptionEvent, 1)
+
+	cancel1 := hub.Subscribe("/a?ID=1", ch1)
+	cancel2 := hub.Subscribe("/a", ch2)
+
+	hub.Publish("/a?ID=1", &SubscriptionEvent{Method: "PUT"})
+	hub.Publish("/a?ID=1", &SubscriptionEvent{Method: "DELETE"}) // must not block
+
+	select {
+	case ev := <-ch1:
+		if ev.Method != "PUT" {
+			t.Errorf(`got "%s", expected "PUT"`, ev.Method)
+		}
+	default:
+		t.Fatal("event not received")
+	}
+
+	if len(ch2) != 0 {
+		t.Errorf("unexpected event for another topic")
+	}
+
+	cancel1()
+	cancel1()
+	if n := hub.Len("/a?ID=1"); n != 0 {
+		t.Errorf("got %d subscribers, expected 0", n)
+	}
+
+	cancel2()
+}
+
+func TestWsFrames(t *testing.T) {
+	for _, ln := range []int{0, 5, 125, 126, 65535, 65536} {
+		data := bytes.Repeat([]byte{'x'}, ln)
+
+		buf := new(bytes.Buffer)
+		if err := wsWriteFrame(buf, wsOpText, data); err != nil {
+			t.Fatal(err)
+		}
+
+		// Клиентский фрейм: тот же, но замаскированный
+		frame := buf.Bytes()
+		hdrLen := len(frame) - ln
+		mask := []byte{1, 2, 3, 4}
+
+		client := append([]byte{}, frame[:hdrLen]...)
+		client[1] |= 0x80
+		client = append(client, mask...)
+		for i, b := range data {
+			client = append(client, b^mask[i%4])
+		}
+
+		op, payload, err := wsReadFrame(bytes.NewReader(client))
+		if ln > wsMaxIncomingPayload {
+			if !errors.Is(err, errWsFrameTooBig) {
+				t.Errorf("[%d] got %v, expected %v", ln, err, errWsFrameTooBig)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("[%d] %s", ln, err)
+		}
+		if op != wsOpText || !bytes.Equal(payload, data) {
+			t.Errorf("[%d] frame mismatch", ln)
+		}
+	}
+
+	if key := wsAcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); key != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf(`got "%s"`, key)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestParseQList(t *testing.T) {
+	h := http.Header{}
+	h.Add("Accept", "text/html;level=1, application/json;q=0.5")
+	h.Add("Accept", "text/csv;q=0.9, */*;q=0")
+
+	list := parseQList(h, "Accept")
+
+	expected := []string{"text/html", "text/csv", "application/json", "*/*"}
+	if len(list) != len(expected) {
+		t.Fatalf("got %d items, expected %d", len(list), len(expected))
+	}
+
+	for i, v := range expected {
+		if list[i].Value != v {
+			t.Errorf(`[%d] got "%s", expected "%s"`, i, list[i].Value, v)
+		}
+	}
+
+	if list[0].Params["level"] != "1" {
+		t.Errorf("params not parsed: %#v", list[0].Params)
+	}
+
+	if q, found := list.weight("image/png", "*/*"); !found || q != 0 {
+		t.Errorf("got %v %v, expected 0 true", q, found)
+	}
+}
+
+func TestByRowTable(t *testing.T) {
+	type row struct {
+		ID    uint64  `json:"id"`
+		Name  string  `json:"name"`
+		Value float64 `json:"value"`
+		Tags  []int   `json:"tags"`
+		Skip  string  `json:"-"`
+	}
+
+	br := &ByRow{
+		Columns: []string{"id", "name", "value", "tags", "unknown"},
+	}
+
+	header, err := byRowTableHeader(',')(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(header); s != "id,name,value,tags,unknown\n" {
+		t.Errorf(`got header "%s"`, s)
+	}
+
+	line, err := byRowMarshalTable(',')(br, &row{ID: 12345678901234567, Name: `a "b", c`, Value: 1.5, Tags: []int{1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(line); s != `12345678901234567,"a ""b"", c",1.5,"[1,2]",` {
+		t.Errorf(`got line "%s"`, s)
+	}
+
+	line, err = byRowMarshalTable('\t')(br, &row{ID: 1, Name: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(line); s != "1\tx\t0\t\t" {
+		t.Errorf(`got line "%s"`, s)
+	}
+}
+
+type byRowTestRow struct {
+	ID   int    `db:"id" json:"id"`
+	Name string `db:"name" json:"name"`
+}
+
+// Выборка из n строк с ошибкой при чтении строки failAt (если failAt >= 0)
+func byRowTestRows(t *testing.T, n int, failAt int, failErr error) *sqlx.Rows {
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	rows := sqlmock.NewRows([]string{"id", "name"})
+	for i := range n {
+		rows.AddRow(i, fmt.Sprintf("name %d", i))
+	}
+	if failAt >= 0 {
+		rows.RowError(failAt, failErr)
+	}
+
+	mock.ExpectQuery("SELECT").WillReturnRows(rows)
+
+	r, err := sqlx.NewDb(conn, "sqlmock").Queryx("SELECT id, name FROM test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+// ProcOptions для потокового ответа без сжатия
+func byRowTestProc(w http.ResponseWriter, rows *sqlx.Rows) *ProcOptions {
+	proc := &ProcOptions{
+		LogFacility:  Log,
+		R:            httptest.NewRequest(stdhttp.MethodGET, "/test", nil),
+		W:            w,
+		Chain:        &path.Chain{},
+		ExtraHeaders: misc.StringMap{},
+		DBqueryRows:  rows,
+	}
+
+	proc.ChainLocal.CompressMinSize = -1
+	proc.ChainLocal.Params.Response.Type = reflect.TypeOf(byRowTestRow{})
+	return proc
+}
+
+func TestByRowStreamFailure(t *testing.T) {
+	failErr := errors.New("connection lost")
+
+	// Ошибка после начала отправки: запись-признак и трейлеры
+	w := httptest.NewRecorder()
+	proc := byRowTestProc(w, byRowTestRows(t, 5, 3, failErr))
+
+	tuner := func(br *ByRow, row any) (err error) {
+		if br.IsFinal {
+			return
+		}
+
+		if br.SrcRowNum == 2 {
+			// Первые строки уходят клиенту
+			err = br.Flush()
+			if err != nil {
+				return
+			}
+		}
+
+		br.Data = []RowData{{Separator: ByRowDefaultSeparator, Data: row}}
+		return
+	}
+
+	br, err := NewByRow(proc, tuner, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = br.Do()
+	if err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+
+	if br.StreamError() == nil || br.StreamError().Error() != failErr.Error() {
+		t.Errorf("StreamError: got %v", br.StreamError())
+	}
+
+	expected := `[{"id":0,"name":"name 0"},{"id":1,"name":"name 1"},{"id":2,"name":"name 2"},` +
+		`{"error":"connection lost","rowCount":3,"incomplete":true}]`
+	if s := w.Body.String(); s != expected {
+		t.Errorf("got body\n%s\nexpected\n%s", s, expected)
+	}
+
+	res := w.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("got status %d", res.StatusCode)
+	}
+	if v := res.Trailer.Get(HTTPheaderStreamError); v != failErr.Error() {
+		t.Errorf("%s trailer: got %q", HTTPheaderStreamError, v)
+	}
+	if v := res.Trailer.Get(HTTPheaderRowCount); v != "3" {
+		t.Errorf("%s trailer: got %q", HTTPheaderRowCount, v)
+	}
+
+	// Ошибка до начала отправки: ответ остается за вызывающим
+	w = httptest.NewRecorder()
+	proc = byRowTestProc(w, byRowTestRows(t, 5, 1, failErr))
+
+	br, err = NewByRow(proc, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = br.Do()
+	if err == nil || err.Error() != failErr.Error() {
+		t.Errorf("Do: got %v, expected %s", err, failErr)
+	}
+	if br.StreamError() != nil || w.Body.Len() != 0 || w.Result().Trailer.Get(HTTPheaderRowCount) != "" {
+		t.Errorf("nothing should be sent, got %q", w.Body.String())
+	}
+}
+
+// Ожидание завершения горутин, запущенных после замера
+func waitGoroutines(t *testing.T, n int) {
+	t.Helper()
+
+	for range 100 {
+		if runtime.NumGoroutine() <= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("goroutine leak: %d, expected %d", runtime.NumGoroutine(), n)
+}
+
+func TestByRowParallel(t *testing.T) {
+	const rowsCount = 200
+
+	tuner := func(br *ByRow, row any) (err error) {
+		if br.IsFinal {
+			br.Data = []RowData{{Separator: ByRowDefaultSeparator, Data: misc.InterfaceMap{"final": br.RowNum, "src": br.SrcRowNum}}}
+			return
+		}
+
+		r := row.(*byRowTestRow)
+
+		// Перемешиваем время обработки
+		time.Sleep(time.Duration(10-r.ID%10) * 50 * time.Microsecond)
+
+		if r.ID%7 == 1 {
+			// Пропуск
+			return
+		}
+
+		br.Data = []RowData{{Separator: ByRowDefaultSeparator, Data: misc.InterfaceMap{"id": r.ID, "rowNum": br.RowNum, "src": br.SrcRowNum}}}
+		return
+	}
+
+	do := func(workers int, rows *sqlx.Rows) string {
+		w := httptest.NewRecorder()
+		proc := byRowTestProc(w, rows)
+
+		br, err := NewByRow(proc, tuner, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		br.Workers = workers
+
+		err = br.Do()
+		if err != nil {
+			t.Fatalf("Do(%d): %s", workers, err)
+		}
+
+		if v := w.Result().Trailer.Get(HTTPheaderRowCount); v != strconv.Itoa(br.RowNum) {
+			t.Errorf("Do(%d): %s trailer %q, RowNum %d", workers, HTTPheaderRowCount, v, br.RowNum)
+		}
+
+		return w.Body.String()
+	}
+
+	serial := do(0, byRowTestRows(t, rowsCount, -1, nil))
+	if !strings.Contains(serial, `"final":171`) {
+		t.Fatalf("unexpected serial result: %s", serial)
+	}
+
+	for _, workers := range []int{2, 4, 16} {
+		rows := byRowTestRows(t, rowsCount, -1, nil)
+		n := runtime.NumGoroutine()
+
+		if parallel := do(workers, rows); parallel != serial {
+			t.Errorf("workers %d: got\n%s\nexpected\n%s", workers, parallel, serial)
+		}
+
+		waitGoroutines(t, n)
+	}
+}
+
+func TestByRowParallelFailure(t *testing.T) {
+	failErr := errors.New("lookup failed")
+	padding := strings.Repeat("x", 1024)
+
+	// Ошибка tuner после начала отправки (буфер уже сброшен клиенту)
+	rows := byRowTestRows(t, 300, -1, nil)
+	n := runtime.NumGoroutine()
+
+	w := httptest.NewRecorder()
+	proc := byRowTestProc(w, rows)
+
+	br, err := NewByRow(proc,
+		func(br *ByRow, row any) (err error) {
+			if br.IsFinal {
+				return
+			}
+
+			r := row.(*byRowTestRow)
+			if r.ID == 200 {
+				return failErr
+			}
+
+			br.Data = []RowData{{Separator: ByRowDefaultSeparator, Data: misc.InterfaceMap{"id": r.ID, "padding": padding}}}
+			return
+		},
+		true,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	br.Workers = 4
+
+	err = br.Do()
+	if err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+
+	if !errors.Is(br.StreamError(), failErr) {
+		t.Errorf("StreamError: got %v", br.StreamError())
+	}
+	if !strings.HasSuffix(w.Body.String(), `,{"error":"lookup failed","rowCount":200,"incomplete":true}]`) {
+		t.Errorf("no error record at the end")
+	}
+	if v := w.Result().Trailer.Get(HTTPheaderStreamError); v != failErr.Error() {
+		t.Errorf("%s trailer: got %q", HTTPheaderStreamError, v)
+	}
+	if v := w.Result().Trailer.Get(HTTPheaderRowCount); v != "200" {
+		t.Errorf("%s trailer: got %q", HTTPheaderRowCount, v)
+	}
+
+	waitGoroutines(t, n)
+
+	// Отключение клиента
+	rows = byRowTestRows(t, 1000, -1, nil)
+	n = runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w = httptest.NewRecorder()
+	proc = byRowTestProc(w, rows)
+	proc.R = proc.R.WithContext(ctx)
+
+	br, err = NewByRow(proc,
+		func(br *ByRow, row any) (err error) {
+			if br.IsFinal {
+				return
+			}
+
+			if br.SrcRowNum == 50 {
+				cancel()
+			}
+
+			br.Data = []RowData{{Separator: ByRowDefaultSeparator, Data: row}}
+			return
+		},
+		true,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	br.Workers = 4
+
+	err = br.Do()
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Do: got %v, expected %s", err, context.Canceled)
+	}
+
+	waitGoroutines(t, n)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestNegotiateEncoding(t *testing.T) {
+	params := []struct {
+		accept   string
+		expected string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate, gzip", "gzip"},
+		{"deflate, gzip;q=0.5", "deflate"},
+		{"*;q=0.1, deflate;q=0.05", "zstd"},
+		{"gzip;q=0, identity", ""},
+		{"br", "br"},
+		{"gzip, deflate, br, zstd", "zstd"},
+		{"gzip, deflate, br", "br"},
+		{"zstd;q=0.8, br;q=0.9, gzip", "gzip"},
+		{"zstd;q=0, *", "br"},
+		{"compress", ""},
+	}
+
+	for i, p := range params {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		if p.accept != "" {
+			r.Header.Set("Accept-Encoding", p.accept)
+		}
+
+		name := ""
+		if enc := negotiateEncoding(r); enc != nil {
+			name = enc.Name
+		}
+
+		if name != p.expected {
+			t.Errorf(`[%d] "%s": got "%s", expected "%s"`, i, p.accept, name, p.expected)
+		}
+	}
+
+	readers := map[string]func(r io.Reader) (io.Reader, error){
+		ContentEncodingGzip: func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+		ContentEncodingDeflate: func(r io.Reader) (io.Reader, error) {
+			return zlib.NewReader(r)
+		},
+		ContentEncodingZstd: func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		},
+		ContentEncodingBrotli: func(r io.Reader) (io.Reader, error) {
+			return brotli.NewReader(r), nil
+		},
+	}
+
+	src := bytes.Repeat([]byte("0123456789"), 100)
+
+	for name, newReader := range readers {
+		enc, exists := GetEncoder(name)
+		if !exists {
+			t.Errorf("%s: encoder not found", name)
+			continue
+		}
+
+		// Повтор - кодировщики из пула
+		for _, level := range []int{0, 1, 9, 0, 1, 9} {
+			packed, err := enc.pack(src, level)
+			if err != nil {
+				t.Errorf("%s/%d: %s", name, level, err)
+				continue
+			}
+
+			rd, err := newReader(bytes.NewReader(packed))
+			if err != nil {
+				t.Errorf("%s/%d: %s", name, level, err)
+				continue
+			}
+
+			unpacked, err := io.ReadAll(rd)
+			if err != nil {
+				t.Errorf("%s/%d: %s", name, level, err)
+				continue
+			}
+
+			if !bytes.Equal(src, unpacked) {
+				t.Errorf("%s/%d: unpacked data differs from source", name, level)
+			}
+		}
+	}
+
+	// Буферизованный и потоковый ответы
+	for name, newReader := range readers {
+		check := func(kind string, w *httptest.ResponseRecorder, expected []byte) {
+			if v := w.Header().Get(stdhttp.HTTPheaderContentEncoding); v != name {
+				t.Errorf("%s %s: got Content-Encoding %q", name, kind, v)
+				return
+			}
+
+			rd, err := newReader(w.Body)
+			if err != nil {
+				t.Errorf("%s %s: %s", name, kind, err)
+				return
+			}
+
+			unpacked, err := io.ReadAll(rd)
+			if err != nil {
+				t.Errorf("%s %s: %s", name, kind, err)
+				return
+			}
+
+			if !bytes.Equal(expected, unpacked) {
+				t.Errorf("%s %s: got %q", name, kind, unpacked)
+			}
+		}
+
+		w := httptest.NewRecorder()
+		proc := byRowTestProc(w, nil)
+		proc.ChainLocal.CompressMinSize = 0
+		proc.R.Header.Set(stdhttp.HTTPheaderAcceptEncoding, name+", gzip;q=0.5")
+
+		err := proc.writeReply(http.StatusOK, stdhttp.ContentTypeText, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check("reply", w, src)
+
+		w = httptest.NewRecorder()
+		proc = byRowTestProc(w, byRowTestRows(t, 2, -1, nil))
+		proc.ChainLocal.CompressMinSize = 0
+		proc.R.Header.Set(stdhttp.HTTPheaderAcceptEncoding, name+", gzip;q=0.5")
+
+		br, err := NewByRow(proc, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = br.Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+		check("stream", w, []byte(`[{"id":0,"name":"name 0"},{"id":1,"name":"name 1"}]`))
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestCacheInvalidation(t *testing.T) {
+	s := newCacheStore()
+	m := "/api/test"
+
+	put := func(key string, params any) {
+		_, fill := s.get(key)
+		if fill == nil {
+			t.Fatalf(`"%s" unexpectedly found`, key)
+		}
+		fill.commit(&cacheEntry{
+			key:     key,
+			module:  m,
+			tags:    []string{cacheModuleTag(m), cacheKeyTag(m, params)},
+			expires: misc.NowUTC().Add(time.Hour),
+		}, false)
+	}
+
+	put("all", nil)
+	put("id1", misc.InterfaceMap{"ID": uint64(1)})
+	put("id2", &struct{ ID uint64 }{ID: 2})
+
+	if n := s.invalidate(m, cacheKeyTag(m, misc.InterfaceMap{"ID": uint64(1)})); n != 2 {
+		t.Errorf("got %d removed, expected 2", n)
+	}
+
+	if e, _ := s.get("id2"); e == nil {
+		t.Errorf("id2 removed")
+	}
+
+	// Инвалидация во время заполнения
+	_, fill := s.get("all")
+	s.invalidate(m)
+	fill.commit(&cacheEntry{key: "all", tags: []string{cacheModuleTag(m), m}, expires: misc.NowUTC().Add(time.Hour)}, false)
+	if e, f := s.get("all"); e != nil {
+		t.Errorf("stale entry saved")
+	} else {
+		f.commit(nil, false)
+	}
+
+	if n := s.invalidate(cacheModuleTag(m)); n != 1 {
+		t.Errorf("got %d removed, expected 1", n)
+	}
+}
+
+func TestCacheLimits(t *testing.T) {
+	defer func(entries int, memory int64) {
+		CacheMaxEntries, CacheMaxMemory = entries, memory
+	}(CacheMaxEntries, CacheMaxMemory)
+
+	CacheMaxEntries = 3
+	CacheMaxMemory = 0
+
+	s := newCacheStore()
+
+	put := func(key string, size int64, lifetime time.Duration) {
+		_, fill := s.get(key)
+		if fill == nil {
+			t.Fatalf(`"%s" unexpectedly found`, key)
+		}
+		expires := misc.NowUTC().Add(lifetime)
+		fill.commit(&cacheEntry{key: key, size: size, expires: expires, staleUntil: expires, errorUntil: expires}, false)
+	}
+
+	exists := func(key string) bool {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		_, exists := s.entries[key]
+		return exists
+	}
+
+	put("a", 10, time.Hour)
+	put("b", 10, time.Hour)
+	put("c", 10, time.Hour)
+
+	// a становится самой свежей, вытесняется b
+	if e, _ := s.get("a"); e == nil {
+		t.Fatalf("a not found")
+	}
+	put("d", 10, time.Hour)
+
+	if !exists("a") || exists("b") || !exists("c") || !exists("d") {
+		t.Errorf("LRU by count: got %v", slices.Sorted(maps.Keys(s.entries)))
+	}
+
+	// Ограничение по памяти
+	CacheMaxEntries = 0
+	CacheMaxMemory = 35
+	put("e", 10, time.Hour)
+
+	if exists("c") || len(s.entries) != 3 || s.memory != 30 {
+		t.Errorf("LRU by memory: got %v, memory %d", slices.Sorted(maps.Keys(s.entries)), s.memory)
+	}
+
+	// Протухшие записи удаляются без обращения к ним
+	put("expired", 1, -time.Second)
+	s.mutex.Lock()
+	s.lastCleanup = time.Time{}
+	s.cleanup(misc.NowUTC())
+	s.mutex.Unlock()
+
+	if exists("expired") || len(s.entries) != 3 || s.memory != 30 {
+		t.Errorf("cleanup: got %v, memory %d", slices.Sorted(maps.Keys(s.entries)), s.memory)
+	}
+}
+
+func TestCacheRequestKey(t *testing.T) {
+	key := func(url string) string {
+		r, _ := http.NewRequest(http.MethodGet, url, nil)
+		proc := &ProcOptions{R: r, Info: &Info{}}
+		return proc.cacheKey()
+	}
+
+	if key("/api/test?b=2&a=1") != key("/api/test?a=1&b=2") {
+		t.Errorf("query parameters order changes the key")
+	}
+
+	if key("/api/test?id=1") == key("/api/test?id=01") {
+		t.Errorf("different query values give the same key")
+	}
+
+	if key("/api/test/1") == key("/api/test/2") || key("/api/test") == key("/api/test?a=") {
+		t.Errorf("different requests give the same key")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestCacheKey(t *testing.T) {
+	newProc := func(user string, groups []string, lang string) *ProcOptions {
+		r, _ := http.NewRequest(http.MethodGet, "/api/test?b=2&a=1", nil)
+		r.Header.Set("X-Tenant", "t1")
+		proc := &ProcOptions{
+			R:            r,
+			Info:         &Info{},
+			AuthIdentity: &auth.Identity{User: user, Groups: groups},
+			Locale:       lang,
+		}
+		proc.ChainLocal.CacheVary = []string{path.CacheVaryGroups, path.CacheVaryLocale, "x-tenant"}
+		return proc
+	}
+
+	p1 := newProc("u1", []string{"b", "a"}, "en")
+	p2 := newProc("u2", []string{"a", "b"}, "en")
+	p3 := newProc("u1", []string{"a", "b"}, "ru")
+
+	k1, k2, k3 := p1.cacheKey(), p2.cacheKey(), p3.cacheKey()
+	if k1 != k2 {
+		t.Errorf("keys for the same groups differ: %q != %q", k1, k2)
+	}
+	if k1 == k3 {
+		t.Errorf("keys for different locales are equal: %q", k1)
+	}
+
+	expected := "Authorization, Cookie, X-Tenant"
+	if v := p1.ExtraHeaders[HTTPheaderVary]; v != expected {
+		t.Errorf(`got Vary "%s", expected "%s"`, v, expected)
+	}
+
+	// Функция ключа цепочки, модуля - только если у цепочки нет своей
+	p1.Info.CacheKey = func(proc *ProcOptions) string { return "module" }
+	if k := p1.cacheKey(); !strings.HasSuffix(k, "\nmodule") {
+		t.Errorf("module CacheKey is not used: %q", k)
+	}
+
+	p1.ChainLocal.CacheKey = func(proc *ProcOptions) string { return "chain:" + proc.AuthIdentity.User }
+	if k := p1.cacheKey(); !strings.HasSuffix(k, "\nchain:u1") {
+		t.Errorf("chain CacheKey is not used: %q", k)
+	}
+
+	info := &Info{
+		Methods: &path.Set{
+			Methods: path.Methods{
+				stdhttp.MethodGET: {Chains: path.ChainsList{{Name: "all", CacheKey: FuncCacheKey(func(proc *ProcOptions) string { return "" })}}},
+			},
+		},
+	}
+	if err := info.checkCacheKeys(); err != nil {
+		t.Errorf("checkCacheKeys: %s", err)
+	}
+
+	info.Methods.Methods[stdhttp.MethodGET].Chains[0].CacheKey = func() string { return "" }
+	if err := info.checkCacheKeys(); err == nil {
+		t.Errorf("checkCacheKeys: error expected for %T", info.Methods.Methods[stdhttp.MethodGET].Chains[0].CacheKey)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestCacheCoalescing(t *testing.T) {
+	s := newCacheStore()
+	now := misc.NowUTC()
+
+	_, fill := s.get("k")
+	if fill == nil {
+		t.Fatal("fill expected")
+	}
+
+	got := make(chan *cacheEntry)
+	go func() {
+		e, f := s.get("k")
+		if f != nil {
+			t.Error("unexpected fill for the waiting request")
+		}
+		got <- e
+	}()
+
+	entry := &cacheEntry{key: "k", created: now, expires: now.Add(time.Hour), staleUntil: now.Add(time.Hour)}
+	fill.commit(entry, false)
+
+	if e := <-got; e != entry {
+		t.Errorf("waiting request got %p, expected %p", e, entry)
+	}
+
+	s.mutex.Lock()
+	entry.expires = now.Add(-time.Second)
+	s.mutex.Unlock()
+
+	// Протухшая запись отдается, для первого запроса - с fill для обновления, для остальных - без
+	e, f := s.get("k")
+	if e != entry || f == nil {
+		t.Fatalf("got %p %p, expected stale entry and fill", e, f)
+	}
+
+	e, f2 := s.get("k")
+	if e != entry || f2 != nil {
+		t.Errorf("got %p %p, expected stale entry only", e, f2)
+	}
+
+	f.commit(nil, true)
+	f.commit(nil, true)
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestHTTPCache(t *testing.T) {
+	chain := &path.Chain{
+		CacheLifetime: config.Duration(time.Minute),
+	}
+	if cc := cacheControlValue(chain); cc != "max-age=60" {
+		t.Errorf(`got "%s"`, cc)
+	}
+
+	chain.HTTPCache = &path.HTTPCachePolicy{SMaxAge: config.Duration(time.Hour)}
+	chain.CacheStaleIfError = config.Duration(time.Second)
+	if cc := cacheControlValue(chain); cc != "public, max-age=60, s-maxage=3600, stale-if-error=1" {
+		t.Errorf(`got "%s"`, cc)
+	}
+
+	chain.HTTPCache.NoStore = true
+	if cc := cacheControlValue(chain); cc != "no-store" {
+		t.Errorf(`got "%s"`, cc)
+	}
+
+	type rec struct {
+		ID       uint64
+		Modified *time.Time `role:"modified"`
+	}
+
+	t1 := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	result := &[]rec{{ID: 1, Modified: &t2}, {ID: 2, Modified: &t1}, {ID: 3}}
+
+	if tm := lastModified(result); !tm.Equal(t2) {
+		t.Errorf("got %s, expected %s", tm, t2)
+	}
+
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(HTTPheaderIfModifiedSince, t2.Format(http.TimeFormat))
+	proc := &ProcOptions{R: r, Chain: chain}
+
+	if !proc.httpCache(result) {
+		t.Errorf("not modified expected")
+	}
+
+	if v := proc.ExtraHeaders[HTTPheaderLastModified]; v != t2.Format(http.TimeFormat) {
+		t.Errorf(`got Last-Modified "%s"`, v)
+	}
+
+	r.Header.Set(HTTPheaderIfModifiedSince, t1.Format(http.TimeFormat))
+	if proc.httpCache(result) {
+		t.Errorf("modified expected")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestCacheStats(t *testing.T) {
+	s := newCacheStore()
+	now := misc.NowUTC()
+
+	for i, scope := range []string{"select.all", "select.id", "select.id"} {
+		key := fmt.Sprintf("k%d", i)
+		e, fill := s.get(key)
+		s.count("/m", "c", e, now)
+		fill.commit(&cacheEntry{key: key, module: "/m", chain: "c", scope: scope, size: 10, expires: now.Add(time.Hour)}, false)
+	}
+
+	e, _ := s.get("k0")
+	s.count("/m", "c", e, now)
+
+	stats := s.stats()
+	if len(stats) != 1 {
+		t.Fatalf("got %d stats, expected 1", len(stats))
+	}
+
+	st := stats[0]
+	if st.Entries != 3 || st.Hits != 1 || st.Misses != 3 || st.Memory != 30 {
+		t.Errorf("got %#v", st)
+	}
+
+	if n := s.purge(func(e *cacheEntry) bool { return e.scope == "select.id" }); n != 2 {
+		t.Errorf("got %d removed, expected 2", n)
+	}
+
+	if size := approxSize(reflect.ValueOf("12345"), 0); size != int64(reflect.TypeFor[string]().Size())+5 {
+		t.Errorf("got size %d", size)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestUpsertConflict(t *testing.T) {
+	proc := &ProcOptions{}
+	req := &proc.ChainLocal.Params.Request
+	req.UniqueKeyFields = []string{"id", "code"}
+	req.FlatModel = misc.StringMap{"code": "code_db", "name": "name_db"} // id - readonly
+	proc.Fields = []misc.InterfaceMap{
+		{"code_db": "a", "name_db": "A"},
+		{"name_db": "B"},
+	}
+
+	res := NewExecResult()
+	res.AddRow(NewExecResultRow())
+	res.AddRow(NewExecResultRow())
+
+	conflict, ok := proc.checkConflictFields(res)
+	if ok {
+		t.Errorf("missing key not detected")
+	}
+	if len(conflict) != 1 || conflict[0] != "code_db" {
+		t.Errorf("got %v", conflict)
+	}
+
+	proc.addUpsertVars(conflict, []string{"code_db", "name_db"}, nil, res)
+	if v := FindSubstArg(proc.DBqueryVars, SubstUpsertSet); v == nil {
+		t.Errorf("%s not found", SubstUpsertSet)
+	}
+}
+
+func TestUpsertKeepsOmitted(t *testing.T) {
+	type rec struct {
+		ID   uint64 `json:"id" db:"id" readonly:"true"`
+		Code string `json:"code" db:"code"`
+		Name string `json:"name" db:"name"`
+		Note string `json:"note" db:"note"`
+	}
+
+	proc := &ProcOptions{}
+
+	p := &proc.ChainLocal.Params
+	p.Request.Type = reflect.TypeFor[rec]()
+	p.Request.UniqueKeyFields = []string{"code"}
+	p.Request.RequiredFields = misc.StringMap{}
+	p.Request.ReadonlyFields = misc.StringMap{}
+	p.Request.AuditFields = path.AuditFields{}
+
+	err := p.MakeTypeFlatModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// note не передан ни в одной записи, name - только в первой
+	proc.RawBody = []byte(`[{"code": "a", "name": "A"}, {"code": "b"}]`)
+
+	res := NewExecResult()
+	blanked, err := proc.prepareFields(res, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slices.Sort(blanked)
+	if !slices.Equal(blanked, []string{"name", "note"}) {
+		t.Fatalf("blanked: got %v", blanked)
+	}
+
+	// Для вставки новых записей пропущенные поля заполнены
+	for i, fields := range proc.Fields {
+		if _, exists := fields["note"]; !exists {
+			t.Errorf("[%d] note is not filled", i)
+		}
+	}
+
+	conflict, ok := proc.checkConflictFields(res)
+	if !ok {
+		t.Fatalf("%v", res.Rows)
+	}
+
+	// Существующие записи сохраняют пропущенные поля, обновлять нечего - ключ присваивается сам себе
+	set := proc.upsertSet(conflict, []string{"code", "name", "note"}, blanked, res)
+	if !slices.Equal(set, []string{"code=EXCLUDED.code"}) {
+		t.Errorf("set: got %v, expected no-op", set)
+	}
+
+	if len(res.Rows[0].Messages) != 1 || len(res.Rows[1].Messages) != 0 {
+		t.Errorf("messages: got %v, %v", res.Rows[0].Messages, res.Rows[1].Messages)
+	}
+
+	set = proc.upsertSet(conflict, []string{"code", "name", "note"}, []string{"note"}, NewExecResult())
+	if !slices.Equal(set, []string{"name=EXCLUDED.name"}) {
+		t.Errorf("set: got %v", set)
+	}
+
+	// Переданы только ключи
+	proc.RawBody = []byte(`[{"code": "a"}, {"code": "b"}]`)
+
+	res = NewExecResult()
+	blanked, err = proc.prepareFields(res, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set = proc.upsertSet(conflict, []string{"code", "name", "note"}, blanked, res)
+	if !slices.Equal(set, []string{"code=EXCLUDED.code"}) {
+		t.Errorf("keys only: got %v", set)
+	}
+
+	for i, r := range res.Rows {
+		if len(r.Messages) != 0 {
+			t.Errorf("keys only [%d]: got messages %v", i, r.Messages)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestBulkKeys(t *testing.T) {
+	keys, err := parseBulkKeys(ScopeDeleteIDs, " 1,2, 2,3 ", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []any{uint64(1), uint64(2), uint64(3)}) {
+		t.Errorf("query: got %v", keys)
+	}
+
+	keys, err = parseBulkKeys(ScopeDeleteIDs, "", []byte(`{"ids": [5, "6"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []any{uint64(5), uint64(6)}) {
+		t.Errorf("body: got %v", keys)
+	}
+
+	keys, err = parseBulkKeys(ScopeUpdateGUIDs, "", []byte(`["a-b", "c-d"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []any{"a-b", "c-d"}) {
+		t.Errorf("guids: got %v", keys)
+	}
+
+	for _, q := range []string{"", "1,x", "0"} {
+		if _, err = parseBulkKeys(ScopeDeleteIDs, q, nil); err == nil {
+			t.Errorf(`"%s": error expected`, q)
+		}
+	}
+
+	// Частичный успех - откат и 207
+
+	er := NewExecResult()
+	er.AddRow(&ExecResultRow{Code: http.StatusOK, ID: 1})
+	er.AddRow(&ExecResultRow{Code: http.StatusNotFound, ID: 2})
+	er.rollbackMark()
+
+	var result any
+	code := 0
+	err = nil
+	er.MultiDefer(&result, &code, &err)
+
+	if code != http.StatusMultiStatus || er.Rows[0].Code != http.StatusFailedDependency || er.FailedRows != 2 {
+		t.Errorf("got code %d, rows %d/%d, failed %d", code, er.Rows[0].Code, er.Rows[1].Code, er.FailedRows)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestSoftDelete(t *testing.T) {
+	type rec struct {
+		ID      uint64 `json:"id" db:"id"`
+		Deleted bool   `json:"deleted" db:"is_deleted" role:"deleted"`
+	}
+	type recT struct {
+		ID        uint64     `json:"id" db:"id"`
+		DeletedAt *time.Time `json:"deletedAt" db:"deleted_at" role:"deleted"`
+	}
+
+	df := lookupDeletedField(reflect.TypeFor[[]*rec]())
+	if df == nil || df.dbName != "is_deleted" || df.isTime {
+		t.Fatalf("bool: got %#v", df)
+	}
+	if s := df.filter(false); s != "is_deleted IS NOT TRUE" {
+		t.Errorf("bool filter: got %s", s)
+	}
+	if v := df.value(true); v != true {
+		t.Errorf("bool value: got %v", v)
+	}
+
+	df = lookupDeletedField(reflect.TypeFor[recT]())
+	if df == nil || df.dbName != "deleted_at" || !df.isTime {
+		t.Fatalf("time: got %#v", df)
+	}
+	if s := df.filter(false); s != "deleted_at IS NULL" {
+		t.Errorf("time filter: got %s", s)
+	}
+	if s := df.filter(true); s != "TRUE" {
+		t.Errorf("include filter: got %s", s)
+	}
+	if v := df.value(false); v != nil {
+		t.Errorf("time restore value: got %v", v)
+	}
+
+	proc := &ProcOptions{
+		Info: &Info{},
+	}
+
+	for _, c := range []struct {
+		query   string
+		admin   bool
+		include bool
+		code    int
+	}{
+		{"", false, false, 0},
+		{ParamIncludeDeleted + "=true", true, true, 0},
+		{ParamIncludeDeleted + "=true", false, false, http.StatusForbidden},
+		{ParamIncludeDeleted + "=false", false, false, 0},
+		{ParamIncludeDeleted + "=zzz", true, false, http.StatusBadRequest},
+	} {
+		proc.R, _ = http.NewRequest(http.MethodGet, "/x?"+c.query, nil)
+		proc.AuthIdentity = &auth.Identity{IsAdmin: c.admin}
+
+		include, code, _ := proc.includeDeleted()
+		if include != c.include || code != c.code {
+			t.Errorf(`"%s" (admin %v): got %v/%d, expected %v/%d`, c.query, c.admin, include, code, c.include, c.code)
+		}
+	}
+}
+
+func TestDeletedFilterCheck(t *testing.T) {
+	defer func(f func(string, string) (string, bool)) { QueryText = f }(QueryText)
+
+	queries := map[string]string{
+		"x.select.id":  "SELECT @FIELDS@ FROM x WHERE @DELETED_FILTER@ AND id=$1",
+		"x.select.all": "SELECT @FIELDS@ FROM x",
+	}
+
+	info := &Info{
+		DBtype:      "main",
+		QueryPrefix: "x.",
+		Methods: &path.Set{
+			Methods: path.Methods{
+				stdhttp.MethodGET: &path.Chains{
+					Chains: path.ChainsList{{Scope: "select.id"}},
+				},
+			},
+		},
+		deletedField: &deletedField{dbName: "is_deleted"},
+	}
+
+	// Без QueryText проверка пропускается с предупреждением
+	QueryText = nil
+	if err := info.checkDeletedFilter(); err != nil {
+		t.Errorf("QueryText is not defined: %s", err)
+	}
+
+	QueryText = func(dbType string, name string) (text string, exists bool) {
+		text, exists = queries[name]
+		return
+	}
+
+	if err := info.checkDeletedFilter(); err != nil {
+		t.Error(err)
+	}
+
+	for _, scope := range []string{"select.all", "select.guid"} {
+		info.Methods.Methods[stdhttp.MethodGET].Chains = path.ChainsList{{Scope: scope}}
+		if err := info.checkDeletedFilter(); err == nil {
+			t.Errorf("%s: error expected", scope)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestAuditFields(t *testing.T) {
+	type rec struct {
+		ID        uint64    `json:"id" db:"id" role:"primary"`
+		Name      string    `json:"name" db:"name"`
+		CreatedAt time.Time `json:"createdAt" db:"created_at" role:"createdAt"`
+		UpdatedAt time.Time `json:"updatedAt" db:"updated_at" role:"updatedAt"`
+		CreatedBy uint64    `json:"createdBy" db:"created_by" role:"createdBy"`
+		UpdatedBy string    `json:"updatedBy" db:"updated_by" role:"updatedBy"`
+	}
+
+	proc := &ProcOptions{
+		AuthIdentity: &auth.Identity{User: "john", UserID: 42},
+	}
+
+	p := &proc.ChainLocal.Params
+	p.Request.Type = reflect.TypeFor[rec]()
+	p.Request.UniqueKeyFields = make([]string, 1)
+	p.Request.RequiredFields = misc.StringMap{}
+	p.Request.ReadonlyFields = misc.StringMap{}
+	p.Request.AuditFields = path.AuditFields{}
+
+	err := p.MakeTypeFlatModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(p.Request.AuditFields) != 4 || len(p.Request.ReadonlyFields) != 4 {
+		t.Fatalf("got audit %d, readonly %d", len(p.Request.AuditFields), len(p.Request.ReadonlyFields))
+	}
+
+	// Клиент не может задать поля аудита
+	fields, _, err := p.ExtractFieldsFromBody([]byte(`[{"name": "x", "createdBy": 1, "updatedAt": "2000-01-01T00:00:00Z"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proc.Fields = fields
+	proc.fillAuditFields(false)
+
+	f := proc.Fields[0]
+	if _, exists := f["created_at"]; exists {
+		t.Errorf("update: created_at filled")
+	}
+	if _, exists := f["created_by"]; exists {
+		t.Errorf("update: created_by filled")
+	}
+	if v, _ := f["updated_at"].(time.Time); v.Year() < 2020 {
+		t.Errorf("update: updated_at = %v", f["updated_at"])
+	}
+	if f["updated_by"] != "john" {
+		t.Errorf("update: updated_by = %v", f["updated_by"])
+	}
+
+	proc.fillAuditFields(true)
+	if f["created_by"] != uint64(42) || f["created_at"] == nil {
+		t.Errorf("create: created_by = %v, created_at = %v", f["created_by"], f["created_at"])
+	}
+
+	// Мягкое удаление: у цепочки нет модели запроса, поля аудита - из update цепочек
+	sd := &ProcOptions{
+		AuthIdentity: proc.AuthIdentity,
+		Info:         &Info{deletedField: &deletedField{dbName: "is_deleted", auditFields: p.Request.AuditFields}},
+	}
+
+	sd.softDeleteFields(true)
+	startIdx, names := sd.softDeleteVars()
+	if startIdx != 1 || !slices.Equal(names, []string{"is_deleted", "updated_at", "updated_by"}) {
+		t.Fatalf("soft delete: got %d, %v", startIdx, names)
+	}
+
+	vals := sd.DBqueryVars[len(sd.DBqueryVars)-1].([][]any)[0]
+	if vals[0] != true || vals[2] != "john" {
+		t.Errorf("soft delete: got %v", vals)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestNestedModule(t *testing.T) {
+	type pathParams struct {
+		ParentID uint64 `json:"parentID"`
+		ID       uint64 `json:"id"`
+	}
+
+	set := &path.Set{
+		Methods: path.Methods{
+			http.MethodGet: {
+				StdParams: path.Params{
+					PathParamsPattern: pathParams{},
+				},
+				Chains: path.ChainsList{
+					{
+						Name:   "all",
+						Tokens: []*path.Token{{Expr: "", VarName: path.VarIgnore}},
+					},
+					{
+						Name:   "byID",
+						Tokens: []*path.Token{{Expr: REid, VarName: path.VarID}},
+					},
+				},
+			},
+		},
+	}
+
+	link := &Parent{Module: "/customers"}
+	parent := &Module{RawURL: "/customers", Info: &Info{Path: "/customers", QueryPrefix: "customers."}}
+	info := &Info{Path: "/orders", Parent: link, Methods: set}
+
+	err := link.prepare(info, parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if link.Name != "orders" || link.KeyVar != DefaultParentKeyVar || link.ExistsQuery != "customers."+ScopeExistsID {
+		t.Fatalf("got %#v", link)
+	}
+
+	err = set.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		tail  []string
+		chain string
+		pp    pathParams
+	}{
+		{[]string{"5", "orders"}, "all", pathParams{ParentID: 5}},
+		{[]string{"5", "orders", "7"}, "byID", pathParams{ParentID: 5, ID: 7}},
+		{[]string{"x", "orders"}, "", pathParams{}},
+		{[]string{"5", "items"}, "", pathParams{}},
+	} {
+		chain, pp, _, _, _ := set.Find(http.MethodGet, c.tail)
+		if c.chain == "" {
+			if chain != nil {
+				t.Errorf("%v: unexpected chain %s", c.tail, chain.Name)
+			}
+			continue
+		}
+
+		if chain == nil || chain.Name != c.chain {
+			t.Errorf("%v: chain %s expected, got %v", c.tail, c.chain, chain)
+			continue
+		}
+
+		if got := *pp.(*pathParams); got != c.pp {
+			t.Errorf("%v: got %#v, expected %#v", c.tail, got, c.pp)
+		}
+	}
+
+	child := &Module{Info: info, parent: parent}
+
+	modulesMutex.Lock()
+	parent.children = map[string]*Module{"orders": child}
+	modules[parent.RawURL] = parent
+	rebuildRoutes()
+	modulesMutex.Unlock()
+
+	defer func() {
+		modulesMutex.Lock()
+		delete(modules, parent.RawURL)
+		rebuildRoutes()
+		modulesMutex.Unlock()
+	}()
+
+	if parent.findChild([]string{"5", "orders", "7"}) != child || parent.findChild([]string{"5"}) != nil || parent.findChild([]string{"5", "items"}) != nil {
+		t.Errorf("findChild failed")
+	}
+
+	key, err := link.parseKey("5")
+	if err != nil || key != uint64(5) {
+		t.Errorf("parseKey: got %v, %v", key, err)
+	}
+
+	// Без базы родителя проверить нельзя - это ошибка, а не пропуск проверки
+	proc := &ProcOptions{Info: info, ParentKey: key}
+	code, err := proc.checkParent()
+	if err == nil || code != http.StatusInternalServerError {
+		t.Errorf("checkParent without database: got %d, %v", code, err)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Прежний поиск модуля последовательным отбрасыванием элементов пути - для сравнения
+func findModuleLinear(path string) (module *Module, basePath string, extraPath []string, found bool) {
+	p := path
+	n := 0
+
+	for {
+		modulesMutex.RLock()
+		module, found = modules[p]
+		modulesMutex.RUnlock()
+
+		if found {
+			basePath = p
+			if n > 0 {
+				tail := path[len(p)+1:]
+
+				extraPath = strings.Split(strings.Trim(tail, "/"), "/")
+				if len(extraPath) == 1 && extraPath[0] == "" {
+					extraPath = []string{}
+				} else {
+					for i, p := range extraPath {
+						extraPath[i], _ = url.PathUnescape(p)
+					}
+				}
+			}
+
+			return
+		}
+
+		i := strings.LastIndexByte(p, '/')
+		if i < 0 {
+			return
+		}
+
+		p = p[:i]
+		if p == "" {
+			return
+		}
+		n++
+	}
+}
+
+func withTestModules(n int) (cleanup func()) {
+	modulesMutex.Lock()
+	defer modulesMutex.Unlock()
+
+	saved := modules
+	modules = make(map[string]*Module, n+2)
+
+	for i := range n {
+		u := fmt.Sprintf("/api/v%d/module%d", i%3, i)
+		modules[u] = &Module{RawURL: u}
+	}
+
+	modules["/"] = &Module{RawURL: "/"}
+	modules["/api/v1/module1/sub"] = &Module{RawURL: "/api/v1/module1/sub"}
+
+	rebuildRoutes()
+
+	return func() {
+		modulesMutex.Lock()
+		modules = saved
+		rebuildRoutes()
+		modulesMutex.Unlock()
+	}
+}
+
+var testModulePaths = []string{
+	"/api/v1/module1",
+	"/api/v1/module1/",
+	"/api/v1/module1/5",
+	"/api/v1/module1/sub",
+	"/api/v1/module1/sub/5/x%20y",
+	"/api/v1/module1/subx",
+	"/api/v2/module299/a/b/c",
+	"/api/v0/module299",
+	"/api/v1/module1000",
+	"/",
+	"/x",
+	"//",
+	"",
+	"api/v1/module1",
+}
+
+func TestFindModule(t *testing.T) {
+	defer withTestModules(300)()
+
+	for _, p := range testModulePaths {
+		m1, base1, tail1, found1 := findModule(p)
+		m2, base2, tail2, found2 := findModuleLinear(p)
+
+		if m1 != m2 || base1 != base2 || !reflect.DeepEqual(tail1, tail2) || found1 != found2 {
+			t.Errorf(`"%s": got (%v, "%s", %#v, %v), expected (%v, "%s", %#v, %v)`, p, m1, base1, tail1, found1, m2, base2, tail2, found2)
+		}
+	}
+}
+
+func BenchmarkFindModule(b *testing.B) {
+	defer withTestModules(300)()
+
+	b.ResetTimer()
+	for i := range b.N {
+		findModule(testModulePaths[i%len(testModulePaths)])
+	}
+}
+
+func BenchmarkFindModuleLinear(b *testing.B) {
+	defer withTestModules(300)()
+
+	b.ResetTimer()
+	for i := range b.N {
+		findModuleLinear(testModulePaths[i%len(testModulePaths)])
+	}
+}
+
+func BenchmarkFindModuleParallel(b *testing.B) {
+	defer withTestModules(300)()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			findModule(testModulePaths[i%len(testModulePaths)])
+			i++
+		}
+	})
+}
+
+func BenchmarkFindModuleLinearParallel(b *testing.B) {
+	defer withTestModules(300)()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			findModuleLinear(testModulePaths[i%len(testModulePaths)])
+			i++
+		}
+	})
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestModuleShadowing(t *testing.T) {
+	type pathParams struct {
+		ID uint64
+	}
+
+	set := func(expr string) *path.Set {
+		s := &path.Set{
+			Methods: path.Methods{
+				http.MethodGet: {
+					StdParams: path.Params{PathParamsPattern: pathParams{}},
+					Chains:    path.ChainsList{{Name: "x", Tokens: []*path.Token{{Expr: expr, VarName: path.VarIgnore}}}},
+				},
+			},
+		}
+		if err := s.Prepare(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	defer withTestModules(0)()
+
+	modulesMutex.Lock()
+	defer modulesMutex.Unlock()
+
+	modules["/api/users"] = &Module{Info: &Info{Methods: set(`[a-z]+`)}}
+
+	if r := moduleShadowing("/api/users/admin", &Info{Methods: set(`\d+`)}); len(r) != 1 {
+		t.Errorf("inner: got %v", r)
+	}
+	if r := moduleShadowing("/api/users/42", &Info{Methods: set(`\d+`)}); len(r) != 0 {
+		t.Errorf("inner, not shadowed: got %v", r)
+	}
+	if r := moduleShadowing("/api", &Info{Methods: set(`users|groups`)}); len(r) != 1 || r[0] != "paths /api/... of the module are shadowed by module /api/users" {
+		t.Errorf("outer: got %v", r)
+	}
+
+	delete(modules, "/api/users")
+}
+
+func TestStrictRoutingStdChains(t *testing.T) {
+	type pathParams struct {
+		ID   uint64
+		GUID string
+		Name string
+	}
+
+	all := &path.Chain{Name: "all", Tokens: []*path.Token{{Expr: "", VarName: path.VarIgnore}}}
+	byID := &path.Chain{Name: "byID", Tokens: []*path.Token{{Expr: REid, VarName: "ID"}}}
+	byGUID := &path.Chain{Name: "byGUID", Tokens: []*path.Token{{Expr: REguid, VarName: "GUID"}}}
+	byName := &path.Chain{Name: "byName", Tokens: []*path.Token{{Expr: REname, VarName: "Name"}}}
+
+	set := func(chains ...*path.Chain) *path.Set {
+		s := &path.Set{
+			Methods: path.Methods{
+				http.MethodGet: {
+					StdParams: path.Params{PathParamsPattern: pathParams{}},
+					Chains:    path.ChainsList(chains).Clone(),
+				},
+			},
+		}
+		if err := s.Prepare(); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	defer func(v bool) { StrictRouting = v }(StrictRouting)
+	StrictRouting = true
+
+	defer withTestModules(0)()
+
+	modulesMutex.Lock()
+	defer modulesMutex.Unlock()
+
+	if err := checkRoutes("/api/users", &Info{Methods: set(all, byID, byGUID, byName)}); err != nil {
+		t.Error(err)
+	}
+
+	// Общая цепочка раньше частной - конфликт
+	if err := checkRoutes("/api/users", &Info{Methods: set(all, byName, byID)}); err == nil {
+		t.Errorf("byName before byID: error expected")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func chainString(chain *path.Chain) string {
+	s := make([]string, len(chain.Tokens))
+	for i, token := range chain.Tokens {
+		s[i] = fmt.Sprintf("%s:%s:%d", token.VarName, token.Expr, token.Flags)
+	}
+	return fmt.Sprintf("%d %v", chain.Flags, s)
+}
+
+func TestParseChain(t *testing.T) {
+	type testCase struct {
+		template string
+		expected *path.Chain
+	}
+
+	cases := []testCase{
+		{"", &path.Chain{Tokens: []*path.Token{{Expr: REempty, VarName: path.VarIgnore}}}},
+		{"/", &path.Chain{Tokens: []*path.Token{{Expr: REempty, VarName: path.VarIgnore}}}},
+		{"/{id}", &path.Chain{Tokens: []*path.Token{{Expr: REid, VarName: path.VarID}}}},
+		{"/{guid}", &path.Chain{Tokens: []*path.Token{{Expr: REguid, VarName: path.VarGUID}}}},
+		{"/{status}/{code}", &path.Chain{Tokens: []*path.Token{{Expr: REstatus, VarName: path.VarStatus}, {Expr: REname, VarName: "Code"}}}},
+		{
+			`/{id:\d+}/items/{guid:guid}/*`,
+			&path.Chain{
+				Flags: path.FlagChainEnableTail,
+				Tokens: []*path.Token{
+					{Expr: `\d+`, VarName: path.VarID},
+					{Expr: "items", VarName: path.VarIgnore},
+					{Expr: REguid, VarName: path.VarGUID},
+				},
+			},
+		},
+		{
+			`/{id:\d+}/files/*tail`,
+			&path.Chain{
+				Tokens: []*path.Token{
+					{Expr: `\d+`, VarName: path.VarID},
+					{Expr: "files", VarName: path.VarIgnore},
+					{Expr: REname, VarName: "Tail", Flags: path.FlagTokenTail},
+				},
+			},
+		},
+		{`/*path:[a-z.]+`, &path.Chain{Tokens: []*path.Token{{Expr: `[a-z.]+`, VarName: "Path", Flags: path.FlagTokenTail}}}},
+		{`/v1.0/{_:a|b}/{n:\d{2,3}}/{text:any}`, &path.Chain{Tokens: []*path.Token{
+			{Expr: `v1\.0`, VarName: path.VarIgnore},
+			{Expr: "a|b", VarName: path.VarIgnore},
+			{Expr: `\d{2,3}`, VarName: "N"},
+			{Expr: REany, VarName: "Text"},
+		}}},
+	}
+
+	for i, c := range cases {
+		chain, err := ParseChain(c.template)
+		if err != nil {
+			t.Errorf("[%d] %s", i, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(chain, c.expected) {
+			t.Errorf("[%d] %s: got %s, expected %s", i, c.template, chainString(chain), chainString(c.expected))
+		}
+	}
+
+	illegal := []string{
+		"/a//b",
+		"/{id",
+		"/id}",
+		"/x{id}",
+		"/{}",
+		"/{id:}",
+		"/{id:[}",
+		"/*/a",
+		"/*",
+		"/*tail/a",
+		"/*:x",
+	}
+
+	for i, template := range illegal {
+		_, err := ParseChain(template)
+		if err == nil {
+			t.Errorf(`[%d] "%s": error expected, but not found`, i, template)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestVersions(t *testing.T) {
+	savedBase := base
+	base = "/api"
+	defer func() { base = savedBase }()
+
+	for _, c := range []struct {
+		path     string
+		version  string
+		expected string
+	}{
+		{"users", "", "/api/users"},
+		{"users", "v2", "/api/v2/users"},
+		{"/abs/users", "", "/abs/users"},
+		{"/abs/users", "v2", "/v2/abs/users"},
+		{"/", "v1", "/api/v1"},
+	} {
+		url, _ := moduleURL(c.path, c.version)
+		if url != c.expected {
+			t.Errorf(`moduleURL("%s", "%s"): got "%s", expected "%s"`, c.path, c.version, url, c.expected)
+		}
+	}
+
+	src := &Info{Path: "users", Tags: []string{"users"}, Methods: &path.Set{Methods: path.Methods{}}}
+	info := src.clone()
+	info.Tags[0] = "changed"
+	info.Methods.Methods[http.MethodGet] = &path.Chains{}
+	if src.Tags[0] != "users" || len(src.Methods.Methods) != 0 {
+		t.Fatalf("clone shares data with the source")
+	}
+
+	v1 := &Module{RawURL: "/api/v1/users", Info: &Info{Version: "v1"}}
+	v2 := &Module{RawURL: "/api/v2/users", Info: &Info{Version: "v2"}}
+	alias := &Module{
+		RawURL:   "/api/users",
+		Info:     v1.Info,
+		versions: map[string]*Module{versionKey("v1"): v1, versionKey("v2"): v2},
+	}
+
+	for i, c := range []struct {
+		header   http.Header
+		expected *Module
+	}{
+		{http.Header{}, v1},
+		{http.Header{http.CanonicalHeaderKey(VersionHeader): {"v2"}}, v2},
+		{http.Header{http.CanonicalHeaderKey(VersionHeader): {"V2"}}, v2},
+		{http.Header{"Accept": {"application/json; version=2"}}, v2},
+		{http.Header{"Accept": {"text/csv; version=1;q=0.5, application/json; version=2"}}, v2},
+		{http.Header{http.CanonicalHeaderKey(VersionHeader): {"1"}, "Accept": {"application/json; version=2"}}, v1},
+		{http.Header{http.CanonicalHeaderKey(VersionHeader): {"v3"}}, nil},
+	} {
+		r := &http.Request{Header: c.header}
+		selected, err := alias.selectVersion(r)
+
+		if c.expected == nil {
+			if err == nil {
+				t.Errorf("[%d] error expected, but not found", i)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("[%d] %s", i, err)
+			continue
+		}
+
+		if selected != c.expected {
+			t.Errorf(`[%d] got "%s", expected "%s"`, i, selected.RawURL, c.expected.RawURL)
+		}
+	}
+
+	if m, _ := v1.selectVersion(&http.Request{Header: http.Header{http.CanonicalHeaderKey(VersionHeader): {"v2"}}}); m != v1 {
+		t.Errorf("a module with a version in the path must not be switched")
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestDeprecation(t *testing.T) {
+	sunset := time.Date(2027, 1, 31, 0, 0, 0, 0, time.UTC)
+	since := time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	chains := &path.Chains{DeprecatedAt: since, Sunset: sunset}
+	chain := &path.Chain{Name: "old", Parent: chains, Deprecated: true, Replacement: "/api/v2/users"}
+	info := &Info{Replacement: "/api/v2"}
+
+	d := ResolveDeprecation(info, chain)
+	if !d.Deprecated || !d.DeprecatedAt.Equal(since) || !d.Sunset.Equal(sunset) || d.Replacement != "/api/v2/users" {
+		t.Fatalf("got %#v", d)
+	}
+
+	if d = ResolveDeprecation(info, &path.Chain{DeprecatedAt: since}); !d.Deprecated {
+		t.Fatalf("DeprecatedAt doesn't make deprecated: %#v", d)
+	}
+
+	d = ResolveDeprecation(info, nil)
+	if d.Deprecated || d.Replacement != "/api/v2" {
+		t.Fatalf("got %#v", d)
+	}
+
+	if ResolveDeprecation(&Info{}, &path.Chain{}).Active() {
+		t.Fatalf("nothing is expected")
+	}
+
+	// Без даты - предупреждение и Deprecation: true
+	check := &Info{
+		Methods: &path.Set{
+			Methods: path.Methods{
+				stdhttp.MethodGET: {Chains: path.ChainsList{{Name: "old", Deprecated: true}}},
+			},
+		},
+	}
+	if u := check.undatedDeprecation(); !slices.Equal(u, []string{`deprecated GET chain "old"`}) {
+		t.Errorf("undated: got %q", u)
+	}
+
+	w := httptest.NewRecorder()
+	proc := &ProcOptions{
+		Info:        check,
+		Chain:       check.Methods.Methods[stdhttp.MethodGET].Chains[0],
+		LogFacility: Log,
+		R:           httptest.NewRequest(http.MethodGet, "/api/old", nil),
+		W:           w,
+	}
+	proc.deprecation()
+	if v := w.Header().Get(HTTPheaderDeprecation); v != "true" {
+		t.Errorf("undated: got Deprecation: %q", v)
+	}
+	if v := DeprecationOutHeaders(check, check.Methods.Methods[stdhttp.MethodGET].Chains[0])[HTTPheaderDeprecation]; !strings.Contains(v, "(true)") {
+		t.Errorf("undated: got OpenAPI header %q", v)
+	}
+
+	check.Methods.Methods[stdhttp.MethodGET].DeprecatedAt = since
+	check.Methods.Methods[stdhttp.MethodGET].Chains[0].Parent = check.Methods.Methods[stdhttp.MethodGET]
+	if u := check.undatedDeprecation(); len(u) != 0 {
+		t.Errorf("undated: got %q", u)
+	}
+
+	check.Deprecated = true
+	if u := check.undatedDeprecation(); !slices.Equal(u, []string{"deprecated module"}) {
+		t.Errorf("undated: got %q", u)
+	}
+
+	DeprecatedUsageReset()
+
+	for range 3 {
+		w := httptest.NewRecorder()
+		proc := &ProcOptions{
+			Info:        info,
+			Chain:       chain,
+			module:      &Module{RawURL: "/api/users"},
+			LogFacility: Log,
+			R:           httptest.NewRequest(http.MethodGet, "/api/users", nil),
+			W:           w,
+		}
+
+		proc.deprecation()
+		proc.deprecation()
+
+		h := w.Header()
+		if h.Get(HTTPheaderDeprecation) != "@1782864000" {
+			t.Errorf("got Deprecation: %q", h.Get(HTTPheaderDeprecation))
+		}
+		if h.Get(HTTPheaderSunset) != "Sun, 31 Jan 2027 00:00:00 GMT" {
+			t.Errorf("got Sunset: %q", h.Get(HTTPheaderSunset))
+		}
+		if v := h.Values(HTTPheaderLink); len(v) != 1 || v[0] != `</api/v2/users>; rel="successor-version"` {
+			t.Errorf("got Link: %q", v)
+		}
+	}
+
+	stat := DeprecatedUsageStat()
+	if len(stat) != 1 || stat[0].Count != 3 || stat[0].User != "-" || stat[0].Chain != "old" {
+		t.Fatalf("got %#v", stat)
+	}
+
+	// Ограничение количества записей
+	defer func(n int) { DeprecatedUsageMaxEntries = n }(DeprecatedUsageMaxEntries)
+	DeprecatedUsageMaxEntries = 2
+
+	for _, user := range []string{"u1", "u2"} {
+		proc := &ProcOptions{
+			Info:         info,
+			Chain:        chain,
+			module:       &Module{RawURL: "/api/users"},
+			LogFacility:  Log,
+			AuthIdentity: &auth.Identity{User: user},
+			R:            httptest.NewRequest(http.MethodGet, "/api/users", nil),
+			W:            httptest.NewRecorder(),
+		}
+		proc.deprecation()
+	}
+
+	stat = DeprecatedUsageStat()
+	if len(stat) != 2 || stat[0].User != "u1" || stat[1].User != "u2" {
+		t.Fatalf("got %#v", stat)
+	}
+
+	// Вытесняется давно не использовавшаяся, а не самая старая
+	for _, user := range []string{"u1", "u3"} {
+		proc := &ProcOptions{
+			Info:         info,
+			Chain:        chain,
+			module:       &Module{RawURL: "/api/users"},
+			LogFacility:  Log,
+			AuthIdentity: &auth.Identity{User: user},
+			R:            httptest.NewRequest(http.MethodGet, "/api/users", nil),
+			W:            httptest.NewRecorder(),
+		}
+		proc.deprecation()
+	}
+
+	stat = DeprecatedUsageStat()
+	if len(stat) != 2 || stat[0].User != "u1" || stat[0].Count != 2 || stat[1].User != "u3" {
+		t.Fatalf("got %#v", stat)
+	}
+
+	DeprecatedUsageReset()
+	if stat = DeprecatedUsageStat(); len(stat) != 0 {
+		t.Fatalf("after reset: got %#v", stat)
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type testAPI struct {
+	info *Info
+}
+
+func (m *testAPI) Info() *Info {
+	return m.info
+}
+
+func (m *testAPI) Prepare(proc *ProcOptions) (result any, code int, err error) {
+	return misc.StringMap{"method": proc.R.Method}, 0, nil
+}
+
+func (m *testAPI) Before(proc *ProcOptions) (result any, code int, err error) {
+	return
+}
+
+func (m *testAPI) After(proc *ProcOptions) (result any, code int, err error) {
+	return
+}
+
+func TestOptionsAndHead(t *testing.T) {
+	chains := func() *path.Chains {
+		return &path.Chains{
+			Chains: path.ChainsList{
+				{Name: "all", Tokens: []*path.Token{{Expr: "", VarName: path.VarIgnore}}},
+				{Name: "items", Tokens: []*path.Token{{Expr: "items", VarName: path.VarIgnore}}},
+			},
+		}
+	}
+
+	set := &path.Set{
+		Methods: path.Methods{
+			stdhttp.MethodGET:  chains(),
+			stdhttp.MethodPOST: {Chains: path.ChainsList{{Name: "all", Tokens: []*path.Token{{Expr: "", VarName: path.VarIgnore}}}}},
+		},
+	}
+
+	err := set.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Module{RawURL: "/api/test", LogFacility: Log}
+	m.Handler = &testAPI{info: &Info{Path: "/test", Methods: set}}
+	m.Info = m.Handler.Info()
+
+	call := func(method string, tail []string) *httptest.ResponseRecorder {
+		find := func(string) (*Module, string, []string, bool) {
+			return m, m.RawURL, tail, true
+		}
+
+		w := httptest.NewRecorder()
+		HandlerEx(find, nil, nil, 1, "", m.RawURL, w, httptest.NewRequest(method, m.RawURL, nil))
+		return w
+	}
+
+	w := call(stdhttp.MethodOPTIONS, []string{})
+	if w.Code != http.StatusNoContent || w.Header().Get(HTTPheaderAllow) != "GET, HEAD, OPTIONS, POST" {
+		t.Errorf("OPTIONS: got %d, Allow: %q", w.Code, w.Header().Get(HTTPheaderAllow))
+	}
+
+	w = call(stdhttp.MethodOPTIONS, []string{"items"})
+	if w.Code != http.StatusNoContent || w.Header().Get(HTTPheaderAllow) != "GET, HEAD, OPTIONS" {
+		t.Errorf("OPTIONS items: got %d, Allow: %q", w.Code, w.Header().Get(HTTPheaderAllow))
+	}
+
+	w = call(stdhttp.MethodOPTIONS, []string{"unknown"})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("OPTIONS unknown: got %d", w.Code)
+	}
+
+	w = call(stdhttp.MethodDELETE, []string{})
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get(HTTPheaderAllow) != "GET, HEAD, OPTIONS, POST" {
+		t.Errorf("DELETE: got %d, Allow: %q", w.Code, w.Header().Get(HTTPheaderAllow))
+	}
+
+	w = call(stdhttp.MethodGET, []string{"items"})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"GET"`) {
+		t.Fatalf("GET: got %d %q", w.Code, w.Body.String())
+	}
+	length := w.Header().Get("Content-Length")
+
+	w = call(stdhttp.MethodHEAD, []string{"items"})
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("Content-Length") != length {
+		t.Errorf("HEAD: got %d, body %q, Content-Length %q (GET %q)", w.Code, w.Body.String(), w.Header().Get("Content-Length"), length)
+	}
+}
+
+type testVersionAPI struct {
+	testAPI
+	calls atomic.Int32
+}
+
+func (m *testVersionAPI) Prepare(proc *ProcOptions) (result any, code int, err error) {
+	return
+}
+
+func (m *testVersionAPI) Before(proc *ProcOptions) (result any, code int, err error) {
+	m.calls.Add(1)
+	return misc.StringMap{"version": proc.Info.Version}, 0, nil
+}
+
+func TestCacheVersionAlias(t *testing.T) {
+	newModule := func(url string, version string) *Module {
+		set := &path.Set{
+			Methods: path.Methods{
+				stdhttp.MethodGET: {
+					Chains: path.ChainsList{
+						{Name: "all", Tokens: []*path.Token{{Expr: "", VarName: path.VarIgnore}}, CacheLifetime: config.Duration(time.Minute)},
+					},
+				},
+			},
+		}
+		if err := set.Prepare(); err != nil {
+			t.Fatal(err)
+		}
+
+		m := &Module{RawURL: url, LogFacility: Log}
+		m.Handler = &testVersionAPI{testAPI: testAPI{info: &Info{Path: "/users", Version: version, Methods: set}}}
+		m.Info = m.Handler.Info()
+		return m
+	}
+
+	v1 := newModule("/api/v1/users", "v1")
+	v2 := newModule("/api/v2/users", "v2")
+	alias := &Module{
+		RawURL:   "/api/users",
+		Info:     v1.Info,
+		versions: map[string]*Module{versionKey("v1"): v1, versionKey("v2"): v2},
+	}
+
+	defer responseCache.purge(func(e *cacheEntry) bool { return true })
+
+	call := func(version string) *httptest.ResponseRecorder {
+		find := func(string) (*Module, string, []string, bool) {
+			return alias, alias.RawURL, []string{}, true
+		}
+
+		r := httptest.NewRequest(stdhttp.MethodGET, alias.RawURL, nil)
+		r.Header.Set(VersionHeader, version)
+
+		w := httptest.NewRecorder()
+		HandlerEx(find, nil, nil, 1, "", alias.RawURL, w, r)
+		return w
+	}
+
+	for range 2 {
+		for _, version := range []string{"v1", "v2"} {
+			w := call(version)
+			if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"`+version+`"`) {
+				t.Errorf("%s: got %d %q", version, w.Code, w.Body.String())
+			}
+			if v := w.Header().Get(VersionHeader); v != version {
+				t.Errorf("%s: got %s %q", version, VersionHeader, v)
+			}
+		}
+	}
+
+	// Второй круг - из кэша
+	for _, m := range []*Module{v1, v2} {
+		if n := m.Handler.(*testVersionAPI).calls.Load(); n != 1 {
+			t.Errorf("%s: %d calls, expected 1", m.RawURL, n)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+type (
+	testItemParams struct {
+		ID uint64
+	}
+
+	testSubscribeAPI struct {
+		testAPI
+		changes *atomic.Int32 // Общий для версий
+	}
+)
+
+func (m *testSubscribeAPI) Prepare(proc *ProcOptions) (result any, code int, err error) {
+	return
+}
+
+func (m *testSubscribeAPI) Before(proc *ProcOptions) (result any, code int, err error) {
+	id := proc.PathParams.(*testItemParams).ID
+
+	if proc.R.Method == stdhttp.MethodGET {
+		return misc.InterfaceMap{"id": id, "version": proc.Info.Version, "changes": m.changes.Load()}, 0, nil
+	}
+
+	m.changes.Add(1)
+
+	r := NewExecResultRow()
+	r.Code = http.StatusOK
+	r.ID = id
+
+	er := NewExecResult()
+	er.AddRow(r)
+	proc.ExecResult = er
+
+	return er, 0, nil
+}
+
+func newTestSubscribeModule(t *testing.T, url string, version string, changes *atomic.Int32) *Module {
+	chain := func() *path.Chains {
+		return &path.Chains{
+			StdParams: path.Params{
+				Flags:             path.FlagRequestDontMakeFlatModel,
+				PathParamsPattern: testItemParams{},
+			},
+			Chains: path.ChainsList{
+				{Name: "byID", Tokens: []*path.Token{{Expr: `\d+`, VarName: "ID"}}, CacheLifetime: config.Duration(time.Minute)},
+			},
+		}
+	}
+
+	set := &path.Set{
+		Methods: path.Methods{
+			stdhttp.MethodGET: chain(),
+			stdhttp.MethodPUT: chain(),
+		},
+	}
+	if err := set.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Module{RawURL: url, LogFacility: Log}
+	m.Handler = &testSubscribeAPI{testAPI: testAPI{info: &Info{Path: "/items", Version: version, Flags: FlagSubscriptions, Methods: set}}, changes: changes}
+	m.Info = m.Handler.Info()
+	return m
+}
+
+// Сервер с заданными модулями, без глобального реестра
+func newTestServer(list ...*Module) *httptest.Server {
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			find := func(p string) (*Module, string, []string, bool) {
+				for _, m := range list {
+					tail, ok := strings.CutPrefix(p, m.RawURL)
+					if !ok || (tail != "" && tail[0] != '/') {
+						continue
+					}
+
+					tail = strings.Trim(tail, "/")
+					if tail == "" {
+						return m, m.RawURL, []string{}, true
+					}
+					return m, m.RawURL, strings.Split(tail, "/"), true
+				}
+				return nil, "", nil, false
+			}
+
+			HandlerEx(find, nil, nil, 1, "", r.URL.Path, w, r)
+		}),
+	)
+}
+
+type testWsClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTestWs(t *testing.T, srv *httptest.Server, url string, header string) *testWsClient {
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fmt.Fprintf(conn,
+		"GET %s HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n%s\r\n",
+		url, header,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testWsClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(c.r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("%s: got %d, Sec-WebSocket-Accept %q", url, resp.StatusCode, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	return c
+}
+
+// Серверные фреймы не замаскированы, ping пропускаются
+func (c *testWsClient) read() *SubscriptionMessage {
+	for {
+		_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		var hdr [2]byte
+		if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+			c.t.Fatal(err)
+		}
+
+		ln := uint64(hdr[1] & 0x7f)
+		switch ln {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+				c.t.Fatal(err)
+			}
+			ln = uint64(ext[0])<<8 | uint64(ext[1])
+		case 127:
+			c.t.Fatal("unexpected frame length")
+		}
+
+		payload := make([]byte, ln)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			c.t.Fatal(err)
+		}
+
+		if op := hdr[0] & 0x0f; op != wsOpText {
+			if op == wsOpPing {
+				continue
+			}
+			c.t.Fatalf("unexpected frame %d", op)
+		}
+
+		msg := &SubscriptionMessage{}
+		if err := json.Unmarshal(payload, msg); err != nil {
+			c.t.Fatalf("%s: %q", err, payload)
+		}
+		return msg
+	}
+}
+
+func (c *testWsClient) close() {
+	// Пустой close фрейм с нулевой маской
+	_, _ = c.conn.Write([]byte{0x80 | wsOpClose, 0x80, 0, 0, 0, 0})
+	c.conn.Close()
+}
+
+func TestSubscription(t *testing.T) {
+	defer responseCache.purge(func(e *cacheEntry) bool { return true })
+
+	m := newTestSubscribeModule(t, "/api/items", "", new(atomic.Int32))
+
+	srv := newTestServer(m)
+	defer srv.Close()
+
+	ws := dialTestWs(t, srv, "/api/items/7", "")
+	defer ws.close()
+
+	msg := ws.read()
+	if msg.Event != SubscriptionEventSnapshot || msg.Code != http.StatusOK || !strings.Contains(string(msg.Data), `"changes":0`) {
+		t.Fatalf("snapshot: got %#v, data %s", msg, msg.Data)
+	}
+
+	// Изменение другого ресурса не должно приходить
+	for _, id := range []string{"8", "7"} {
+		putTestItem(t, srv, "/api/items/"+id)
+	}
+
+	msg = ws.read()
+	if msg.Event != SubscriptionEventChange || msg.Method != stdhttp.MethodPUT || msg.Code != http.StatusOK || !strings.Contains(string(msg.Data), `"changes":2`) {
+		t.Errorf("change: got %#v, data %s", msg, msg.Data)
+	}
+}
+
+func putTestItem(t *testing.T, srv *httptest.Server, url string) {
+	req, err := http.NewRequest(stdhttp.MethodPUT, srv.URL+url, strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT %s: got %d", url, resp.StatusCode)
+	}
+}
+
+func getTestItem(t *testing.T, srv *httptest.Server, url string, version string) string {
+	req, err := http.NewRequest(stdhttp.MethodGET, srv.URL+url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "" {
+		req.Header.Set(VersionHeader, version)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: got %d %q", url, resp.StatusCode, body)
+	}
+
+	return string(body)
+}
+
+// Изменение через одну версию сбрасывает кэш и оповещает подписчиков других версий и пути без версии
+func TestVersionsChange(t *testing.T) {
+	defer responseCache.purge(func(e *cacheEntry) bool { return true })
+
+	changes := new(atomic.Int32)
+
+	v1 := newTestSubscribeModule(t, "/api/v1/items", "v1", changes)
+	v2 := newTestSubscribeModule(t, "/api/v2/items", "v2", changes)
+	alias := &Module{
+		RawURL:   "/api/items",
+		Info:     v1.Info,
+		versions: map[string]*Module{versionKey("v1"): v1, versionKey("v2"): v2},
+	}
+
+	urls := []string{alias.RawURL, v1.RawURL, v2.RawURL}
+	for _, m := range []*Module{v1, v2, alias} {
+		m.versionURLs = urls
+	}
+
+	srv := newTestServer(v1, v2, alias)
+	defer srv.Close()
+
+	clients := []*testWsClient{
+		dialTestWs(t, srv, "/api/v1/items/7", ""),
+		dialTestWs(t, srv, "/api/items/7", ""),
+	}
+
+	for i, ws := range clients {
+		defer ws.close()
+
+		if msg := ws.read(); msg.Event != SubscriptionEventSnapshot {
+			t.Fatalf("[%d] snapshot: got %#v", i, msg)
+		}
+	}
+
+	// В кэше
+	for _, url := range []string{"/api/v1/items/7", "/api/items/7"} {
+		if body := getTestItem(t, srv, url, ""); !strings.Contains(body, `"changes":0`) {
+			t.Fatalf("GET %s: got %s", url, body)
+		}
+	}
+
+	putTestItem(t, srv, "/api/v2/items/7")
+
+	for i, ws := range clients {
+		msg := ws.read()
+		if msg.Event != SubscriptionEventChange || msg.Method != stdhttp.MethodPUT || !strings.Contains(string(msg.Data), `"changes":1`) {
+			t.Errorf("[%d] change: got %#v, data %s", i, msg, msg.Data)
+		}
+	}
+
+	for _, c := range []struct {
+		url     string
+		version string
+	}{
+		{"/api/v1/items/7", ""},
+		{"/api/items/7", ""},
+		{"/api/items/7", "v1"},
+	} {
+		if body := getTestItem(t, srv, c.url, c.version); !strings.Contains(body, `"changes":1`) {
+			t.Errorf("GET %s (%s): got %s", c.url, c.version, body)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func TestCORS(t *testing.T) {
+	cors := &CORSConfig{
+		AllowedOrigins:   []string{"https://*.example.com/", "http://localhost:8080"},
+		AllowedMethods:   []string{"get", "head", "options"},
+		ExposedHeaders:   []string{"x-total"},
+		AllowCredentials: true,
+		MaxAge:           config.Duration(10 * time.Minute),
+	}
+
+	err := cors.Check(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = (&CORSConfig{AllowedOrigins: []string{"https://*.*.com"}}).Check(nil)
+	if err == nil {
+		t.Errorf("two wildcards: error expected")
+	}
+
+	err = (&CORSConfig{AllowedOrigins: []string{" * "}, AllowCredentials: true}).Check(nil)
+	if err == nil {
+		t.Errorf("any origin with credentials: error expected")
+	}
+
+	// Программно заданная глобальная политика проверяется при старте, загруженная из конфига - нет
+	defer func(d *CORSConfig, l *CORSConfig) { DefaultCORS, loadedCORS = d, l }(DefaultCORS, loadedCORS)
+
+	DefaultCORS = &CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}
+	if checkGlobalCORS() == nil {
+		t.Errorf("DefaultCORS: error expected")
+	}
+
+	loadedCORS = cors
+	DefaultCORS = cors
+	cors.AllowedOrigins = append(cors.AllowedOrigins, "https://*.*.com") // Не должна проверяться повторно
+	if err = checkGlobalCORS(); err != nil {
+		t.Errorf("loaded DefaultCORS is checked again: %s", err)
+	}
+	cors.AllowedOrigins = cors.AllowedOrigins[:len(cors.AllowedOrigins)-1]
+	DefaultCORS = nil
+
+	set := &path.Set{
+		Methods: path.Methods{
+			stdhttp.MethodGET: {
+				Chains: path.ChainsList{
+					{
+						Name:   "all",
+						Tokens: []*path.Token{{Expr: "", VarName: path.VarIgnore}},
+						Params: path.Params{OutHeaders: misc.StringMap{"X-Request-Id": "Request ID"}},
+					},
+				},
+			},
+			stdhttp.MethodPOST: {Chains: path.ChainsList{{Name: "all", Tokens: []*path.Token{{Expr: "", VarName: path.VarIgnore}}}}},
+		},
+	}
+
+	err = set.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Module{RawURL: "/api/cors", LogFacility: Log}
+	m.Handler = &testAPI{info: &Info{Path: "/cors", Methods: set, CORS: cors}}
+	m.Info = m.Handler.Info()
+
+	call := func(method string, headers misc.StringMap) *httptest.ResponseRecorder {
+		find := func(string) (*Module, string, []string, bool) {
+			return m, m.RawURL, []string{}, true
+		}
+
+		r := httptest.NewRequest(method, m.RawURL, nil)
+		for n, v := range headers {
+			r.Header.Set(n, v)
+		}
+
+		w := httptest.NewRecorder()
+		HandlerEx(find, nil, nil, 1, "", m.RawURL, w, r)
+		return w
+	}
+
+	// Preflight
+	w := call(stdhttp.MethodOPTIONS, misc.StringMap{
+		HTTPheaderOrigin:                      "https://app.example.com",
+		HTTPheaderAccessControlRequestMethod:  "GET",
+		HTTPheaderAccessControlRequestHeaders: "X-Token",
+	})
+	h := w.Header()
+	if w.Code != http.StatusNoContent ||
+		h.Get(HTTPheaderAccessControlAllowOrigin) != "https://app.example.com" ||
+		h.Get(HTTPheaderAccessControlAllowMethods) != "GET, HEAD, OPTIONS" ||
+		h.Get(HTTPheaderAccessControlAllowHeaders) != "X-Token" ||
+		h.Get(HTTPheaderAccessControlAllowCredentials) != "true" ||
+		h.Get(HTTPheaderAccessControlMaxAge) != "600" {
+		t.Errorf("preflight: got %d, headers %v", w.Code, h)
+	}
+
+	// Preflight для неразрешенного метода
+	w = call(stdhttp.MethodOPTIONS, misc.StringMap{
+		HTTPheaderOrigin:                     "https://app.example.com",
+		HTTPheaderAccessControlRequestMethod: "POST",
+	})
+	if w.Code != http.StatusNoContent || w.Header().Get(HTTPheaderAccessControlAllowOrigin) != "" {
+		t.Errorf("preflight POST: got %d, headers %v", w.Code, w.Header())
+	}
+
+	// Обычный запрос
+	w = call(stdhttp.MethodGET, misc.StringMap{HTTPheaderOrigin: "http://localhost:8080"})
+	h = w.Header()
+	if w.Code != http.StatusOK ||
+		h.Get(HTTPheaderAccessControlAllowOrigin) != "http://localhost:8080" ||
+		h.Get(HTTPheaderAccessControlExposeHeaders) != "X-Request-Id, X-Total" ||
+		!strings.Contains(h.Get(HTTPheaderVary), HTTPheaderOrigin) {
+		t.Errorf("GET: got %d, headers %v", w.Code, h)
+	}
+
+	// Без Origin - только Vary
+	w = call(stdhttp.MethodGET, nil)
+	h = w.Header()
+	if w.Code != http.StatusOK || h.Get(HTTPheaderAccessControlAllowOrigin) != "" || !strings.Contains(h.Get(HTTPheaderVary), HTTPheaderOrigin) {
+		t.Errorf("GET without Origin: got %d, headers %v", w.Code, h)
+	}
+
+	// Неразрешенный Origin
+	w = call(stdhttp.MethodGET, misc.StringMap{HTTPheaderOrigin: "https://example.com"})
+	if w.Code != http.StatusOK || w.Header().Get(HTTPheaderAccessControlAllowOrigin) != "" {
+		t.Errorf("GET foreign: got %d, headers %v", w.Code, w.Header())
+	}
+
+	// Отключено для модуля
+	m.Info.CORS = &CORSConfig{Disabled: true}
+	defer func() { m.Info.CORS = nil }()
+	w = call(stdhttp.MethodGET, misc.StringMap{HTTPheaderOrigin: "http://localhost:8080"})
+	if w.Header().Get(HTTPheaderAccessControlAllowOrigin) != "" {
+		t.Errorf("disabled: headers %v", w.Header())
+	}
+
+	// Блок CORS в конфиге модуля: пустой не отменяет глобальную политику
+	DefaultCORS = cors
+
+	type moduleConfig struct {
+		CORS CORSConfig
+	}
+	type modulePtrConfig struct {
+		CORS *CORSConfig
+	}
+
+	for i, c := range []struct {
+		cfg      any
+		expected *CORSConfig
+	}{
+		{&moduleConfig{}, cors},
+		{&modulePtrConfig{}, cors},
+		{&modulePtrConfig{CORS: &CORSConfig{}}, cors},
+		{&moduleConfig{CORS: CORSConfig{Disabled: true}}, nil},
+		{&moduleConfig{CORS: CORSConfig{AllowedOrigins: []string{"https://other.com"}}}, nil},
+	} {
+		info := &Info{Config: c.cfg}
+		if err := info.findCORSConfig(); err != nil {
+			t.Fatalf("[%d] %s", i, err)
+		}
+
+		policy := info.corsPolicy()
+		switch {
+		case c.expected != nil && (info.CORS != nil || policy != c.expected):
+			t.Errorf("[%d] got %#v, expected the global policy", i, info.CORS)
+		case c.expected == nil && info.CORS == nil:
+			t.Errorf("[%d] module policy is not found", i)
+		}
+	}
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
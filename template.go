@@ -0,0 +1,231 @@
+package rest
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	path "github.com/alrusov/rest/v4/path"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Описание цепочки шаблоном пути, например
+//
+//	/{id:\d+}/items/{guid:guid}/*
+//
+// Элементы шаблона:
+//   - text - постоянный элемент пути (VarName = path.VarIgnore);
+//   - {var} - переменная. Если var совпадает с именем стандартного шаблона (см. PathPatterns), то используется он, иначе REname;
+//   - {var:expr} - переменная с выражением. expr - имя стандартного шаблона или регулярное выражение;
+//   - * - разрешить остаток пути (FlagChainEnableTail), он доступен в ProcOptions.Tail. Допустим только последним элементом;
+//   - *var или *var:expr - остаток пути (один и более элементов) в переменную (path.FlagTokenTail). Поле - string или []string,
+//     каждый элемент должен соответствовать expr (по умолчанию REname). Допустим только последним элементом.
+//
+// Имя переменной приводится к имени поля PathParamsPattern: id, guid, name, status - к path.VarID, path.VarGUID,
+// path.VarName и path.VarStatus, в остальных случаях первая буква делается заглавной. Переменная _ игнорируется.
+// Пустой шаблон или / - цепочка для пустого пути.
+
+var (
+	// Стандартные шаблоны переменных
+	PathPatterns = map[string]string{
+		ExprID:     REid,
+		ExprGUID:   REguid,
+		ExprName:   REname,
+		ExprStatus: REstatus,
+		ExprAny:    REany,
+	}
+
+	stdPathVars = map[string]string{
+		strings.ToLower(path.VarID):     path.VarID,
+		strings.ToLower(path.VarGUID):   path.VarGUID,
+		strings.ToLower(path.VarName):   path.VarName,
+		strings.ToLower(path.VarStatus): path.VarStatus,
+	}
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Цепочка по шаблону
+func ParseChain(template string) (chain *path.Chain, err error) {
+	elems, err := splitTemplate(template)
+	if err != nil {
+		err = fmt.Errorf(`template "%s": %s`, template, err)
+		return
+	}
+
+	chain = &path.Chain{}
+
+	if len(elems) == 0 {
+		chain.Tokens = []*path.Token{{Expr: REempty, VarName: path.VarIgnore}}
+		return
+	}
+
+	chain.Tokens = make([]*path.Token, 0, len(elems))
+
+	for i, elem := range elems {
+		if strings.HasPrefix(elem, "*") {
+			if i != len(elems)-1 {
+				err = fmt.Errorf(`template "%s": "%s" must be the last element`, template, elem)
+				return
+			}
+
+			if elem == "*" {
+				chain.Flags |= path.FlagChainEnableTail
+				break
+			}
+
+			var token *path.Token
+			token, err = parseTemplateElem("{" + elem[1:] + "}")
+			if err != nil {
+				err = fmt.Errorf(`template "%s": %s`, template, err)
+				return
+			}
+
+			token.Flags |= path.FlagTokenTail
+			chain.Tokens = append(chain.Tokens, token)
+			break
+		}
+
+		var token *path.Token
+		token, err = parseTemplateElem(elem)
+		if err != nil {
+			err = fmt.Errorf(`template "%s": %s`, template, err)
+			return
+		}
+
+		chain.Tokens = append(chain.Tokens, token)
+	}
+
+	if len(chain.Tokens) == 0 {
+		err = fmt.Errorf(`template "%s": at least one element is required before the tail`, template)
+		return
+	}
+
+	return
+}
+
+// Цепочка по шаблону с паникой при ошибке. Для описаний цепочек в литералах
+func MustChain(template string) *path.Chain {
+	chain, err := ParseChain(template)
+	if err != nil {
+		panic(err)
+	}
+
+	return chain
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Разбиение шаблона на элементы. Внутри {} символ / не является разделителем
+func splitTemplate(template string) (elems []string, err error) {
+	template = strings.TrimPrefix(template, "/")
+	if template == "" {
+		return
+	}
+
+	depth := 0
+	start := 0
+
+	for i, c := range template {
+		switch c {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth < 0 {
+				err = fmt.Errorf(`unbalanced "}" at %d`, i)
+				return
+			}
+		case '/':
+			if depth == 0 {
+				elems = append(elems, template[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	if depth != 0 {
+		err = fmt.Errorf(`unbalanced "{"`)
+		return
+	}
+
+	elems = append(elems, template[start:])
+
+	for _, elem := range elems {
+		if elem == "" {
+			err = fmt.Errorf(`empty element`)
+			return
+		}
+	}
+
+	return
+}
+
+// Токен по элементу шаблона
+func parseTemplateElem(elem string) (token *path.Token, err error) {
+	if !strings.HasPrefix(elem, "{") {
+		if strings.ContainsAny(elem, "{}") {
+			err = fmt.Errorf(`"%s": a variable must be the whole element`, elem)
+			return
+		}
+
+		token = &path.Token{Expr: regexp.QuoteMeta(elem), VarName: path.VarIgnore}
+		return
+	}
+
+	if !strings.HasSuffix(elem, "}") {
+		err = fmt.Errorf(`"%s": a variable must be the whole element`, elem)
+		return
+	}
+
+	name, expr, withExpr := strings.Cut(elem[1:len(elem)-1], ":")
+
+	if name == "" {
+		err = fmt.Errorf(`"%s": empty variable name`, elem)
+		return
+	}
+
+	if !withExpr {
+		expr = strings.ToLower(name)
+		if _, exists := PathPatterns[expr]; !exists {
+			expr = REname
+		}
+	}
+
+	if expr == "" {
+		err = fmt.Errorf(`"%s": empty expression`, elem)
+		return
+	}
+
+	if re, exists := PathPatterns[expr]; exists {
+		expr = re
+	}
+
+	_, err = regexp.Compile(expr)
+	if err != nil {
+		err = fmt.Errorf(`"%s": %s`, elem, err)
+		return
+	}
+
+	token = &path.Token{Expr: expr, VarName: templateVarName(name)}
+	return
+}
+
+// Имя поля PathParamsPattern по имени переменной шаблона
+func templateVarName(name string) string {
+	if name == path.VarIgnore {
+		return name
+	}
+
+	if v, exists := stdPathVars[strings.ToLower(name)]; exists {
+		return v
+	}
+
+	r, n := utf8.DecodeRuneInString(name)
+	return string(unicode.ToUpper(r)) + name[n:]
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,251 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/alrusov/misc"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Версии API.
+//
+// Один и тот же API регистрируется в нескольких версиях через ModuleVersionsRegistration. Каждая версия получает
+// свою копию Info (Version.Tune может ее изменить) и свой путь: base/<версия>/<Path>, например /api/v2/users.
+// Кроме того, регистрируется путь без версии (/api/users), на котором версия выбирается:
+//   - по заголовку VersionHeader (API-Version: v2);
+//   - по параметру VersionMediaParam в Accept (Accept: application/json; version=2);
+//   - иначе версия по умолчанию.
+//
+// Версии сравниваются без учета регистра и префикса v: v2, V2 и 2 - одна и та же версия.
+// Неизвестная версия - 400. Выбранная версия возвращается в заголовке VersionHeader.
+//
+// Все версии работают с одними и теми же данными, поэтому изменение через любую из них сбрасывает кэш
+// и оповещает подписчиков всех версий и пути без версии.
+
+type (
+	// Версия модуля
+	Version struct {
+		Name    string   // Имя версии, элемент пути, например v2
+		Default bool     // Версия по умолчанию для пути без версии. Если ни одна не отмечена, то последняя
+		Tune    FuncInit // Изменение копии Info для этой версии
+	}
+)
+
+var (
+	// Заголовок с версией в запросе и ответе
+	VersionHeader = "API-Version"
+
+	// Параметр media type в Accept с версией
+	VersionMediaParam = "version"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Регистрация модуля в нескольких версиях
+func ModuleVersionsRegistration(handler API, versions ...*Version) (err error) {
+	modulesMutex.Lock()
+	defer modulesMutex.Unlock()
+
+	src := handler.Info()
+	if src == nil {
+		return fmt.Errorf(`info is nil for [%#v]"`, handler)
+	}
+
+	if len(versions) == 0 {
+		return fmt.Errorf("[%s] no versions", src.Path)
+	}
+
+	registered := make(map[string]*Module, len(versions))
+	var def *Module
+
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		// Откат уже зарегистрированных версий
+		for _, m := range registered {
+			if m.parent != nil {
+				delete(m.parent.children, m.Info.Parent.Name)
+			} else {
+				delete(modules, m.RawURL)
+			}
+			httpHdl.DelEndpointsInfo(misc.StringMap{m.RawURL: ""})
+		}
+		rebuildRoutes()
+	}()
+
+	for _, v := range versions {
+		name := strings.TrimSpace(v.Name)
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf(`[%s] illegal version name "%s"`, src.Path, v.Name)
+		}
+
+		key := versionKey(name)
+		if _, exists := registered[key]; exists {
+			return fmt.Errorf(`[%s] duplicate version "%s"`, src.Path, name)
+		}
+
+		info := src.clone()
+		info.Version = name
+
+		if v.Tune != nil {
+			err = v.Tune(info)
+			if err != nil {
+				return fmt.Errorf("[%s] %s: %w", src.Path, name, err)
+			}
+		}
+
+		var m *Module
+		m, err = registerModule(handler, info)
+		if err != nil {
+			return
+		}
+
+		registered[key] = m
+
+		if v.Default || (def == nil && v == versions[len(versions)-1]) {
+			def = m
+		}
+	}
+
+	urls := make([]string, 0, len(registered)+1)
+	for _, m := range registered {
+		urls = append(urls, m.RawURL)
+	}
+
+	setURLs := func() {
+		sort.Strings(urls)
+		for _, m := range registered {
+			m.versionURLs = urls
+		}
+	}
+
+	if src.Parent != nil {
+		// Путь без версии вложенного модуля - путь без версии родителя, выбор версии там
+		setURLs()
+		return
+	}
+
+	url, _ := moduleURL(src.Path, "")
+	if _, exists := modules[url]; exists {
+		return fmt.Errorf(`[%s] %s already registered"`, src.Path, url)
+	}
+
+	alias := &Module{
+		RawURL:      url,
+		RelativeURL: def.RelativeURL,
+		Handler:     handler,
+		Info:        def.Info,
+		LogFacility: def.LogFacility,
+		versions:    registered,
+	}
+
+	urls = append(urls, url)
+	setURLs()
+	alias.versionURLs = urls
+
+	modules[url] = alias
+	rebuildRoutes()
+
+	httpHdl.AddEndpointsInfo(
+		misc.StringMap{
+			url: def.Info.Summary,
+		},
+	)
+
+	return
+}
+
+// Копия Info для версии
+func (info *Info) clone() *Info {
+	c := *info
+
+	c.Tags = append([]string(nil), info.Tags...)
+	c.Methods = info.Methods.Clone()
+
+	if info.Parent != nil {
+		parent := *info.Parent
+		c.Parent = &parent
+	}
+
+	return &c
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Список зарегистрированных версий
+func Versions() (list []string) {
+	modulesMutex.RLock()
+	defer modulesMutex.RUnlock()
+
+	found := make(misc.BoolMap)
+
+	for _, m := range modules {
+		if m.versions != nil || m.Info.Version == "" || found[m.Info.Version] {
+			continue
+		}
+
+		found[m.Info.Version] = true
+		list = append(list, m.Info.Version)
+	}
+
+	sort.Strings(list)
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Ключ для сравнения версий
+func versionKey(v string) string {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if len(v) > 1 && v[0] == 'v' {
+		v = v[1:]
+	}
+
+	return v
+}
+
+// URL модуля, а для версий - URL всех версий и пути без версии
+func (proc *ProcOptions) moduleURLs() []string {
+	if proc.module == nil || len(proc.module.versionURLs) == 0 {
+		return []string{proc.moduleURL()}
+	}
+
+	return proc.module.versionURLs
+}
+
+// Модуль версии, запрошенной в заголовках. Для модулей без версий - он сам
+func (m *Module) selectVersion(r *http.Request) (selected *Module, err error) {
+	if m.versions == nil {
+		return m, nil
+	}
+
+	v := strings.TrimSpace(r.Header.Get(VersionHeader))
+
+	if v == "" {
+		for _, item := range parseQList(r.Header, "Accept") {
+			if x, exists := item.Params[VersionMediaParam]; exists {
+				v = x
+				break
+			}
+		}
+	}
+
+	if v == "" {
+		return m.versions[versionKey(m.Info.Version)], nil
+	}
+
+	selected, exists := m.versions[versionKey(v)]
+	if !exists {
+		return m, fmt.Errorf(`unknown API version "%s"`, v)
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
@@ -0,0 +1,256 @@
+package rest
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Минимальная серверная реализация WebSocket (RFC 6455), достаточная для push уведомлений
+
+type (
+	wsConn struct {
+		conn   net.Conn
+		rw     *bufio.ReadWriter
+		wMutex sync.Mutex
+	}
+)
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+
+	wsCloseNormal   = 1000
+	wsCloseGoingWay = 1001
+	wsCloseTooBig   = 1009
+
+	wsMaxIncomingPayload = 64 * 1024
+	wsWriteTimeout       = 10 * time.Second
+	wsPingInterval       = 30 * time.Second
+)
+
+var (
+	errWsFrameTooBig = errors.New("websocket frame too big")
+)
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Является ли запрос запросом на WebSocket соединение
+func isWebSocketRequest(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") &&
+		headerContainsToken(r.Header, "Upgrade", "websocket")
+}
+
+func headerContainsToken(h http.Header, name string, token string) bool {
+	for _, s := range h[http.CanonicalHeaderKey(name)] {
+		for v := range strings.SplitSeq(s, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+// Handshake и перехват соединения. Если code != 0, то соединение не перехвачено и можно отвечать обычным образом
+func wsAccept(w http.ResponseWriter, r *http.Request) (ws *wsConn, code int, err error) {
+	if r.Method != http.MethodGet {
+		code = http.StatusMethodNotAllowed
+		err = fmt.Errorf("websocket handshake requires GET")
+		return
+	}
+
+	if v := r.Header.Get("Sec-WebSocket-Version"); v != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		code = http.StatusUpgradeRequired
+		err = fmt.Errorf(`unsupported websocket version "%s"`, v)
+		return
+	}
+
+	key := strings.TrimSpace(r.Header.Get("Sec-WebSocket-Key"))
+	if key == "" {
+		code = http.StatusBadRequest
+		err = fmt.Errorf("empty Sec-WebSocket-Key")
+		return
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		code = http.StatusInternalServerError
+		err = fmt.Errorf("hijack: %w", err)
+		return
+	}
+
+	ws = &wsConn{
+		conn: conn,
+		rw:   rw,
+	}
+
+	answer := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n\r\n"
+
+	ws.wMutex.Lock()
+	defer ws.wMutex.Unlock()
+
+	_ = conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+
+	_, err = rw.WriteString(answer)
+	if err == nil {
+		err = rw.Flush()
+	}
+
+	if err != nil {
+		conn.Close()
+		ws = nil
+		return
+	}
+
+	return
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (ws *wsConn) WriteMessage(op byte, data []byte) (err error) {
+	ws.wMutex.Lock()
+	defer ws.wMutex.Unlock()
+
+	_ = ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+
+	err = wsWriteFrame(ws.rw.Writer, op, data)
+	if err != nil {
+		return
+	}
+
+	return ws.rw.Flush()
+}
+
+// Серверные фреймы не маскируются
+func wsWriteFrame(w io.Writer, op byte, data []byte) (err error) {
+	ln := len(data)
+
+	hdr := make([]byte, 2, 10)
+	hdr[0] = 0x80 | op // FIN
+
+	switch {
+	case ln < 126:
+		hdr[1] = byte(ln)
+	case ln <= 0xFFFF:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(ln))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(ln))
+	}
+
+	_, err = w.Write(hdr)
+	if err != nil {
+		return
+	}
+
+	if ln > 0 {
+		_, err = w.Write(data)
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (ws *wsConn) ReadFrame() (op byte, payload []byte, err error) {
+	return wsReadFrame(ws.rw.Reader)
+}
+
+// Клиентские фреймы обязаны быть замаскированы
+func wsReadFrame(r io.Reader) (op byte, payload []byte, err error) {
+	var hdr [2]byte
+	_, err = io.ReadFull(r, hdr[:])
+	if err != nil {
+		return
+	}
+
+	op = hdr[0] & 0x0F
+	masked := hdr[1]&0x80 != 0
+	ln := uint64(hdr[1] & 0x7F)
+
+	switch ln {
+	case 126:
+		var b [2]byte
+		_, err = io.ReadFull(r, b[:])
+		if err != nil {
+			return
+		}
+		ln = uint64(binary.BigEndian.Uint16(b[:]))
+
+	case 127:
+		var b [8]byte
+		_, err = io.ReadFull(r, b[:])
+		if err != nil {
+			return
+		}
+		ln = binary.BigEndian.Uint64(b[:])
+	}
+
+	if !masked {
+		err = fmt.Errorf("unmasked client frame")
+		return
+	}
+
+	if ln > wsMaxIncomingPayload {
+		err = fmt.Errorf("%w (%d bytes)", errWsFrameTooBig, ln)
+		return
+	}
+
+	var mask [4]byte
+	_, err = io.ReadFull(r, mask[:])
+	if err != nil {
+		return
+	}
+
+	payload = make([]byte, ln)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//
+
+func (ws *wsConn) Close(code int, reason string) {
+	data := binary.BigEndian.AppendUint16(nil, uint16(code))
+	data = append(data, reason...)
+	_ = ws.WriteMessage(wsOpClose, data)
+	ws.conn.Close()
+}
+
+//----------------------------------------------------------------------------------------------------------------------------//